@@ -0,0 +1,347 @@
+//
+// Buckets.
+//
+// Named objects live within buckets, which must be created before any
+// object is uploaded to them:
+//
+//   PUT    /buckets/{bucket}  - Create a bucket, or change its policy.
+//   GET    /buckets/{bucket}  - Describe a bucket.
+//   DELETE /buckets/{bucket}  - Remove an empty bucket.
+//   GET    /buckets           - List the buckets.
+//
+// Each bucket has a policy, which controls the objects uploaded to it:
+//
+//   replicas   - The number of copies each object must have, within
+//                its group, rather than a copy upon every member.
+//   max_size   - The size of the largest object which may be uploaded.
+//   mime_types - The values of the `X-Mime-Type` header which uploads
+//                may have, such as `image/png` or `image/*`.
+//   public     - Whether the objects may be fetched by name via our
+//                download port, or only via our upload port.
+//
+// An upload succeeds once `replicas` members of a group have stored it,
+// and `sos replicate` then keeps that many copies, replacing any which
+// are lost, rather than copying the object to every member of the group
+// as it otherwise would.
+//
+// Buckets are recorded in our cluster metadata, with keys of the form
+// `buckets/${bucket}`, alongside the names of the objects within them.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//
+// bucketPolicy is the value recorded for each bucket.
+//
+type bucketPolicy struct {
+	// Replicas is the number of copies each object must have, or
+	// zero to store it upon every member of its group.
+	Replicas int `json:"replicas,omitempty"`
+
+	// MaxSize is the size of the largest object which may be
+	// uploaded, or zero if there is no limit.
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// MimeTypes are the MIME types objects may have, or empty if
+	// any type is allowed.
+	MimeTypes []string `json:"mime_types,omitempty"`
+
+	// Public is true if objects may be fetched via our download
+	// port.
+	Public bool `json:"public"`
+}
+
+//
+// validate returns an error if the policy is not sensible.
+//
+func (p bucketPolicy) validate() error {
+	if p.Replicas < 0 {
+		return errors.New("replicas must not be negative")
+	}
+	if p.MaxSize < 0 {
+		return errors.New("max_size must not be negative")
+	}
+	for _, t := range p.MimeTypes {
+		if strings.Count(t, "/") != 1 || strings.HasPrefix(t, "/") || strings.HasSuffix(t, "/") {
+			return errors.New("invalid MIME type " + t)
+		}
+	}
+	return nil
+}
+
+//
+// allowsType returns true if objects with the given MIME type may be
+// uploaded to the bucket.
+//
+// Any parameters of the type are ignored, and a type such as `image/*`
+// allows all images.
+//
+func (p bucketPolicy) allowsType(value string) bool {
+	if len(p.MimeTypes) == 0 {
+		return true
+	}
+
+	mimeType, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		return false
+	}
+	for _, t := range p.MimeTypes {
+		t = strings.ToLower(t)
+		if t == mimeType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mimeType, t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// quorum returns the number of members of the given group which must
+// store an object uploaded to the bucket, which is its number of replicas
+// if it has one, otherwise our default.
+//
+func (p bucketPolicy) quorum(group string, fallback func(group string) int) int {
+	if p.Replicas > 0 {
+		return p.Replicas
+	}
+	return fallback(group)
+}
+
+//
+// bucketKey returns the metadata key which holds the given bucket.
+//
+func bucketKey(bucket string) string {
+	return "buckets/" + bucket
+}
+
+//
+// lookupBucket returns the policy of the given bucket.
+//
+// The second value is false if there is no such bucket.
+//
+func (api *apiServer) lookupBucket(bucket string) (bucketPolicy, bool, error) {
+	var policy bucketPolicy
+
+	entry, found, err := api.getMeta(bucketKey(bucket))
+	if err != nil || !found {
+		return policy, false, err
+	}
+
+	err = json.Unmarshal(entry.Value, &policy)
+	if err != nil {
+		return policy, false, err
+	}
+	return policy, true, nil
+}
+
+//
+// findBucket returns the policy of the given bucket, or reports to the
+// caller that it doesn't exist.
+//
+func (api *apiServer) findBucket(res http.ResponseWriter, bucket string) (bucketPolicy, bool) {
+	policy, found, err := api.lookupBucket(bucket)
+	if err != nil {
+		jsonError(res, http.StatusInternalServerError, err.Error())
+		return policy, false
+	}
+	if !found {
+		jsonError(res, http.StatusNotFound, "no such bucket")
+		return policy, false
+	}
+	return policy, true
+}
+
+//
+// bucketEmpty returns true if there are no objects within the given
+// bucket.
+//
+func (api *apiServer) bucketEmpty(bucket string) (bool, error) {
+
+	//
+	// Deleted names aren't returned, but might fill a page, so we
+	// keep going until we find a name or run out of pages.
+	//
+	after := ""
+	for {
+		objects, next, err := api.listMeta(objectKey(bucket, ""), after, maxListLimit)
+		if err != nil {
+			return false, err
+		}
+		if len(objects) > 0 {
+			return false, nil
+		}
+		if next == "" {
+			return true, nil
+		}
+		after = next
+	}
+}
+
+//
+// bucketReply returns the description of a bucket we give to callers.
+//
+func bucketReply(bucket string, policy bucketPolicy, modified time.Time) map[string]interface{} {
+	if policy.MimeTypes == nil {
+		policy.MimeTypes = []string{}
+	}
+	return map[string]interface{}{
+		"bucket":     bucket,
+		"replicas":   policy.Replicas,
+		"max_size":   policy.MaxSize,
+		"mime_types": policy.MimeTypes,
+		"public":     policy.Public,
+		"modified":   modified,
+	}
+}
+
+// APIBucketPutHandler creates a bucket, or changes the policy of an
+// existing bucket.
+//
+// The policy is given as a JSON object in the body of the request, and
+// any values which are missing take their defaults:  an empty body
+// creates a public bucket with no restrictions.
+func (api *apiServer) APIBucketPutHandler(res http.ResponseWriter, req *http.Request) {
+	bucket := mux.Vars(req)["bucket"]
+	if !validBucket.MatchString(bucket) {
+		jsonError(res, http.StatusBadRequest, "invalid bucket")
+		return
+	}
+
+	policy := bucketPolicy{Public: true}
+	err := json.NewDecoder(io.LimitReader(req.Body, 64*1024)).Decode(&policy)
+	if err != nil && err != io.EOF {
+		jsonError(res, http.StatusBadRequest, "invalid policy")
+		return
+	}
+	err = policy.validate()
+	if err != nil {
+		jsonError(res, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	entry := MetaEntry{
+		Key:      bucketKey(bucket),
+		Modified: time.Now().UTC(),
+	}
+	entry.Value, _ = json.Marshal(policy)
+
+	err = api.putMeta(entry)
+	if err != nil {
+		jsonError(res, http.StatusInternalServerError, "failed to record bucket: "+err.Error())
+		return
+	}
+
+	reply := bucketReply(bucket, policy, entry.Modified)
+	reply["status"] = "OK"
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(reply)
+}
+
+// APIBucketGetHandler describes a bucket, and its policy.
+func (api *apiServer) APIBucketGetHandler(res http.ResponseWriter, req *http.Request) {
+	bucket := mux.Vars(req)["bucket"]
+	if !validBucket.MatchString(bucket) {
+		jsonError(res, http.StatusBadRequest, "invalid bucket")
+		return
+	}
+
+	entry, found, err := api.getMeta(bucketKey(bucket))
+	if err != nil {
+		jsonError(res, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var policy bucketPolicy
+	if !found || json.Unmarshal(entry.Value, &policy) != nil {
+		jsonError(res, http.StatusNotFound, "no such bucket")
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(bucketReply(bucket, policy, entry.Modified))
+}
+
+// APIBucketDeleteHandler removes a bucket.
+//
+// Only empty buckets may be removed, so that the objects within a bucket
+// can't be left without a policy.
+func (api *apiServer) APIBucketDeleteHandler(res http.ResponseWriter, req *http.Request) {
+	bucket := mux.Vars(req)["bucket"]
+	if !validBucket.MatchString(bucket) {
+		jsonError(res, http.StatusBadRequest, "invalid bucket")
+		return
+	}
+	if _, ok := api.findBucket(res, bucket); !ok {
+		return
+	}
+
+	empty, err := api.bucketEmpty(bucket)
+	if err != nil {
+		jsonError(res, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !empty {
+		jsonError(res, http.StatusConflict, "bucket is not empty")
+		return
+	}
+
+	err = api.putMeta(MetaEntry{
+		Key:      bucketKey(bucket),
+		Modified: time.Now().UTC(),
+		Deleted:  true,
+	})
+	if err != nil {
+		jsonError(res, http.StatusInternalServerError, "failed to remove bucket: "+err.Error())
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(map[string]interface{}{
+		"bucket": bucket,
+		"status": "OK",
+	})
+}
+
+// APIBucketListHandler lists our buckets, in order, along with their
+// policies.
+func (api *apiServer) APIBucketListHandler(res http.ResponseWriter, req *http.Request) {
+	buckets := []map[string]interface{}{}
+
+	after := ""
+	for {
+		entries, next, err := api.listMeta(bucketKey(""), after, maxListLimit)
+		if err != nil {
+			jsonError(res, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		for _, entry := range entries {
+			var policy bucketPolicy
+			if json.Unmarshal(entry.Value, &policy) != nil {
+				continue
+			}
+			bucket := strings.TrimPrefix(entry.Key, bucketKey(""))
+			buckets = append(buckets, bucketReply(bucket, policy, entry.Modified))
+		}
+
+		if next == "" {
+			break
+		}
+		after = next
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(map[string]interface{}{
+		"buckets": buckets,
+	})
+}
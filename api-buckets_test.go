@@ -0,0 +1,178 @@
+//
+// Test buckets, and their policies, via the API-server.
+//
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/skx/sos/libconfig"
+)
+
+//
+// Test matching MIME types against a policy.
+//
+func TestBucketMimeTypes(t *testing.T) {
+	policy := bucketPolicy{MimeTypes: []string{"text/plain", "image/*"}}
+
+	tests := []struct {
+		mimeType string
+		allowed  bool
+	}{
+		{"text/plain", true},
+		{"Text/Plain; charset=utf-8", true},
+		{"text/html", false},
+		{"image/png", true},
+		{"image/", false},
+		{"imagery/png", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if policy.allowsType(test.mimeType) != test.allowed {
+			t.Errorf("Unexpected result for %q, expected %v", test.mimeType, test.allowed)
+		}
+	}
+
+	if !(bucketPolicy{}).allowsType("") {
+		t.Errorf("Unrestricted bucket refused an object")
+	}
+}
+
+//
+// Test creating, using, and removing buckets.
+//
+func TestBuckets(t *testing.T) {
+
+	server, cleanup := newTestBlobServer(t)
+	defer cleanup()
+
+	config, _ := libconfig.NewFromFlag(server.URL)
+	api := newAPIServer(config, apiServerCmd{})
+	router := api.uploadRouter()
+	download := api.downloadRouter()
+
+	//
+	// Invalid policies are refused.
+	//
+	for _, policy := range []string{"{", `{"replicas":-1}`, `{"max_size":-1}`, `{"mime_types":["text"]}`} {
+		status, _ := callRouter(router, "PUT", "/buckets/test", policy)
+		if status != http.StatusBadRequest {
+			t.Errorf("Unexpected status %d for policy %s", status, policy)
+		}
+	}
+
+	//
+	// Create a bucket, and change its policy.
+	//
+	status, result := callRouter(router, "PUT", "/buckets/test", "")
+	if status != http.StatusOK || result["public"] != true {
+		t.Fatalf("Failed to create bucket: %d %v", status, result)
+	}
+	status, result = callRouter(router, "PUT", "/buckets/test", `{"max_size":10,"mime_types":["text/*"],"public":false}`)
+	if status != http.StatusOK || result["public"] != false {
+		t.Fatalf("Failed to change bucket: %d %v", status, result)
+	}
+	status, result = callRouter(router, "GET", "/buckets/test", "")
+	if status != http.StatusOK || result["max_size"] != float64(10) {
+		t.Errorf("Unexpected bucket %d %v", status, result)
+	}
+	status, _ = callRouter(router, "GET", "/buckets/missing", "")
+	if status != http.StatusNotFound {
+		t.Errorf("Unexpected status %d for a missing bucket", status)
+	}
+
+	//
+	// The policy is applied to uploads.
+	//
+	status, _ = callRouter(router, "PUT", "/objects/test/big", "this is too large")
+	if status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Unexpected status %d uploading a large object", status)
+	}
+
+	req, _ := http.NewRequest("PUT", "/objects/test/image", strings.NewReader("png"))
+	req.Header.Set("X-Mime-Type", "image/png")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Unexpected status %d uploading an image", rr.Code)
+	}
+
+	status, _ = callRouter(router, "PUT", "/objects/test/small", "small")
+	if status != http.StatusOK {
+		t.Errorf("Unexpected status %d uploading an object", status)
+	}
+
+	//
+	// Content which is already public stays so when it is also
+	// stored within a private bucket.
+	//
+	callRouter(router, "PUT", "/buckets/open", "")
+	_, result = callRouter(router, "PUT", "/objects/open/shared", "shared")
+	shared, _ := result["id"].(string)
+	callRouter(router, "PUT", "/objects/test/shared", "shared")
+
+	//
+	// Objects in a private bucket may only be fetched via our
+	// upload port.
+	//
+	tests := []struct {
+		router *mux.Router
+		path   string
+		status int
+	}{
+		{download, "/fetch/test/small", http.StatusForbidden},
+		{router, "/objects/test/small", http.StatusOK},
+		{download, "/fetch/missing/small", http.StatusNotFound},
+		{download, "/fetch/test/shared", http.StatusForbidden},
+		{download, "/fetch/open/shared", http.StatusOK},
+		{download, "/fetch/" + shared, http.StatusOK},
+	}
+	for _, test := range tests {
+		req, _ = http.NewRequest("GET", test.path, nil)
+		rr = httptest.NewRecorder()
+		test.router.ServeHTTP(rr, req)
+		if rr.Code != test.status {
+			t.Errorf("Unexpected status %d fetching %s, expected %d", rr.Code, test.path, test.status)
+		}
+	}
+
+	//
+	// More replicas than a group has members can't be stored.
+	//
+	callRouter(router, "PUT", "/buckets/copies", `{"replicas":2}`)
+	status, _ = callRouter(router, "PUT", "/objects/copies/obj", "content")
+	if status != http.StatusInternalServerError {
+		t.Errorf("Unexpected status %d uploading with too many replicas", status)
+	}
+
+	req, _ = http.NewRequest("GET", "/buckets", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if !strings.Contains(rr.Body.String(), `"bucket":"copies"`) || !strings.Contains(rr.Body.String(), `"bucket":"test"`) {
+		t.Errorf("Unexpected listing %s", rr.Body.String())
+	}
+
+	//
+	// Only empty buckets may be removed.
+	//
+	status, _ = callRouter(router, "DELETE", "/buckets/test", "")
+	if status != http.StatusConflict {
+		t.Errorf("Unexpected status %d removing a bucket", status)
+	}
+	callRouter(router, "DELETE", "/objects/test/small", "")
+	callRouter(router, "DELETE", "/objects/test/shared", "")
+	status, _ = callRouter(router, "DELETE", "/buckets/test", "")
+	if status != http.StatusOK {
+		t.Errorf("Unexpected status %d removing an empty bucket", status)
+	}
+	status, _ = callRouter(router, "GET", "/buckets/test", "")
+	if status != http.StatusNotFound {
+		t.Errorf("Unexpected status %d for a removed bucket", status)
+	}
+}
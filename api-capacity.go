@@ -0,0 +1,84 @@
+//
+// Track the capacity of our blob-servers.
+//
+// The API-server periodically fetches the `/stats` of each blob-server,
+// and records the space each has available.  This is used to direct
+// uploads to the emptiest group, and away from groups which are full.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/skx/sos/libconfig"
+)
+
+//
+// fetchStats retrieves the storage statistics of the given blob-server.
+//
+func fetchStats(server string) (StorageStats, error) {
+	var stats StorageStats
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	response, err := client.Get(server + "/stats")
+	if err != nil {
+		return stats, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return stats, fmt.Errorf("status %d", response.StatusCode)
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&stats)
+	return stats, err
+}
+
+//
+// pollCapacity fetches the statistics of each blob-server in the given
+// configuration, in parallel, and records their capacity.
+//
+// If a server cannot be contacted we forget what we knew about it, so
+// that stale figures are not used.  Failures are reported if verbose is
+// true.
+//
+func pollCapacity(config *libconfig.Config, verbose bool) {
+	var wg sync.WaitGroup
+
+	for _, s := range config.Servers() {
+		wg.Add(1)
+		go func(location string) {
+			defer wg.Done()
+
+			stats, err := fetchStats(location)
+			if err != nil {
+				if verbose {
+					fmt.Printf("Failed to fetch stats from %s: %s\n", location, err.Error())
+				}
+				config.ForgetCapacity(location)
+				return
+			}
+
+			config.SetCapacity(location, libconfig.Capacity{
+				Free:  stats.FreeBytes,
+				Total: stats.TotalBytes,
+			})
+		}(s.Location)
+	}
+	wg.Wait()
+}
+
+//
+// capacityLoop polls our blob-servers for their capacity, forever.
+//
+func capacityLoop(config *libconfig.Config, interval time.Duration, verbose bool) {
+	for {
+		pollCapacity(config, verbose)
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,88 @@
+//
+// Limit the number of concurrent requests sent to each blob-server.
+//
+// A blob-server may be configured with `max-conns=N`, and once we have
+// that many requests outstanding to it we skip it, and move on to the
+// next server, rather than queuing behind the busy one.
+//
+
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/skx/sos/libconfig"
+)
+
+//
+// errBackendBusy is returned when a blob-server already has as many
+// requests outstanding as it allows.
+//
+var errBackendBusy = errors.New("too many concurrent requests")
+
+//
+// connLimiter tracks the number of requests outstanding to each
+// blob-server.
+//
+type connLimiter struct {
+	sync.Mutex
+
+	// active holds the number of outstanding requests, by location.
+	active map[string]int
+}
+
+//
+// newConnLimiter creates a new limiter.
+//
+func newConnLimiter() *connLimiter {
+	return &connLimiter{active: make(map[string]int)}
+}
+
+//
+// acquire records the start of a request to the given server, returning
+// false if the server is already at its limit.
+//
+func (cl *connLimiter) acquire(s libconfig.BlobServer) bool {
+	cl.Lock()
+	defer cl.Unlock()
+
+	if s.MaxConns > 0 && cl.active[s.Location] >= s.MaxConns {
+		return false
+	}
+	cl.active[s.Location]++
+	return true
+}
+
+//
+// release records the end of a request to the given server.
+//
+func (cl *connLimiter) release(s libconfig.BlobServer) {
+	cl.Lock()
+	defer cl.Unlock()
+
+	cl.active[s.Location]--
+	if cl.active[s.Location] <= 0 {
+		delete(cl.active, s.Location)
+	}
+}
+
+//
+// releasingBody wraps the body of a reply, so that the request is only
+// considered complete once the body has been closed.
+//
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+//
+// Close closes the body, and releases the request.
+//
+func (rb *releasingBody) Close() error {
+	err := rb.ReadCloser.Close()
+	rb.once.Do(rb.release)
+	return err
+}
@@ -0,0 +1,84 @@
+//
+// Test limiting the requests sent to each blob-server.
+//
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/skx/sos/libconfig"
+)
+
+//
+// Test that busy servers are skipped, and released once we're done.
+//
+func TestConnLimits(t *testing.T) {
+
+	api := newAPIServer(nil, apiServerCmd{})
+
+	busy := newFakeBlobServer("obj")
+	defer busy.server.Close()
+	idle := newFakeBlobServer("obj")
+	defer idle.server.Close()
+
+	servers := []libconfig.BlobServer{
+		{Location: busy.server.URL, Group: "default", MaxConns: 1},
+		{Location: idle.server.URL, Group: "default", MaxConns: 1},
+	}
+
+	//
+	// Occupy the first server.
+	//
+	if !api.conns.acquire(servers[0]) {
+		t.Fatalf("Failed to acquire an idle server")
+	}
+	if api.conns.acquire(servers[0]) {
+		t.Fatalf("Acquired a busy server")
+	}
+
+	//
+	// Downloads go to the other server, which is busy until we've
+	// read the reply.
+	//
+	response, cancel := api.fetchObject(context.Background(), "GET", "obj", nil, servers, 0, 0)
+	if response == nil {
+		t.Fatalf("Failed to fetch the object")
+	}
+	busy.Lock()
+	asked := busy.requests["GET"]
+	busy.Unlock()
+	if asked != 0 {
+		t.Errorf("The busy server was asked for the object")
+	}
+	if api.conns.acquire(servers[1]) {
+		t.Errorf("Acquired a server while it was replying")
+	}
+	ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	cancel()
+
+	if !api.conns.acquire(servers[1]) {
+		t.Fatalf("The server wasn't released")
+	}
+
+	//
+	// Uploads skip busy servers too.
+	//
+	body := strings.NewReader("content of new")
+	stored, attempts := api.storeReplicas(servers, "new", body, int64(body.Len()), nil, func(string) int { return 1 })
+	if len(stored) != 0 || len(attempts) != 2 || attempts[0].Error != errBackendBusy.Error() {
+		t.Errorf("Unexpected result %v %v", stored, attempts)
+	}
+
+	api.conns.release(servers[0])
+	api.conns.release(servers[1])
+
+	stored, _ = api.storeReplicas(servers, "new", body, int64(body.Len()), nil, func(string) int { return 1 })
+	if len(stored) != 1 || stored[0] != busy.server.URL {
+		t.Errorf("Unexpected result %v", stored)
+	}
+}
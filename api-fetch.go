@@ -0,0 +1,255 @@
+//
+// Fetch objects from our blob-servers.
+//
+// Rather than trying each blob-server strictly in turn we use hedged
+// requests: we ask the first server, and if it hasn't replied after a
+// short delay we also ask the next, and so on.  Whichever server replies
+// successfully first is used, and the other requests are cancelled.
+//
+// Each request also has a timeout, so that a server which has hung can't
+// stall a download.
+//
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/skx/sos/libconfig"
+)
+
+//
+// errBackendTimeout is returned when a blob-server doesn't reply in time.
+//
+var errBackendTimeout = errors.New("timed out waiting for a reply")
+
+//
+// fetchResult holds the outcome of asking a single blob-server for an
+// object.
+//
+type fetchResult struct {
+	server   libconfig.BlobServer
+	response *http.Response
+	err      error
+	cancel   context.CancelFunc
+}
+
+//
+// fetchFrom asks a single blob-server for the given object, sending the
+// outcome to the given channel.  The given headers are added to the
+// request.
+//
+// The timeout applies only to receiving the headers of the reply, since
+// the body of a large object may take a long time to stream.
+//
+func (api *apiServer) fetchFrom(ctx context.Context, method string, id string, header http.Header, server libconfig.BlobServer, timeout time.Duration, results chan<- fetchResult) {
+
+	ctx, cancel := context.WithCancel(ctx)
+	result := fetchResult{server: server, cancel: cancel}
+
+	req, err := http.NewRequest(method, server.Location+"/blob/"+id, nil)
+	if err != nil {
+		result.err = err
+		results <- result
+		return
+	}
+	for name, value := range header {
+		req.Header[name] = value
+	}
+
+	//
+	// Don't add to the load of a server which is busy.
+	//
+	if !api.conns.acquire(server) {
+		result.err = errBackendBusy
+		results <- result
+		return
+	}
+
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, cancel)
+	}
+
+	result.response, result.err = http.DefaultClient.Do(req.WithContext(ctx))
+
+	//
+	// If the timer fired we've been cancelled, even if we
+	// received a reply just before that happened.
+	//
+	if timer != nil && !timer.Stop() {
+		if result.err == nil {
+			result.response.Body.Close()
+			result.response = nil
+		}
+		result.err = errBackendTimeout
+	}
+
+	//
+	// The request is outstanding until its body is closed.
+	//
+	if result.err != nil {
+		api.conns.release(server)
+	} else {
+		result.response.Body = &releasingBody{
+			ReadCloser: result.response.Body,
+			release:    func() { api.conns.release(server) },
+		}
+	}
+	results <- result
+}
+
+//
+// fetched returns true if the given status shows that a blob-server holds
+// the object we asked for.
+//
+func fetched(status int) bool {
+	return status == http.StatusOK ||
+		status == http.StatusPartialContent ||
+		status == http.StatusNotModified ||
+		status == http.StatusRequestedRangeNotSatisfiable
+}
+
+//
+// fetchObject asks the given servers for the given object, returning the
+// first successful reply.
+//
+// The servers are asked in order.  We move on to the next server as soon
+// as one fails, or if it hasn't replied within the given delay.  If the
+// delay is zero we only move on when a server fails.
+//
+// A reply is successful if it holds the object, or the requested part of
+// it, or reports that the requested range cannot be satisfied, or that
+// the caller's copy of the object is current.
+//
+// The caller must close the body of the reply, and then invoke the
+// returned function to release its resources.  If no server holds the
+// object nil is returned.
+//
+func (api *apiServer) fetchObject(ctx context.Context, method string, id string, header http.Header, servers []libconfig.BlobServer, delay time.Duration, timeout time.Duration) (*http.Response, context.CancelFunc) {
+
+	if len(servers) == 0 {
+		return nil, nil
+	}
+
+	//
+	// We cancel all our outstanding requests once we're done.
+	//
+	ctx, cancel := context.WithCancel(ctx)
+
+	results := make(chan fetchResult, len(servers))
+	next := 0
+	pending := 0
+
+	launch := func() {
+		s := servers[next]
+		if api.options.verbose {
+			fmt.Printf("Attempting retrieval from %s%s%s\n", s.Location, "/blob/", id)
+		}
+		next++
+		pending++
+		go api.fetchFrom(ctx, method, id, header, s, timeout, results)
+	}
+
+	//
+	// The hedge fires each time we've waited too long.
+	//
+	var hedge <-chan time.Time
+	if delay > 0 {
+		ticker := time.NewTicker(delay)
+		defer ticker.Stop()
+		hedge = ticker.C
+	}
+
+	launch()
+	for pending > 0 {
+		select {
+		case <-hedge:
+			if next < len(servers) {
+				if api.options.verbose {
+					fmt.Printf("\tNo reply after %s, hedging\n", delay)
+				}
+				launch()
+			}
+
+		case r := <-results:
+			pending--
+
+			if r.err == nil && fetched(r.response.StatusCode) {
+
+				//
+				// We have a winner.  Any other replies
+				// are discarded as they arrive.
+				//
+				go func(remaining int) {
+					for ; remaining > 0; remaining-- {
+						discard := <-results
+						if discard.err == nil {
+							discard.response.Body.Close()
+						}
+						discard.cancel()
+					}
+				}(pending)
+
+				if api.index != nil {
+					api.index.Add(id, r.server.Location)
+				}
+				return r.response, func() {
+					r.cancel()
+					cancel()
+				}
+			}
+
+			//
+			// This server failed.
+			//
+			if r.err != nil {
+				if api.options.verbose {
+					fmt.Printf("\tError fetching from %s: %s\n", r.server.Location, r.err.Error())
+				}
+			} else {
+
+				//
+				// The HTTP-connection to the back-end
+				// succeeded, but that didn't return the
+				// object.
+				//
+				// This might happen if a file was uploaded
+				// to only one host, but we've hit another.
+				//
+				// (i.e. Replication is pending.)
+				//
+				if api.options.verbose {
+					fmt.Printf("\tStatus Code from %s: %d\n", r.server.Location, r.response.StatusCode)
+				}
+
+				//
+				// If our index claimed the object was here
+				// then it was wrong.
+				//
+				if api.index != nil && r.response.StatusCode == http.StatusNotFound {
+					api.index.Remove(id, r.server.Location)
+				}
+				r.response.Body.Close()
+			}
+			r.cancel()
+
+			//
+			// Move straight on to the next server.
+			//
+			if next < len(servers) {
+				launch()
+			}
+		}
+	}
+
+	//
+	// Nobody had it.
+	//
+	cancel()
+	return nil, nil
+}
@@ -0,0 +1,252 @@
+//
+// Test fetching objects from our blob-servers.
+//
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/skx/sos/libconfig"
+)
+
+//
+// newHungServer returns a server which never replies, until the request
+// is cancelled, along with a channel which receives each cancellation.
+//
+func newHungServer() (*httptest.Server, chan bool) {
+	cancelled := make(chan bool, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+			cancelled <- true
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	return server, cancelled
+}
+
+//
+// Test that slow servers are hedged, and cancelled.
+//
+func TestFetchObjectHedged(t *testing.T) {
+
+	api := newAPIServer(nil, apiServerCmd{})
+
+	hung, cancelled := newHungServer()
+	defer hung.Close()
+
+	good := newFakeBlobServer("obj")
+	defer good.server.Close()
+
+	servers := []libconfig.BlobServer{
+		{Location: hung.URL, Group: "default"},
+		{Location: good.server.URL, Group: "default"},
+	}
+
+	type TestCase struct {
+		delay   time.Duration
+		timeout time.Duration
+	}
+
+	tests := []TestCase{
+		// The hedge fires before the hung server times out.
+		{20 * time.Millisecond, 0},
+
+		// Without hedging the hung server times out.
+		{0, 50 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		start := time.Now()
+
+		response, done := api.fetchObject(context.Background(), "GET", "obj", nil, servers, test.delay, test.timeout)
+		if response == nil {
+			t.Fatalf("Failed to fetch object with %+v", test)
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		done()
+
+		if string(body) != "content of obj" {
+			t.Errorf("Unexpected body %s", body)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Errorf("Fetch took too long with %+v", test)
+		}
+
+		//
+		// The request to the hung server is cancelled.
+		//
+		select {
+		case <-cancelled:
+		case <-time.After(5 * time.Second):
+			t.Errorf("Request to hung server wasn't cancelled with %+v", test)
+		}
+	}
+}
+
+//
+// Test that failing servers are skipped, and missing objects reported.
+//
+func TestFetchObjectMissing(t *testing.T) {
+
+	api := newAPIServer(nil, apiServerCmd{})
+
+	a := newFakeBlobServer()
+	defer a.server.Close()
+	b := newFakeBlobServer("obj")
+	defer b.server.Close()
+
+	broken := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		http.Error(res, "broken", http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	servers := []libconfig.BlobServer{
+		{Location: broken.URL, Group: "default"},
+		{Location: a.server.URL, Group: "default"},
+		{Location: b.server.URL, Group: "default"},
+	}
+
+	//
+	// Without hedging we should find the object on the last
+	// server.
+	//
+	response, done := api.fetchObject(context.Background(), "HEAD", "obj", nil, servers, 0, 0)
+	if response == nil {
+		t.Fatalf("Failed to find object")
+	}
+	response.Body.Close()
+	done()
+
+	//
+	// But not if it isn't there.
+	//
+	response, _ = api.fetchObject(context.Background(), "GET", "missing", nil, servers, 0, 0)
+	if response != nil {
+		t.Errorf("Found a missing object")
+	}
+
+	for _, f := range []*fakeBlobServer{a, b} {
+		f.Lock()
+		total := f.requests["GET"] + f.requests["HEAD"]
+		f.Unlock()
+		if total != 2 {
+			t.Errorf("%s received %d requests", f.server.URL, total)
+		}
+	}
+}
+
+//
+// newDownloadRouter returns a router for our download-handler, which will
+// fetch from a blob-server holding the object "steve".
+//
+// The returned function must be invoked to clean up.
+//
+func newDownloadRouter(t *testing.T) (*mux.Router, func()) {
+
+	server, cleanup := newTestBlobServer(t)
+	STORAGE.Store("steve", strings.NewReader("Content goes here"), nil)
+
+	config, _ := libconfig.NewFromFlag(server.URL)
+	return newAPIServer(config, apiServerCmd{}).downloadRouter(), cleanup
+}
+
+//
+// Test that requests for part of an object are passed on, and that the
+// partial reply is relayed.
+//
+func TestDownloadRange(t *testing.T) {
+
+	router, cleanup := newDownloadRouter(t)
+	defer cleanup()
+
+	type TestCase struct {
+		rng    string
+		status int
+		body   string
+		header string
+	}
+
+	tests := []TestCase{
+		{"", http.StatusOK, "Content goes here", ""},
+		{"bytes=8-11", http.StatusPartialContent, "goes", "bytes 8-11/17"},
+		{"bytes=100-", http.StatusRequestedRangeNotSatisfiable, "", "bytes */17"},
+	}
+
+	for i, test := range tests {
+		req, _ := http.NewRequest("GET", "/fetch/steve", nil)
+		if test.rng != "" {
+			req.Header.Set("Range", test.rng)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != test.status {
+			t.Errorf("test %d: unexpected status-code %d", i, rr.Code)
+		}
+		if test.body != "" && rr.Body.String() != test.body {
+			t.Errorf("test %d: unexpected body '%s'", i, rr.Body.String())
+		}
+		if rr.Header().Get("Content-Range") != test.header {
+			t.Errorf("test %d: unexpected Content-Range '%s'", i, rr.Header().Get("Content-Range"))
+		}
+	}
+}
+
+//
+// Test that downloads may be cached, and conditional requests are
+// honoured.
+//
+func TestDownloadCaching(t *testing.T) {
+
+	router, cleanup := newDownloadRouter(t)
+	defer cleanup()
+
+	type TestCase struct {
+		method      string
+		ifNoneMatch string
+		status      int
+		body        string
+	}
+
+	tests := []TestCase{
+		{"GET", "", http.StatusOK, "Content goes here"},
+		{"HEAD", "", http.StatusOK, ""},
+		{"GET", "\"steve\"", http.StatusNotModified, ""},
+		{"HEAD", "\"steve\"", http.StatusNotModified, ""},
+		{"GET", "\"other\"", http.StatusOK, "Content goes here"},
+	}
+
+	for i, test := range tests {
+		req, _ := http.NewRequest(test.method, "/fetch/steve", nil)
+		if test.ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", test.ifNoneMatch)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != test.status {
+			t.Errorf("test %d: unexpected status-code %d", i, rr.Code)
+		}
+		if rr.Body.String() != test.body {
+			t.Errorf("test %d: unexpected body '%s'", i, rr.Body.String())
+		}
+		if rr.Header().Get("ETag") != "\"steve\"" || rr.Header().Get("Cache-Control") != "public, max-age=31536000, immutable" {
+			t.Errorf("test %d: unexpected headers %v", i, rr.Header())
+		}
+		if test.status == http.StatusOK && (rr.Header().Get("Content-Length") != "17" || rr.Header().Get("Last-Modified") == "") {
+			t.Errorf("test %d: unexpected headers %v", i, rr.Header())
+		}
+	}
+}
@@ -0,0 +1,54 @@
+//
+// Helpers shared by the tests of our API-server.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+//
+// callRouter makes a request of the given router, and decodes the JSON
+// it returns.
+//
+func callRouter(router http.Handler, method string, path string, body string) (int, map[string]interface{}) {
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("X-Mime-Type", "text/plain")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	result := make(map[string]interface{})
+	json.Unmarshal(rr.Body.Bytes(), &result)
+	return rr.Code, result
+}
+
+//
+// newTestBlobServer launches a blob-server, with all its routes, which
+// stores objects in a temporary directory.
+//
+// The returned function must be invoked to clean up.
+//
+func newTestBlobServer(t *testing.T) (*httptest.Server, func()) {
+
+	p, err := ioutil.TempDir("tmp", "prefix")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory %s", err.Error())
+	}
+
+	STORAGE = new(FilesystemStorage)
+	STORAGE.Setup(p)
+
+	server := httptest.NewServer(blobRouter())
+	return server, func() {
+		server.Close()
+		os.RemoveAll(p)
+	}
+}
@@ -0,0 +1,218 @@
+//
+// Check the health of our blob-servers.
+//
+// The API-server periodically polls the `/alive` end-point of each
+// blob-server.  A server which fails several checks in a row is marked
+// as down, and no longer receives requests, until it has passed several
+// checks in a row again.  Requiring a run of results, rather than acting
+// on each one, prevents a flaky server from flapping between states.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/skx/sos/libconfig"
+)
+
+//
+// backendState holds the health of a single blob-server.
+//
+type backendState struct {
+	Location  string    `json:"location"`
+	Group     string    `json:"group"`
+	Up        bool      `json:"up"`
+	LastCheck time.Time `json:"last_check"`
+	LastError string    `json:"last_error,omitempty"`
+
+	// The number of consecutive checks passed, or failed.
+	passes   int
+	failures int
+}
+
+//
+// healthChecker tracks the health of our blob-servers.
+//
+type healthChecker struct {
+	sync.Mutex
+
+	// config holds the servers we check, and is told which
+	// are down.
+	config *libconfig.Config
+
+	// rise is the number of checks a server must pass to be
+	// marked up, and fall the number it must fail to be marked
+	// down.
+	rise int
+	fall int
+
+	// timeout is how long we wait for a reply.
+	timeout time.Duration
+
+	// state holds the state of each server, by location.
+	state map[string]*backendState
+}
+
+//
+// newHealthChecker creates a new health-checker for the servers in the
+// given configuration.
+//
+func newHealthChecker(config *libconfig.Config, rise int, fall int, timeout time.Duration) *healthChecker {
+	if rise < 1 {
+		rise = 1
+	}
+	if fall < 1 {
+		fall = 1
+	}
+	return &healthChecker{
+		config:  config,
+		rise:    rise,
+		fall:    fall,
+		timeout: timeout,
+		state:   make(map[string]*backendState),
+	}
+}
+
+//
+// probe checks whether the given blob-server is alive.
+//
+func (hc *healthChecker) probe(location string) error {
+	client := &http.Client{Timeout: hc.timeout}
+
+	response, err := client.Get(location + "/alive")
+	if err != nil {
+		return err
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK || string(body) != "alive" {
+		return fmt.Errorf("status %d", response.StatusCode)
+	}
+	return nil
+}
+
+//
+// record updates the state of the given server with the result of a
+// check, marking it up or down as necessary.
+//
+func (hc *healthChecker) record(s libconfig.BlobServer, err error) {
+	hc.Lock()
+	defer hc.Unlock()
+
+	//
+	// Servers are assumed to be up until we learn otherwise.
+	//
+	state, ok := hc.state[s.Location]
+	if !ok {
+		state = &backendState{Location: s.Location, Group: s.Group, Up: true}
+		hc.state[s.Location] = state
+	}
+	state.LastCheck = time.Now()
+
+	if err == nil {
+		state.LastError = ""
+		state.passes++
+		state.failures = 0
+
+		if !state.Up && state.passes >= hc.rise {
+			fmt.Printf("Blob-server %s is up\n", s.Location)
+			state.Up = true
+			hc.config.MarkUp(s.Location)
+		}
+		return
+	}
+
+	state.LastError = err.Error()
+	state.failures++
+	state.passes = 0
+
+	if state.Up && state.failures >= hc.fall {
+		fmt.Printf("Blob-server %s is down: %s\n", s.Location, err.Error())
+		state.Up = false
+		hc.config.MarkDown(s.Location)
+	}
+}
+
+//
+// check probes each of the given servers, in parallel.
+//
+func (hc *healthChecker) check(servers []libconfig.BlobServer) {
+	var wg sync.WaitGroup
+
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s libconfig.BlobServer) {
+			defer wg.Done()
+			hc.record(s, hc.probe(s.Location))
+		}(s)
+	}
+	wg.Wait()
+}
+
+//
+// prune forgets the state of any server which isn't one of the given
+// servers, after our configuration has been reloaded.
+//
+func (hc *healthChecker) prune(servers []libconfig.BlobServer) {
+	hc.Lock()
+	defer hc.Unlock()
+
+	known := make(map[string]bool)
+	for _, s := range servers {
+		known[s.Location] = true
+	}
+	for location := range hc.state {
+		if !known[location] {
+			delete(hc.state, location)
+		}
+	}
+}
+
+//
+// loop checks our blob-servers, forever.
+//
+func (hc *healthChecker) loop(interval time.Duration) {
+	for {
+		hc.check(hc.config.Servers())
+		time.Sleep(interval)
+	}
+}
+
+//
+// ServeHTTP reports the state of every blob-server.
+//
+func (hc *healthChecker) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	hc.Lock()
+	defer hc.Unlock()
+
+	//
+	// Report every server we've checked, and any we haven't
+	// checked yet.
+	//
+	list := []backendState{}
+	for _, state := range hc.state {
+		list = append(list, *state)
+	}
+	for _, s := range hc.config.Servers() {
+		if _, ok := hc.state[s.Location]; !ok {
+			list = append(list, backendState{Location: s.Location, Group: s.Group, Up: !hc.config.IsDown(s.Location)})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Group != list[j].Group {
+			return list[i].Group < list[j].Group
+		}
+		return list[i].Location < list[j].Location
+	})
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(list)
+}
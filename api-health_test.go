@@ -0,0 +1,112 @@
+//
+// Test the health-checking of blob-servers.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/skx/sos/libconfig"
+)
+
+//
+// Test that servers are marked down, and up, with hysteresis.
+//
+func TestHealthChecker(t *testing.T) {
+
+	var alive int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&alive) == 0 {
+			http.Error(res, "dead", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(res, "alive")
+	}))
+	defer server.Close()
+
+	config := libconfig.New()
+	servers := []libconfig.BlobServer{{Location: server.URL, Group: "default"}}
+	hc := newHealthChecker(config, 2, 3, time.Second)
+
+	//
+	// Each step is whether the server is alive, and whether we
+	// expect it to have been marked down after the check.
+	//
+	type TestCase struct {
+		alive bool
+		down  bool
+	}
+
+	tests := []TestCase{
+		{true, false},
+		{false, false},
+		{false, false},
+		{true, false},
+		{false, false},
+		{false, false},
+		{false, true},
+		{true, true},
+		{false, true},
+		{true, true},
+		{true, false},
+	}
+
+	for i, test := range tests {
+		if test.alive {
+			atomic.StoreInt32(&alive, 1)
+		} else {
+			atomic.StoreInt32(&alive, 0)
+		}
+
+		hc.check(servers)
+
+		if config.IsDown(server.URL) != test.down {
+			t.Errorf("step %d: expected down=%t", i, test.down)
+		}
+	}
+
+	//
+	// Unreachable servers are marked down too.
+	//
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+
+	hc = newHealthChecker(config, 1, 1, time.Second)
+	hc.check([]libconfig.BlobServer{{Location: gone.URL, Group: "other"}})
+	if !config.IsDown(gone.URL) {
+		t.Errorf("Unreachable server wasn't marked down")
+	}
+
+	//
+	// And reported as such.
+	//
+	rr := httptest.NewRecorder()
+	hc.ServeHTTP(rr, httptest.NewRequest("GET", "/backends", nil))
+
+	var states []backendState
+	err := json.Unmarshal(rr.Body.Bytes(), &states)
+	if err != nil {
+		t.Fatalf("Failed to decode state: %s", err.Error())
+	}
+	if len(states) != 1 || states[0].Up || states[0].Location != gone.URL || states[0].LastError == "" {
+		t.Errorf("Unexpected state %s", rr.Body.String())
+	}
+
+	//
+	// Once the server is removed it is forgotten.
+	//
+	hc.prune(servers)
+	rr = httptest.NewRecorder()
+	hc.ServeHTTP(rr, httptest.NewRequest("GET", "/backends", nil))
+	if strings.Contains(rr.Body.String(), gone.URL) {
+		t.Errorf("Removed server is still reported %s", rr.Body.String())
+	}
+}
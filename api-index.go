@@ -0,0 +1,308 @@
+//
+// An index of where each object is stored.
+//
+// Without an index the API-server must probe blob-servers in turn to
+// find an object.  With one it can go straight to the servers holding
+// it, falling back to probing if the index is wrong or incomplete.
+//
+// The index is populated as objects are uploaded, and by periodically
+// crawling the listings of each blob-server.  It is held in RAM, and
+// persisted to a file to which changes are appended:
+//
+//     + ${id} ${server}
+//     - ${id} ${server}
+//     - ${id}
+//
+// These record that the server holds the object, that the server no
+// longer holds the object, and that the object is no longer held
+// anywhere.  The file is compacted each time it is opened.
+//
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skx/sos/libconfig"
+)
+
+//
+// locationIndex records which blob-servers hold each object.
+//
+type locationIndex struct {
+	sync.RWMutex
+
+	// file is open for appending our changes.
+	file *os.File
+
+	// locations maps each object to the servers holding it.
+	locations map[string][]string
+
+	// crawled records when we last crawled each server.
+	crawled map[string]time.Time
+}
+
+//
+// crawlSlack is subtracted from the time of our last crawl when asking a
+// blob-server for the objects it has stored since, to allow for the
+// clocks of the two hosts differing.
+//
+const crawlSlack = 5 * time.Minute
+
+//
+// openLocationIndex loads the index from the given file, creating it if
+// it doesn't exist.
+//
+func openLocationIndex(path string) (*locationIndex, error) {
+	idx := &locationIndex{
+		locations: make(map[string][]string),
+		crawled:   make(map[string]time.Time),
+	}
+
+	//
+	// Replay the existing file, if any.
+	//
+	in, err := os.Open(path)
+	if err == nil {
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+
+			//
+			// Anything malformed, such as a line which was
+			// only partially written, is ignored.
+			//
+			if len(fields) == 3 && fields[0] == "+" {
+				idx.add(fields[1], fields[2])
+			}
+			if len(fields) == 3 && fields[0] == "-" {
+				idx.remove(fields[1], fields[2])
+			}
+			if len(fields) == 2 && fields[0] == "-" {
+				delete(idx.locations, fields[1])
+			}
+		}
+		in.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	//
+	// Write out a compacted copy, and replace the original
+	// with it.
+	//
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriter(out)
+	for id, servers := range idx.locations {
+		for _, server := range servers {
+			fmt.Fprintf(writer, "+ %s %s\n", id, server)
+		}
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = out.Sync()
+	}
+	out.Close()
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	//
+	// Now open it for appending.
+	//
+	idx.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+//
+// add records that the given server holds the given object, returning
+// false if we already knew that.
+//
+// The caller must hold our lock.
+//
+func (idx *locationIndex) add(id string, server string) bool {
+	for _, existing := range idx.locations[id] {
+		if existing == server {
+			return false
+		}
+	}
+	idx.locations[id] = append(idx.locations[id], server)
+	return true
+}
+
+//
+// remove records that the given server no longer holds the given object,
+// returning false if we didn't believe it did.
+//
+// The caller must hold our lock.
+//
+func (idx *locationIndex) remove(id string, server string) bool {
+	var remaining []string
+	for _, existing := range idx.locations[id] {
+		if existing != server {
+			remaining = append(remaining, existing)
+		}
+	}
+	if len(remaining) == len(idx.locations[id]) {
+		return false
+	}
+
+	if len(remaining) == 0 {
+		delete(idx.locations, id)
+	} else {
+		idx.locations[id] = remaining
+	}
+	return true
+}
+
+//
+// Add records that the given server holds the given object.
+//
+func (idx *locationIndex) Add(id string, server string) {
+	idx.Lock()
+	defer idx.Unlock()
+
+	if idx.add(id, server) {
+		fmt.Fprintf(idx.file, "+ %s %s\n", id, server)
+	}
+}
+
+//
+// Remove records that the given server no longer holds the given object.
+//
+func (idx *locationIndex) Remove(id string, server string) {
+	idx.Lock()
+	defer idx.Unlock()
+
+	if idx.remove(id, server) {
+		fmt.Fprintf(idx.file, "- %s %s\n", id, server)
+	}
+}
+
+//
+// Forget records that the given object is no longer held anywhere.
+//
+func (idx *locationIndex) Forget(id string) {
+	idx.Lock()
+	defer idx.Unlock()
+
+	if _, ok := idx.locations[id]; ok {
+		delete(idx.locations, id)
+		fmt.Fprintf(idx.file, "- %s\n", id)
+	}
+}
+
+//
+// Lookup returns the servers which we believe hold the given object.
+//
+func (idx *locationIndex) Lookup(id string) []string {
+	idx.RLock()
+	defer idx.RUnlock()
+
+	ret := make([]string, len(idx.locations[id]))
+	copy(ret, idx.locations[id])
+	return ret
+}
+
+//
+// Close closes our persistent file.
+//
+func (idx *locationIndex) Close() error {
+	idx.Lock()
+	defer idx.Unlock()
+
+	return idx.file.Close()
+}
+
+//
+// crawl records the objects held by each of the given servers.
+//
+// After the first crawl of a server we only ask it for the objects it
+// has stored since the previous crawl.  Failures are reported if verbose
+// is true.
+//
+func (idx *locationIndex) crawl(servers []libconfig.BlobServer, verbose bool) {
+	for _, s := range servers {
+
+		idx.RLock()
+		since, ok := idx.crawled[s.Location]
+		idx.RUnlock()
+		if ok {
+			since = since.Add(-crawlSlack)
+		}
+
+		start := time.Now()
+		objects, err := ObjectsSince(context.Background(), s.Location, since)
+		if err != nil {
+			if verbose {
+				fmt.Printf("Failed to crawl %s: %s\n", s.Location, err.Error())
+			}
+			continue
+		}
+
+		for _, obj := range objects {
+			idx.Add(obj, s.Location)
+		}
+
+		idx.Lock()
+		idx.crawled[s.Location] = start
+		idx.Unlock()
+	}
+}
+
+//
+// crawlLoop crawls the blob-servers in the given configuration, forever.
+//
+func (idx *locationIndex) crawlLoop(config *libconfig.Config, interval time.Duration, verbose bool) {
+	for {
+		idx.crawl(config.Servers(), verbose)
+		time.Sleep(interval)
+	}
+}
+
+//
+// indexedServers orders the given servers so that those which the index
+// believes hold the given object come first.
+//
+// If we have no index the servers are returned unchanged.
+//
+func indexedServers(idx *locationIndex, id string, servers []libconfig.BlobServer) []libconfig.BlobServer {
+	if idx == nil {
+		return servers
+	}
+
+	known := make(map[string]bool)
+	for _, location := range idx.Lookup(id) {
+		known[location] = true
+	}
+	if len(known) == 0 {
+		return servers
+	}
+
+	var first, rest []libconfig.BlobServer
+	for _, s := range servers {
+		if known[s.Location] {
+			first = append(first, s)
+		} else {
+			rest = append(rest, s)
+		}
+	}
+	return append(first, rest...)
+}
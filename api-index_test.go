@@ -0,0 +1,132 @@
+//
+// Test our index of object locations.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/skx/sos/libconfig"
+)
+
+//
+// Test that the index records locations, and persists them.
+//
+func TestLocationIndex(t *testing.T) {
+
+	p, _ := ioutil.TempDir("tmp", "prefix")
+	defer os.RemoveAll(p)
+	path := filepath.Join(p, "index")
+
+	idx, err := openLocationIndex(path)
+	if err != nil {
+		t.Fatalf("Failed to open index: %s", err.Error())
+	}
+
+	idx.Add("one", "http://a")
+	idx.Add("one", "http://b")
+	idx.Add("one", "http://a")
+	idx.Add("two", "http://a")
+	idx.Add("three", "http://b")
+	idx.Remove("one", "http://a")
+	idx.Forget("two")
+
+	expected := map[string]string{
+		"one":   "http://b",
+		"two":   "",
+		"three": "http://b",
+	}
+	for id, location := range expected {
+		if out := strings.Join(idx.Lookup(id), ","); out != location {
+			t.Errorf("Unexpected location for %s: '%s'", id, out)
+		}
+	}
+	idx.Close()
+
+	//
+	// Append a partially-written line, as if we'd crashed.
+	//
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString("+ four")
+	f.Close()
+
+	//
+	// Reopening gives us the same content.
+	//
+	idx, err = openLocationIndex(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen index: %s", err.Error())
+	}
+	defer idx.Close()
+
+	for id, location := range expected {
+		if out := strings.Join(idx.Lookup(id), ","); out != location {
+			t.Errorf("Unexpected location for %s after reopening: '%s'", id, out)
+		}
+	}
+
+	//
+	// Which has been compacted.
+	//
+	data, _ := ioutil.ReadFile(path)
+	if len(strings.Split(strings.TrimSpace(string(data)), "\n")) != 2 {
+		t.Errorf("Index wasn't compacted:\n%s", data)
+	}
+}
+
+//
+// Test that crawling populates the index, and that it is used to order
+// our servers.
+//
+func TestLocationIndexCrawl(t *testing.T) {
+
+	a := newFakeBlobServer("one", "two")
+	defer a.server.Close()
+	b := newFakeBlobServer("two", "three")
+	defer b.server.Close()
+
+	p, _ := ioutil.TempDir("tmp", "prefix")
+	defer os.RemoveAll(p)
+
+	idx, err := openLocationIndex(filepath.Join(p, "index"))
+	if err != nil {
+		t.Fatalf("Failed to open index: %s", err.Error())
+	}
+	defer idx.Close()
+
+	servers := []libconfig.BlobServer{
+		{Location: a.server.URL, Group: "default"},
+		{Location: b.server.URL, Group: "default"},
+	}
+	idx.crawl(servers, false)
+
+	if len(idx.Lookup("two")) != 2 || idx.Lookup("three")[0] != b.server.URL {
+		t.Errorf("Crawl didn't find our objects")
+	}
+
+	//
+	// Servers holding an object are tried first.
+	//
+	order := indexedServers(idx, "three", servers)
+	if order[0].Location != b.server.URL || len(order) != 2 {
+		t.Errorf("Unexpected order %v", order)
+	}
+
+	//
+	// Without an index, or knowledge of the object, nothing
+	// changes.
+	//
+	for _, order = range [][]libconfig.BlobServer{
+		indexedServers(nil, "three", servers),
+		indexedServers(idx, "missing", servers),
+	} {
+		if order[0].Location != a.server.URL || len(order) != 2 {
+			t.Errorf("Unexpected order %v", order)
+		}
+	}
+}
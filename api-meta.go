@@ -0,0 +1,346 @@
+//
+// Read and write our cluster metadata.
+//
+// Every blob-server holds a copy of each metadata entry.  Changes are
+// sent to every blob-server which is up, and succeed once a quorum have
+// stored them, by default a majority of all our blob-servers.
+//
+// Reads ask every blob-server which is up, and use the most recent copy
+// of the entry they find.  Any server which holds an older copy, or no
+// copy at all, is sent the most recent one.  Servers which were down
+// when a change was made are also brought up to date by `sos replicate`.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/skx/sos/libconfig"
+)
+
+//
+// errNoMetaServers is returned when no blob-server could be asked about
+// our metadata.
+//
+var errNoMetaServers = errors.New("no blob-server replied")
+
+//
+// metaClient returns the client we use to talk to blob-servers about
+// our metadata.
+//
+func (api *apiServer) metaClient() *http.Client {
+	return &http.Client{Timeout: api.options.backendTimeout}
+}
+
+//
+// fetchMeta retrieves the entry with the given key from the given server.
+//
+// The second value is false if the server doesn't hold the entry.
+//
+func fetchMeta(client *http.Client, server string, key string) (MetaEntry, bool, error) {
+	var entry MetaEntry
+
+	response, err := client.Get(server + "/meta/" + hex.EncodeToString([]byte(key)))
+	if err != nil {
+		return entry, false, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return entry, false, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return entry, false, fmt.Errorf("status %d", response.StatusCode)
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&entry)
+	if err != nil {
+		return entry, false, err
+	}
+	return entry, true, nil
+}
+
+//
+// sendMeta stores the given entry upon the given server.
+//
+// The server only stores the entry if it is more recent than the copy
+// it holds, and the copy it holds afterwards is returned.
+//
+func sendMeta(client *http.Client, server string, entry MetaEntry) (MetaEntry, error) {
+	var result MetaEntry
+
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return result, err
+	}
+
+	child, _ := http.NewRequest("PUT", server+"/meta/"+hex.EncodeToString([]byte(entry.Key)), bytes.NewReader(body))
+	child.Header.Set("Content-Type", "application/json")
+
+	response, err := client.Do(child)
+	if err != nil {
+		return result, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("status %d", response.StatusCode)
+	}
+	err = json.NewDecoder(response.Body).Decode(&result)
+	return result, err
+}
+
+//
+// metaPage reads a single page of the entries held by the given server,
+// whose keys begin with the given prefix.
+//
+func metaPage(client *http.Client, server string, prefix string, after string, limit int) ([]MetaEntry, error) {
+	query := fmt.Sprintf("%s/meta?prefix=%s&after=%s&limit=%d",
+		server, url.QueryEscape(prefix), url.QueryEscape(after), limit)
+
+	response, err := client.Get(query)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", response.StatusCode)
+	}
+
+	var page []MetaEntry
+	err = json.NewDecoder(response.Body).Decode(&page)
+	return page, err
+}
+
+// MetaEntries reads all the entries held by the given server, including
+// any tombstones.
+//
+// The list is fetched a page at a time, to avoid a single huge response.
+func MetaEntries(client *http.Client, server string) ([]MetaEntry, error) {
+	var all []MetaEntry
+
+	after := ""
+	for {
+		page, err := metaPage(client, server, "", after, listPageSize)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, page...)
+
+		if len(page) < listPageSize {
+			return all, nil
+		}
+		after = page[len(page)-1].Key
+	}
+}
+
+//
+// metaServers returns the blob-servers we ask about our metadata, which
+// are all those which are up.
+//
+func (api *apiServer) metaServers() []libconfig.BlobServer {
+	var servers []libconfig.BlobServer
+	for _, s := range api.config.Servers() {
+		if !api.config.IsDown(s.Location) {
+			servers = append(servers, s)
+		}
+	}
+	return servers
+}
+
+//
+// metaQuorum returns the number of blob-servers which must store a
+// change to our metadata.
+//
+func (api *apiServer) metaQuorum() int {
+	if api.options.metaQuorum > 0 {
+		return api.options.metaQuorum
+	}
+	return len(api.config.Servers())/2 + 1
+}
+
+//
+// getMeta returns the most recent copy of the entry with the given key.
+//
+// The second value is false if the entry doesn't exist, or has been
+// deleted.
+//
+func (api *apiServer) getMeta(key string) (MetaEntry, bool, error) {
+
+	type reply struct {
+		server string
+		entry  MetaEntry
+		found  bool
+		err    error
+	}
+
+	client := api.metaClient()
+	servers := api.metaServers()
+	replies := make(chan reply, len(servers))
+	for _, s := range servers {
+		go func(server string) {
+			entry, found, err := fetchMeta(client, server, key)
+			replies <- reply{server: server, entry: entry, found: found, err: err}
+		}(s.Location)
+	}
+
+	//
+	// Find the most recent copy.
+	//
+	var all []reply
+	var latest MetaEntry
+	found := false
+	answered := 0
+	for range servers {
+		r := <-replies
+		all = append(all, r)
+
+		if r.err != nil {
+			if api.options.verbose {
+				fmt.Printf("\tError fetching metadata from %s: %s\n", r.server, r.err.Error())
+			}
+			continue
+		}
+		answered++
+		if r.found && (!found || r.entry.Newer(latest)) {
+			latest = r.entry
+			found = true
+		}
+	}
+	if answered == 0 {
+		return latest, false, errNoMetaServers
+	}
+
+	//
+	// Bring any out of date servers up to date.
+	//
+	if found {
+		for _, r := range all {
+			if r.err == nil && (!r.found || latest.Newer(r.entry)) {
+				go sendMeta(client, r.server, latest)
+			}
+		}
+	}
+
+	return latest, found && !latest.Deleted, nil
+}
+
+//
+// putMeta stores the given entry upon our blob-servers, and returns an
+// error if not enough of them stored it.
+//
+func (api *apiServer) putMeta(entry MetaEntry) error {
+
+	client := api.metaClient()
+	servers := api.metaServers()
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(server string) {
+			_, err := sendMeta(client, server, entry)
+			if err != nil && api.options.verbose {
+				fmt.Printf("\tError storing metadata upon %s: %s\n", server, err.Error())
+			}
+			errs <- err
+		}(s.Location)
+	}
+
+	stored := 0
+	for range servers {
+		if <-errs == nil {
+			stored++
+		}
+	}
+
+	if stored < api.metaQuorum() {
+		return fmt.Errorf("stored upon %d blob-servers, %d required", stored, api.metaQuorum())
+	}
+	return nil
+}
+
+//
+// listMeta returns the most recent copy of the entries whose keys begin
+// with the given prefix, and which sort after `after`, in order.  Deleted
+// entries are omitted.
+//
+// At most `limit` entries are returned.  If there might be more then the
+// key to pass as `after` to retrieve them is returned too.
+//
+func (api *apiServer) listMeta(prefix string, after string, limit int) ([]MetaEntry, string, error) {
+
+	type reply struct {
+		server string
+		page   []MetaEntry
+		err    error
+	}
+
+	client := api.metaClient()
+	servers := api.metaServers()
+	replies := make(chan reply, len(servers))
+	for _, s := range servers {
+		go func(server string) {
+			page, err := metaPage(client, server, prefix, after, limit)
+			replies <- reply{server: server, page: page, err: err}
+		}(s.Location)
+	}
+
+	//
+	// Merge the pages, keeping the most recent copy of each entry.
+	//
+	// A server which returned a full page might hold more entries,
+	// so we can only be sure of the entries up to the last one it
+	// returned.
+	//
+	latest := make(map[string]MetaEntry)
+	next := ""
+	answered := 0
+	for range servers {
+		r := <-replies
+		if r.err != nil {
+			if api.options.verbose {
+				fmt.Printf("\tError listing metadata from %s: %s\n", r.server, r.err.Error())
+			}
+			continue
+		}
+		answered++
+
+		for _, entry := range r.page {
+			if existing, ok := latest[entry.Key]; !ok || entry.Newer(existing) {
+				latest[entry.Key] = entry
+			}
+		}
+		if len(r.page) >= limit {
+			last := r.page[len(r.page)-1].Key
+			if next == "" || last < next {
+				next = last
+			}
+		}
+	}
+	if answered == 0 {
+		return nil, "", errNoMetaServers
+	}
+
+	keys := make([]string, 0, len(latest))
+	for key := range latest {
+		if next == "" || key <= next {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	list := []MetaEntry{}
+	for _, key := range keys {
+		if !latest[key].Deleted {
+			list = append(list, latest[key])
+		}
+	}
+	return list, next, nil
+}
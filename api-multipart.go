@@ -0,0 +1,443 @@
+//
+// Multipart uploads, via the API-server.
+//
+// Objects may be uploaded in parts, rather than in a single request, so
+// that a failure part-way through uploading a large object only requires
+// the missing parts to be sent again:
+//
+//   POST   /multipart                   - Begin an upload.
+//   PUT    /multipart/{upload}/{part}   - Upload a part.
+//   GET    /multipart/{upload}          - List the parts received.
+//   POST   /multipart/{upload}/complete - Finish the upload.
+//   DELETE /multipart/{upload}          - Abandon the upload.
+//
+// The parts are held by a single blob-server, chosen when the upload is
+// begun, and the name of the upload records which server that is.  This
+// means that we needn't remember anything about the upload ourselves, so
+// an upload may be continued via any API-server.
+//
+// When the upload is finished that blob-server joins the parts together,
+// and hashes the result to find its ID.  The object is then stored upon
+// the servers it belongs to, exactly as if it had been uploaded in one
+// piece, and the upload is removed.
+//
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/skx/sos/libconfig"
+)
+
+//
+// uploadPattern matches the random part of the name of an upload.
+//
+var uploadPattern = regexp.MustCompile("^([a-z0-9]+)$")
+
+//
+// uploadName returns the name we give to the given upload, held upon
+// the given blob-server.
+//
+func uploadName(upload string, server libconfig.BlobServer) string {
+	return upload + "-" + hex.EncodeToString([]byte(server.Location))
+}
+
+//
+// parseUploadName returns the upload, and the blob-server holding it,
+// which the given name refers to.
+//
+// Only blob-servers which we know about are accepted, so that we can't
+// be used to send requests elsewhere.
+//
+func (api *apiServer) parseUploadName(name string) (string, libconfig.BlobServer, bool) {
+	i := strings.Index(name, "-")
+	if i < 0 {
+		return "", libconfig.BlobServer{}, false
+	}
+
+	upload := name[:i]
+	if !uploadPattern.MatchString(upload) {
+		return "", libconfig.BlobServer{}, false
+	}
+
+	location, err := hex.DecodeString(name[i+1:])
+	if err != nil {
+		return "", libconfig.BlobServer{}, false
+	}
+	for _, s := range api.config.Servers() {
+		if s.Location == string(location) {
+			return upload, s, true
+		}
+	}
+	return "", libconfig.BlobServer{}, false
+}
+
+//
+// multipartRequest sends a request for the given upload to the blob-server
+// holding it.
+//
+// The request is cancelled along with the given context.  The timeout,
+// if not zero, applies only to receiving the headers of the reply, as
+// with downloads, since a part or an object may take a long time to send.
+//
+func (api *apiServer) multipartRequest(ctx context.Context, timeout time.Duration, method string, server libconfig.BlobServer, path string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	url := server.Location + "/multipart/" + path
+
+	if api.options.verbose {
+		fmt.Printf("Sending %s to %s\n", method, url)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	child, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	child.ContentLength = size
+	for name, value := range header {
+		child.Header[name] = value
+	}
+
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, cancel)
+	}
+
+	response, err := http.DefaultClient.Do(child)
+
+	//
+	// If the timer fired we've been cancelled, even if we
+	// received a reply just before that happened.
+	//
+	if timer != nil && !timer.Stop() {
+		if err == nil {
+			response.Body.Close()
+		}
+		err = errBackendTimeout
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	//
+	// The request is outstanding until its body is closed.
+	//
+	response.Body = &releasingBody{ReadCloser: response.Body, release: cancel}
+	return response, nil
+}
+
+//
+// jsonError reports a failure to the caller, as a JSON object holding
+// the reason.
+//
+func jsonError(res http.ResponseWriter, status int, reason string) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(map[string]interface{}{
+		"error": reason,
+	})
+}
+
+//
+// multipartResult decodes the reply of a blob-server into the given value,
+// returning an error if it was unsuccessful.
+//
+// The status-code to report to our caller is returned too, so that they
+// learn of missing uploads, and similar.
+//
+func multipartResult(response *http.Response, result interface{}) (int, error) {
+	defer response.Body.Close()
+
+	//
+	// A listing of many parts might be large, but not this large.
+	//
+	reply, err := ioutil.ReadAll(io.LimitReader(response.Body, 1024*1024))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		reason := strings.TrimSpace(string(reply))
+		if reason == "" {
+			reason = fmt.Sprintf("status %d", response.StatusCode)
+		}
+		return response.StatusCode, errors.New(reason)
+	}
+
+	err = json.Unmarshal(reply, result)
+	if err != nil {
+		return http.StatusInternalServerError, errors.New("invalid response")
+	}
+	return http.StatusOK, nil
+}
+
+//
+// relayMultipart passes the reply of a blob-server on to our caller,
+// replacing the name of the upload with ours.
+//
+func relayMultipart(res http.ResponseWriter, response *http.Response, name string) {
+	var result map[string]interface{}
+	status, err := multipartResult(response, &result)
+	if err != nil {
+		jsonError(res, status, err.Error())
+		return
+	}
+
+	result["upload"] = name
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(result)
+}
+
+//
+// findUpload returns the upload a request refers to, and the blob-server
+// holding it, or reports that it doesn't exist.
+//
+func (api *apiServer) findUpload(res http.ResponseWriter, req *http.Request) (string, string, libconfig.BlobServer, bool) {
+	name := mux.Vars(req)["upload"]
+
+	upload, server, ok := api.parseUploadName(name)
+	if !ok {
+		jsonError(res, http.StatusNotFound, errUnknownUpload.Error())
+	}
+	return name, upload, server, ok
+}
+
+// APIMultipartCreateHandler begins a multipart upload.
+//
+// The parts will be held by the first blob-server which we'd upload an
+// object to, which is willing to accept them.  Any X-headers are stored
+// alongside the object which is uploaded.
+func (api *apiServer) APIMultipartCreateHandler(res http.ResponseWriter, req *http.Request) {
+
+	//
+	// Generate a random name for the upload.
+	//
+	random := make([]byte, 16)
+	_, err := rand.Read(random)
+	if err != nil {
+		jsonError(res, http.StatusInternalServerError, "failed to name upload")
+		return
+	}
+	upload := hex.EncodeToString(random)
+
+	header := uploadHeaders(req)
+
+	attempts := []uploadAttempt{}
+	for _, s := range api.uploadServers(upload) {
+
+		var result map[string]interface{}
+		response, err := api.multipartRequest(req.Context(), api.options.backendTimeout, "POST", s, upload, nil, 0, header)
+		if err == nil {
+			_, err = multipartResult(response, &result)
+		}
+		if err != nil {
+			if api.options.verbose {
+				fmt.Printf("\tBeginning upload on %s failed: %s\n", s.Location, err.Error())
+			}
+			attempts = append(attempts, uploadAttempt{
+				Server: s.Location,
+				Group:  s.Group,
+				Error:  err.Error(),
+			})
+			continue
+		}
+
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(map[string]interface{}{
+			"upload": uploadName(upload, s),
+			"status": "OK",
+		})
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(res).Encode(map[string]interface{}{
+		"error":    "upload failed",
+		"attempts": attempts,
+	})
+}
+
+// APIMultipartPartHandler uploads a single part of a multipart upload.
+//
+// Parts are numbered from one, and may be uploaded in any order.  A part
+// which is uploaded again replaces the previous copy.
+func (api *apiServer) APIMultipartPartHandler(res http.ResponseWriter, req *http.Request) {
+	name, upload, server, ok := api.findUpload(res, req)
+	if !ok {
+		return
+	}
+
+	part, err := strconv.Atoi(mux.Vars(req)["part"])
+	if err != nil || part < 1 || part > maxParts {
+		jsonError(res, http.StatusBadRequest, "invalid part")
+		return
+	}
+
+	//
+	// The part is streamed to the blob-server, rather than being
+	// held here.
+	//
+	path := fmt.Sprintf("%s/%d", upload, part)
+	response, err := api.multipartRequest(req.Context(), api.options.backendTimeout, "PUT", server, path, req.Body, req.ContentLength, nil)
+	if err != nil {
+		jsonError(res, http.StatusInternalServerError, err.Error())
+		return
+	}
+	relayMultipart(res, response, name)
+}
+
+// APIMultipartListHandler lists the parts of a multipart upload which
+// have been received, so that an interrupted upload may be resumed.
+func (api *apiServer) APIMultipartListHandler(res http.ResponseWriter, req *http.Request) {
+	name, upload, server, ok := api.findUpload(res, req)
+	if !ok {
+		return
+	}
+
+	response, err := api.multipartRequest(req.Context(), api.options.backendTimeout, "GET", server, upload, nil, 0, nil)
+	if err != nil {
+		jsonError(res, http.StatusInternalServerError, err.Error())
+		return
+	}
+	relayMultipart(res, response, name)
+}
+
+// APIMultipartAbortHandler abandons a multipart upload, removing any
+// parts which were received.
+func (api *apiServer) APIMultipartAbortHandler(res http.ResponseWriter, req *http.Request) {
+	name, upload, server, ok := api.findUpload(res, req)
+	if !ok {
+		return
+	}
+
+	response, err := api.multipartRequest(req.Context(), api.options.backendTimeout, "DELETE", server, upload, nil, 0, nil)
+	if err != nil {
+		jsonError(res, http.StatusInternalServerError, err.Error())
+		return
+	}
+	relayMultipart(res, response, name)
+}
+
+// APIMultipartCompleteHandler finishes a multipart upload.
+//
+// The parts are joined together, by the blob-server holding them, and
+// the result is stored just like any other upload.  If that fails the
+// parts are retained, so the caller may try again.
+func (api *apiServer) APIMultipartCompleteHandler(res http.ResponseWriter, req *http.Request) {
+	_, upload, server, ok := api.findUpload(res, req)
+	if !ok {
+		return
+	}
+
+	//
+	// Join the parts together, which tells us the ID of the
+	// object.
+	//
+	// There is no timeout, since the blob-server only replies
+	// once it has read every part.
+	//
+	var obj UploadedObject
+	response, err := api.multipartRequest(req.Context(), 0, "POST", server, upload+"/complete", nil, 0, nil)
+	if err != nil {
+		jsonError(res, http.StatusInternalServerError, err.Error())
+		return
+	}
+	status, err := multipartResult(response, &obj)
+	if err != nil {
+		jsonError(res, status, err.Error())
+		return
+	}
+
+	//
+	// Now store it where it belongs.
+	//
+	// The server holding the parts can store the object without
+	// it being sent anywhere, otherwise we copy it from there.
+	//
+	stored, attempts := api.storeWith(api.uploadServers(obj.ID), api.replicaQuorum, func(s libconfig.BlobServer) error {
+		if s.Location == server.Location {
+			return api.commitUpload(req.Context(), server, upload, obj)
+		}
+		return api.copyUpload(req.Context(), server, upload, obj, s)
+	})
+
+	//
+	// Once stored the upload is no longer required.
+	//
+	if len(stored) > 0 {
+		response, err = api.multipartRequest(req.Context(), api.options.backendTimeout, "DELETE", server, upload, nil, 0, nil)
+		if err == nil {
+			response.Body.Close()
+		}
+	}
+
+	api.uploadResult(res, obj.ID, obj.Size, stored, attempts, nil)
+}
+
+//
+// commitUpload asks the blob-server holding an upload to store the object
+// it produced.
+//
+// As with completing the upload there is no timeout, since the object is
+// written before the blob-server replies.
+//
+func (api *apiServer) commitUpload(ctx context.Context, server libconfig.BlobServer, upload string, obj UploadedObject) error {
+	response, err := api.multipartRequest(ctx, 0, "POST", server, upload+"/commit", nil, 0, nil)
+	if err != nil {
+		return err
+	}
+
+	var result UploadedObject
+	status, err := multipartResult(response, &result)
+	if err != nil {
+		return fmt.Errorf("status %d: %s", status, err.Error())
+	}
+	if result != obj {
+		return fmt.Errorf("stored %s with size %d, expected %s with size %d", result.ID, result.Size, obj.ID, obj.Size)
+	}
+	return nil
+}
+
+//
+// copyUpload copies the object produced by an upload from the blob-server
+// holding it to another.
+//
+func (api *apiServer) copyUpload(ctx context.Context, server libconfig.BlobServer, upload string, obj UploadedObject, dst libconfig.BlobServer) error {
+	response, err := api.multipartRequest(ctx, api.options.backendTimeout, "GET", server, upload+"/object", nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to read upload: status %d", response.StatusCode)
+	}
+
+	//
+	// The X-headers the upload was begun with are stored along
+	// with the object.
+	//
+	header := make(http.Header)
+	for name, value := range response.Header {
+		if strings.HasPrefix(name, "X-") {
+			header.Set(name, value[0])
+		}
+	}
+	return api.postBlob(dst.Location, obj.ID, response.Body, obj.Size, header)
+}
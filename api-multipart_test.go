@@ -0,0 +1,178 @@
+//
+// Test multipart uploads via the API-server.
+//
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skx/sos/libconfig"
+)
+
+//
+// Test an upload in parts, which is stored upon the blob-server holding
+// the parts and copied to another.
+//
+func TestMultipartUpload(t *testing.T) {
+
+	//
+	// The parts are held by a real blob-server, which is first
+	// in line, and copies made to a fake server.
+	//
+	server, cleanup := newTestBlobServer(t)
+	defer cleanup()
+
+	fake := newFakeBlobServer()
+	defer fake.server.Close()
+
+	config, _ := libconfig.NewFromFlag(server.URL + "," + fake.server.URL)
+	router := newAPIServer(config, apiServerCmd{minReplicas: 2}).uploadRouter()
+
+	//
+	// Begin the upload, and send the parts in the wrong order.
+	//
+	status, result := callRouter(router, "POST", "/multipart", "")
+	if status != http.StatusOK {
+		t.Fatalf("Failed to begin upload: %d %v", status, result)
+	}
+	name, _ := result["upload"].(string)
+
+	status, result = callRouter(router, "PUT", "/multipart/"+name+"/2", "world")
+	if status != http.StatusOK || result["upload"] != name || result["size"] != float64(5) {
+		t.Errorf("Failed to upload part 2: %d %v", status, result)
+	}
+	status, _ = callRouter(router, "PUT", "/multipart/"+name+"/1", "hello ")
+	if status != http.StatusOK {
+		t.Errorf("Failed to upload part 1: %d", status)
+	}
+	status, _ = callRouter(router, "PUT", "/multipart/"+name+"/0", "nothing")
+	if status != http.StatusBadRequest {
+		t.Errorf("Unexpected status uploading part 0: %d", status)
+	}
+
+	status, result = callRouter(router, "GET", "/multipart/"+name, "")
+	parts, _ := result["parts"].([]interface{})
+	if status != http.StatusOK || len(parts) != 2 {
+		t.Errorf("Unexpected listing %d %v", status, result)
+	}
+
+	//
+	// If we can't store enough copies the upload may be completed
+	// again later.
+	//
+	fake.Lock()
+	fake.full = true
+	fake.Unlock()
+
+	status, result = callRouter(router, "POST", "/multipart/"+name+"/complete", "")
+	if status != http.StatusInternalServerError || result["error"] != "upload failed" {
+		t.Errorf("Unexpected result completing upload: %d %v", status, result)
+	}
+
+	fake.Lock()
+	fake.full = false
+	fake.Unlock()
+
+	hash := sha1.Sum([]byte("hello world"))
+	id := hex.EncodeToString(hash[:])
+
+	status, result = callRouter(router, "POST", "/multipart/"+name+"/complete", "")
+	if status != http.StatusOK || result["id"] != id || result["size"] != float64(11) || result["replicas"] != float64(2) {
+		t.Errorf("Unexpected result completing upload: %d %v", status, result)
+	}
+
+	//
+	// Both servers now hold the object, and the upload is gone.
+	//
+	data, meta := STORAGE.Get(id)
+	if data == nil {
+		t.Fatalf("The object wasn't stored")
+	}
+	content, _ := ioutil.ReadAll(data)
+	data.Close()
+	if string(content) != "hello world" || meta["X-Mime-Type"] != "text/plain" {
+		t.Errorf("Unexpected object '%s' %v", content, meta)
+	}
+
+	fake.Lock()
+	copied := fake.objects[id]
+	fake.Unlock()
+	if copied != "hello world" {
+		t.Errorf("Unexpected copy '%s'", copied)
+	}
+
+	status, _ = callRouter(router, "GET", "/multipart/"+name, "")
+	if status != http.StatusNotFound {
+		t.Errorf("Unexpected status for a finished upload: %d", status)
+	}
+}
+
+//
+// Test that uploads may be abandoned, and that we only talk to the
+// blob-servers we know about.
+//
+func TestMultipartAbort(t *testing.T) {
+
+	server, cleanup := newTestBlobServer(t)
+	defer cleanup()
+
+	config, _ := libconfig.NewFromFlag(server.URL)
+	router := newAPIServer(config, apiServerCmd{}).uploadRouter()
+
+	_, result := callRouter(router, "POST", "/multipart", "")
+	name, _ := result["upload"].(string)
+
+	status, _ := callRouter(router, "DELETE", "/multipart/"+name, "")
+	if status != http.StatusOK {
+		t.Errorf("Failed to abandon upload: %d", status)
+	}
+
+	//
+	// The upload is gone, and names which don't refer to one of
+	// our blob-servers are rejected.
+	//
+	upload := strings.SplitN(name, "-", 2)[0]
+	names := []string{
+		name,
+		"bogus",
+		upload + "-" + hex.EncodeToString([]byte("http://example.com")),
+		"UPPER-" + hex.EncodeToString([]byte(server.URL)),
+	}
+	for _, n := range names {
+		status, _ = callRouter(router, "GET", "/multipart/"+n, "")
+		if status != http.StatusNotFound {
+			t.Errorf("Unexpected status for upload %s: %d", n, status)
+		}
+	}
+}
+
+//
+// Test that a blob-server which doesn't reply is abandoned.
+//
+func TestMultipartTimeout(t *testing.T) {
+
+	server, cancelled := newHungServer()
+	defer server.Close()
+
+	config, _ := libconfig.NewFromFlag(server.URL)
+	router := newAPIServer(config, apiServerCmd{backendTimeout: 50 * time.Millisecond}).uploadRouter()
+
+	name := "abc-" + hex.EncodeToString([]byte(server.URL))
+	status, _ := callRouter(router, "GET", "/multipart/"+name, "")
+	if status != http.StatusInternalServerError {
+		t.Errorf("Unexpected status for a hung server: %d", status)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Errorf("The request to the hung server wasn't cancelled")
+	}
+}
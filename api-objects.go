@@ -0,0 +1,347 @@
+//
+// Named objects.
+//
+// Objects are identified by the SHA1 hash of their content, which means
+// that a client must remember the ID of everything it uploads.  Instead
+// an object may be uploaded beneath a name of the client's choosing,
+// within a bucket:
+//
+//   PUT    /objects/{bucket}/{path}  - Upload an object, replacing any
+//                                      object which had the same name.
+//   DELETE /objects/{bucket}/{path}  - Remove the name.
+//   GET    /objects/{bucket}         - List the names within a bucket.
+//
+//   GET    /objects/{bucket}/{path}  - Download the object with a name.
+//
+//   GET    /fetch/{bucket}/{path}    - Download the object with a name,
+//                                      if its bucket is public.
+//
+// The bucket must have been created first, and its policy is applied to
+// the objects uploaded to it, see `api-buckets.go`.
+//
+// Names are recorded in our cluster metadata, with keys of the form
+// `objects/${bucket}/${path}`, and map to the ID of the object.  The
+// objects themselves are stored exactly as any other upload is, so
+// objects with the same content are only stored once.
+//
+// For that reason the privacy of a bucket applies to the names within
+// it:  anybody who knows the ID of an object may fetch it, just as they
+// could if it had been sent to `/upload`.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//
+// namedObject is the value recorded for each name.
+//
+type namedObject struct {
+	ID   string `json:"id"`
+	Size int64  `json:"size"`
+}
+
+//
+// maxListLimit is the most names we return in a single listing.
+//
+const maxListLimit = 1000
+
+//
+// validBucket matches the names we allow for buckets.
+//
+var validBucket = regexp.MustCompile("^[a-z0-9][a-z0-9.-]{0,62}$")
+
+//
+// objectKey returns the metadata key which holds the given name.
+//
+func objectKey(bucket string, path string) string {
+	return "objects/" + bucket + "/" + path
+}
+
+//
+// objectName returns the bucket and path a request refers to, or reports
+// an error to the caller.
+//
+func objectName(res http.ResponseWriter, req *http.Request) (string, string, bool) {
+	vars := mux.Vars(req)
+	bucket := vars["bucket"]
+	path := vars["path"]
+
+	if !validBucket.MatchString(bucket) {
+		jsonError(res, http.StatusBadRequest, "invalid bucket")
+		return "", "", false
+	}
+	if path == "" || !validMetaKey(objectKey(bucket, path)) {
+		jsonError(res, http.StatusBadRequest, "invalid name")
+		return "", "", false
+	}
+	return bucket, path, true
+}
+
+//
+// lookupObject returns the object with the given name.
+//
+// The second value is false if there is no such object.
+//
+func (api *apiServer) lookupObject(bucket string, path string) (namedObject, bool, error) {
+	var obj namedObject
+
+	entry, found, err := api.getMeta(objectKey(bucket, path))
+	if err != nil || !found {
+		return obj, false, err
+	}
+
+	err = json.Unmarshal(entry.Value, &obj)
+	if err != nil {
+		return obj, false, err
+	}
+	return obj, true, nil
+}
+
+// APIObjectPutHandler uploads an object beneath the given name.
+//
+// The object is stored exactly as `/upload` would store it, subject to
+// the policy of its bucket, and then the name is recorded.  If the name
+// was already in use it now refers to the new object.
+func (api *apiServer) APIObjectPutHandler(res http.ResponseWriter, req *http.Request) {
+	bucket, path, ok := objectName(res, req)
+	if !ok {
+		return
+	}
+	policy, ok := api.findBucket(res, bucket)
+	if !ok {
+		return
+	}
+
+	if !policy.allowsType(req.Header.Get("X-Mime-Type")) {
+		jsonError(res, http.StatusUnsupportedMediaType, "MIME type is not allowed in this bucket")
+		return
+	}
+
+	//
+	// If the bucket has a size limit we don't read more than is
+	// allowed, whatever the caller claims to be sending.
+	//
+	body := io.Reader(req.Body)
+	if policy.MaxSize > 0 {
+		if req.ContentLength > policy.MaxSize {
+			jsonError(res, http.StatusRequestEntityTooLarge, fmt.Sprintf("objects in this bucket may not exceed %d bytes", policy.MaxSize))
+			return
+		}
+		body = io.LimitReader(req.Body, policy.MaxSize+1)
+	}
+
+	spool, id, size, err := spoolUpload(body)
+	if err != nil {
+		jsonError(res, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	if policy.MaxSize > 0 && size > policy.MaxSize {
+		jsonError(res, http.StatusRequestEntityTooLarge, fmt.Sprintf("objects in this bucket may not exceed %d bytes", policy.MaxSize))
+		return
+	}
+
+	quorum := func(group string) int {
+		return policy.quorum(group, api.replicaQuorum)
+	}
+	stored, attempts := api.storeReplicas(api.uploadServers(id), id, spool, size, uploadHeaders(req), quorum)
+	if len(stored) == 0 {
+		api.uploadResult(res, id, size, stored, attempts, nil)
+		return
+	}
+
+	//
+	// Now the object is stored we can give it its name.
+	//
+	value, _ := json.Marshal(namedObject{ID: id, Size: size})
+	err = api.putMeta(MetaEntry{
+		Key:      objectKey(bucket, path),
+		Value:    value,
+		Modified: time.Now().UTC(),
+	})
+	if err != nil {
+		jsonError(res, http.StatusInternalServerError, "failed to record name: "+err.Error())
+		return
+	}
+
+	api.uploadResult(res, id, size, stored, attempts, map[string]interface{}{
+		"bucket": bucket,
+		"key":    path,
+	})
+}
+
+// APIObjectDeleteHandler removes the given name.
+//
+// The object the name referred to is left alone, since other names, or
+// clients who know its ID, might still refer to it.  Use `/delete/{id}`
+// to remove it.
+func (api *apiServer) APIObjectDeleteHandler(res http.ResponseWriter, req *http.Request) {
+	bucket, path, ok := objectName(res, req)
+	if !ok {
+		return
+	}
+
+	obj, found, err := api.lookupObject(bucket, path)
+	if err != nil {
+		jsonError(res, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !found {
+		jsonError(res, http.StatusNotFound, "no such object")
+		return
+	}
+
+	err = api.putMeta(MetaEntry{
+		Key:      objectKey(bucket, path),
+		Modified: time.Now().UTC(),
+		Deleted:  true,
+	})
+	if err != nil {
+		jsonError(res, http.StatusInternalServerError, "failed to remove name: "+err.Error())
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(map[string]interface{}{
+		"bucket": bucket,
+		"key":    path,
+		"id":     obj.ID,
+		"status": "OK",
+	})
+}
+
+// APIObjectListHandler lists the names within a bucket, in order.
+//
+// The listing may be restricted to names beginning with a given prefix,
+// and is paginated:
+//
+//   GET /objects/{bucket}?prefix=photos/&after=photos/b.jpg&limit=100
+//
+// If there may be more names the reply includes `next`, which should be
+// given as `after` to retrieve them.
+func (api *apiServer) APIObjectListHandler(res http.ResponseWriter, req *http.Request) {
+	bucket := mux.Vars(req)["bucket"]
+	if !validBucket.MatchString(bucket) {
+		jsonError(res, http.StatusBadRequest, "invalid bucket")
+		return
+	}
+	if _, ok := api.findBucket(res, bucket); !ok {
+		return
+	}
+
+	limit := maxListLimit
+	if req.FormValue("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(req.FormValue("limit"))
+		if err != nil || limit < 1 || limit > maxListLimit {
+			jsonError(res, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxListLimit))
+			return
+		}
+	}
+
+	after := ""
+	if req.FormValue("after") != "" {
+		after = objectKey(bucket, req.FormValue("after"))
+	}
+
+	prefix := objectKey(bucket, req.FormValue("prefix"))
+	entries, next, err := api.listMeta(prefix, after, limit)
+	if err != nil {
+		jsonError(res, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	objects := []map[string]interface{}{}
+	for _, entry := range entries {
+		var obj namedObject
+		if json.Unmarshal(entry.Value, &obj) != nil {
+			continue
+		}
+		objects = append(objects, map[string]interface{}{
+			"key":      strings.TrimPrefix(entry.Key, objectKey(bucket, "")),
+			"id":       obj.ID,
+			"size":     obj.Size,
+			"modified": entry.Modified,
+		})
+	}
+
+	reply := map[string]interface{}{
+		"bucket":  bucket,
+		"objects": objects,
+	}
+	if next != "" {
+		reply["next"] = strings.TrimPrefix(next, objectKey(bucket, ""))
+	}
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(reply)
+}
+
+// APIObjectGetHandler downloads the object with the given name, whatever
+// the policy of its bucket.
+//
+// This is served upon our upload port, so that the objects within private
+// buckets may be fetched by the same clients which may upload them.
+func (api *apiServer) APIObjectGetHandler(res http.ResponseWriter, req *http.Request) {
+	api.fetchNamed(res, req, false)
+}
+
+// APIObjectFetchHandler downloads the object with the given name, if its
+// bucket is public.
+//
+// The reply is exactly as if the object had been requested by its ID,
+// except that it must not be cached without checking it is current,
+// since the name might later refer to a different object.
+func (api *apiServer) APIObjectFetchHandler(res http.ResponseWriter, req *http.Request) {
+	api.fetchNamed(res, req, true)
+}
+
+//
+// fetchNamed sends the object with the name a request refers to, to the
+// caller.  If `public` is true then the object is only sent if it is
+// within a public bucket.
+//
+func (api *apiServer) fetchNamed(res http.ResponseWriter, req *http.Request, public bool) {
+	bucket, path, ok := objectName(res, req)
+	if !ok {
+		return
+	}
+
+	policy, found, err := api.lookupBucket(bucket)
+	if err == nil && found && public && !policy.Public {
+		res.Header().Set("Connection", "close")
+		res.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	var obj namedObject
+	if err == nil && found {
+		obj, found, err = api.lookupObject(bucket, path)
+	}
+	if err != nil {
+		res.Header().Set("Connection", "close")
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		res.Header().Set("Connection", "close")
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	api.serveObject(res, req, obj.ID, false)
+}
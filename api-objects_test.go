@@ -0,0 +1,144 @@
+//
+// Test named objects via the API-server.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/skx/sos/libconfig"
+)
+
+//
+// Test uploading, listing, fetching, and removing named objects.
+//
+func TestNamedObjects(t *testing.T) {
+
+	server, cleanup := newTestBlobServer(t)
+	defer cleanup()
+
+	config, _ := libconfig.NewFromFlag(server.URL)
+	api := newAPIServer(config, apiServerCmd{})
+	router := api.uploadRouter()
+	download := api.downloadRouter()
+
+	//
+	// Invalid names are refused.
+	//
+	for _, path := range []string{"/objects/UPPER/x", "/objects/-dash/x"} {
+		status, _ := callRouter(router, "PUT", path, "x")
+		if status != http.StatusBadRequest {
+			t.Errorf("Unexpected status %d uploading %s", status, path)
+		}
+	}
+
+	//
+	// Objects may only be uploaded to buckets which exist.
+	//
+	status, _ := callRouter(router, "PUT", "/objects/test/x", "x")
+	if status != http.StatusNotFound {
+		t.Errorf("Unexpected status %d uploading to a missing bucket", status)
+	}
+	status, _ = callRouter(router, "PUT", "/buckets/test", "")
+	if status != http.StatusOK {
+		t.Fatalf("Failed to create bucket: %d", status)
+	}
+
+	//
+	// Upload some objects, one of them twice.
+	//
+	uploads := []struct {
+		path    string
+		content string
+	}{
+		{"photos/a.jpg", "first"},
+		{"photos/b.jpg", "second"},
+		{"photos/c.jpg", "third"},
+		{"notes.txt", "notes"},
+		{"photos/a.jpg", "replaced"},
+	}
+	for _, upload := range uploads {
+		status, result := callRouter(router, "PUT", "/objects/test/"+upload.path, upload.content)
+		if status != http.StatusOK || result["key"] != upload.path || result["bucket"] != "test" {
+			t.Fatalf("Failed to upload %s: %d %v", upload.path, status, result)
+		}
+	}
+
+	//
+	// The most recent upload is returned, and may change.
+	//
+	req, _ := http.NewRequest("GET", "/fetch/test/photos/a.jpg", nil)
+	rr := httptest.NewRecorder()
+	download.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "replaced" {
+		t.Errorf("Unexpected reply %d %s", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("Named object may be cached: %s", rr.Header().Get("Cache-Control"))
+	}
+	if rr.Header().Get("X-Mime-Type") != "text/plain" {
+		t.Errorf("Headers were not stored")
+	}
+
+	//
+	// List the objects, a page at a time.
+	//
+	var keys []string
+	after := ""
+	for pages := 0; pages < 10; pages++ {
+		var result struct {
+			Objects []struct {
+				Key  string `json:"key"`
+				Size int64  `json:"size"`
+			} `json:"objects"`
+			Next string `json:"next"`
+		}
+
+		req, _ = http.NewRequest("GET", "/objects/test?prefix=photos/&limit=2&after="+after, nil)
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		json.Unmarshal(rr.Body.Bytes(), &result)
+
+		for _, obj := range result.Objects {
+			keys = append(keys, obj.Key)
+		}
+		if result.Next == "" {
+			break
+		}
+		after = result.Next
+	}
+	if strings.Join(keys, ",") != "photos/a.jpg,photos/b.jpg,photos/c.jpg" {
+		t.Errorf("Unexpected listing %v", keys)
+	}
+
+	//
+	// Remove a name, which can then no longer be fetched.
+	//
+	status, _ = callRouter(router, "DELETE", "/objects/test/photos/b.jpg", "")
+	if status != http.StatusOK {
+		t.Errorf("Failed to remove object: %d", status)
+	}
+	status, _ = callRouter(router, "DELETE", "/objects/test/photos/b.jpg", "")
+	if status != http.StatusNotFound {
+		t.Errorf("Removed a missing object: %d", status)
+	}
+
+	req, _ = http.NewRequest("GET", "/fetch/test/photos/b.jpg", nil)
+	rr = httptest.NewRecorder()
+	download.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Fetched a removed object: %d", rr.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/objects/test", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if strings.Contains(rr.Body.String(), "b.jpg") {
+		t.Errorf("Removed object is still listed: %s", rr.Body.String())
+	}
+}
@@ -0,0 +1,137 @@
+//
+// Cluster metadata, on the blob-server.
+//
+// Keys may contain any character, so they're hex-encoded when they
+// appear in a path:
+//
+//   GET /meta?prefix=XX&after=XX&limit=N  - List entries, in order.
+//   GET /meta/{hex-key}                   - Retrieve an entry.
+//   PUT /meta/{hex-key}                   - Store an entry.
+//
+// Entries are stored only if they're more recent than the copy we hold,
+// so the API-server, and the replicator, may safely send them to us in
+// any order.
+//
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+//
+// metaStorage returns our storage, or reports to the caller that it
+// doesn't support metadata.
+//
+func metaStorage(res http.ResponseWriter) (MetadataHandler, bool) {
+	storage, ok := STORAGE.(MetadataHandler)
+	if !ok {
+		http.Error(res, "metadata is not supported", http.StatusNotImplemented)
+	}
+	return storage, ok
+}
+
+//
+// metaKey returns the key a request refers to, or reports an error to
+// the caller.
+//
+func metaKey(res http.ResponseWriter, req *http.Request) (string, bool) {
+	key, err := hex.DecodeString(mux.Vars(req)["key"])
+	if err != nil || !validMetaKey(string(key)) {
+		http.Error(res, errInvalidMetaKey.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return string(key), true
+}
+
+// MetaListHandler returns the metadata entries whose keys begin with the
+// given prefix, in order, including any tombstones.
+//
+// The listing may be paginated, exactly as for `/blobs`.
+func MetaListHandler(res http.ResponseWriter, req *http.Request) {
+	storage, ok := metaStorage(res)
+	if !ok {
+		return
+	}
+
+	limit := 0
+	if req.FormValue("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(req.FormValue("limit"))
+		if err != nil || limit < 0 {
+			http.Error(res, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	list := storage.ListMeta(req.FormValue("prefix"), req.FormValue("after"), limit)
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(list)
+}
+
+// MetaGetHandler returns a single metadata entry, which may be a
+// tombstone.
+func MetaGetHandler(res http.ResponseWriter, req *http.Request) {
+	storage, ok := metaStorage(res)
+	if !ok {
+		return
+	}
+	key, ok := metaKey(res, req)
+	if !ok {
+		return
+	}
+
+	entry, ok := storage.GetMeta(key)
+	if !ok {
+		http.NotFound(res, req)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(entry)
+}
+
+// MetaPutHandler stores a single metadata entry, unless we hold a more
+// recent copy of it, and returns the entry we hold afterwards.
+func MetaPutHandler(res http.ResponseWriter, req *http.Request) {
+	var (
+		status int
+		err    error
+	)
+	defer func() {
+		if nil != err {
+			http.Error(res, err.Error(), status)
+		}
+	}()
+
+	storage, ok := metaStorage(res)
+	if !ok {
+		return
+	}
+	key, ok := metaKey(res, req)
+	if !ok {
+		return
+	}
+
+	var entry MetaEntry
+	err = json.NewDecoder(http.MaxBytesReader(res, req.Body, 1024*1024)).Decode(&entry)
+	if err != nil || entry.Modified.IsZero() {
+		err = errors.New("invalid entry")
+		status = http.StatusBadRequest
+		return
+	}
+	entry.Key = key
+
+	entry, err = storage.PutMeta(entry)
+	if err != nil {
+		status = http.StatusInternalServerError
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(entry)
+}
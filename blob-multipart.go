@@ -0,0 +1,236 @@
+//
+// Multipart uploads, on the blob-server.
+//
+// The API-server chooses a single blob-server to hold the parts of each
+// multipart upload, which is asked to join them together, and hash the
+// result, once the upload is complete.  The API-server then copies the
+// object to wherever it belongs, and removes the upload.
+//
+//   POST   /multipart/{upload}           - Begin an upload.
+//   PUT    /multipart/{upload}/{part}    - Store a part.
+//   GET    /multipart/{upload}           - List the parts we hold.
+//   POST   /multipart/{upload}/complete  - Join the parts together.
+//   GET    /multipart/{upload}/object    - Retrieve the joined object.
+//   POST   /multipart/{upload}/commit    - Store the joined object.
+//   DELETE /multipart/{upload}           - Remove the upload.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//
+// multipartUpload returns our storage, and the upload the request refers
+// to, or reports an error to the caller.
+//
+func multipartUpload(res http.ResponseWriter, req *http.Request) (MultipartHandler, string, bool) {
+
+	storage, ok := STORAGE.(MultipartHandler)
+	if !ok {
+		http.Error(res, "multipart uploads are not supported", http.StatusNotImplemented)
+		return nil, "", false
+	}
+
+	//
+	// The upload names a directory, so it must be alphanumeric
+	// to prevent traversal attacks, just like our IDs.
+	//
+	upload := mux.Vars(req)["upload"]
+	r, _ := regexp.Compile("^([a-z0-9]+)$")
+	if !r.MatchString(upload) {
+		http.Error(res, "alphanumeric IDs only", http.StatusInternalServerError)
+		return nil, "", false
+	}
+	return storage, upload, true
+}
+
+//
+// multipartError reports the given error to the caller, with a suitable
+// status-code.
+//
+func multipartError(res http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if _, missing := err.(missingPart); missing {
+		status = http.StatusConflict
+	}
+	switch err {
+	case errUnknownUpload:
+		status = http.StatusNotFound
+	case errUploadExists, errUploadComplete, errUploadIncomplete, errUploadBusy, errNoParts:
+		status = http.StatusConflict
+	}
+	http.Error(res, err.Error(), status)
+}
+
+//
+// multipartReply sends the given values, as JSON, to the caller.
+//
+func multipartReply(res http.ResponseWriter, reply map[string]interface{}) {
+	reply["status"] = "OK"
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(reply)
+}
+
+// MultipartCreateHandler begins a new multipart upload.
+//
+// Any X-headers are stored alongside the object the upload produces.
+func MultipartCreateHandler(res http.ResponseWriter, req *http.Request) {
+	storage, upload, ok := multipartUpload(res, req)
+	if !ok {
+		return
+	}
+
+	extras := make(map[string]string)
+	for header, value := range req.Header {
+		if strings.HasPrefix(header, "X-") {
+			extras[header] = value[0]
+		}
+	}
+
+	err := storage.CreateUpload(upload, extras)
+	if err != nil {
+		multipartError(res, err)
+		return
+	}
+	multipartReply(res, map[string]interface{}{"upload": upload})
+}
+
+// MultipartPartHandler stores a single part of a multipart upload.
+//
+// Parts are numbered from one, and a part which is sent again replaces
+// the previous copy.
+func MultipartPartHandler(res http.ResponseWriter, req *http.Request) {
+	storage, upload, ok := multipartUpload(res, req)
+	if !ok {
+		return
+	}
+
+	part, err := strconv.Atoi(mux.Vars(req)["part"])
+	if err != nil || part < 1 || part > maxParts {
+		http.Error(res, "invalid part", http.StatusBadRequest)
+		return
+	}
+
+	size, err := storage.StorePart(upload, part, req.Body)
+	if err != nil {
+		multipartError(res, err)
+		return
+	}
+	multipartReply(res, map[string]interface{}{
+		"upload": upload,
+		"part":   part,
+		"size":   size,
+	})
+}
+
+// MultipartListHandler reports the parts of a multipart upload which we
+// hold, so that a client can resume an interrupted upload.
+//
+// Once the upload has been completed the object it produced is reported
+// too.
+func MultipartListHandler(res http.ResponseWriter, req *http.Request) {
+	storage, upload, ok := multipartUpload(res, req)
+	if !ok {
+		return
+	}
+
+	parts, obj, err := storage.Parts(upload)
+	if err != nil {
+		multipartError(res, err)
+		return
+	}
+
+	reply := map[string]interface{}{
+		"upload": upload,
+		"parts":  parts,
+	}
+	if obj != nil {
+		reply["id"] = obj.ID
+		reply["size"] = obj.Size
+	}
+	multipartReply(res, reply)
+}
+
+// MultipartCompleteHandler joins the parts of a multipart upload
+// together, and reports the ID and size of the result.
+func MultipartCompleteHandler(res http.ResponseWriter, req *http.Request) {
+	storage, upload, ok := multipartUpload(res, req)
+	if !ok {
+		return
+	}
+
+	obj, err := storage.CompleteUpload(upload)
+	if err != nil {
+		multipartError(res, err)
+		return
+	}
+	multipartReply(res, map[string]interface{}{
+		"upload": upload,
+		"id":     obj.ID,
+		"size":   obj.Size,
+	})
+}
+
+// MultipartObjectHandler returns the object produced by a multipart
+// upload, along with the X-headers the upload was begun with.
+func MultipartObjectHandler(res http.ResponseWriter, req *http.Request) {
+	storage, upload, ok := multipartUpload(res, req)
+	if !ok {
+		return
+	}
+
+	data, meta, err := storage.OpenUpload(upload)
+	if err != nil {
+		multipartError(res, err)
+		return
+	}
+	defer data.Close()
+
+	for k, v := range meta {
+		res.Header().Set(k, v)
+	}
+	http.ServeContent(res, req, "", time.Time{}, data)
+}
+
+// MultipartCommitHandler stores the object produced by a multipart
+// upload, as though it had been uploaded directly.
+func MultipartCommitHandler(res http.ResponseWriter, req *http.Request) {
+	storage, upload, ok := multipartUpload(res, req)
+	if !ok {
+		return
+	}
+
+	obj, err := storage.CommitUpload(upload)
+	if err != nil {
+		multipartError(res, err)
+		return
+	}
+	multipartReply(res, map[string]interface{}{
+		"id":   obj.ID,
+		"size": obj.Size,
+	})
+}
+
+// MultipartAbortHandler removes a multipart upload, along with its parts.
+func MultipartAbortHandler(res http.ResponseWriter, req *http.Request) {
+	storage, upload, ok := multipartUpload(res, req)
+	if !ok {
+		return
+	}
+
+	err := storage.AbortUpload(upload)
+	if err != nil {
+		multipartError(res, err)
+		return
+	}
+	multipartReply(res, map[string]interface{}{"upload": upload})
+}
@@ -5,46 +5,86 @@
 package main
 
 import (
-	"bytes"
 	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/skx/sos/libconfig"
 )
 
-// OPTIONS holds options passed to this sub-command, so that we can later
-// test if `-verbose` is in-force.
-var OPTIONS apiServerCmd
+//
+// apiServer holds the state shared by the handlers of our API-server.
+//
+type apiServer struct {
+	// options are those given to the `api-server` sub-command.
+	options apiServerCmd
+
+	// config holds our blob-servers.
+	config *libconfig.Config
+
+	// health holds the health of our blob-servers, if we check it.
+	health *healthChecker
+
+	// index holds our index of object locations, if we maintain one.
+	index *locationIndex
+
+	// conns tracks the requests outstanding to each blob-server.
+	conns *connLimiter
+}
+
+//
+// newAPIServer creates the state of an API-server, using the given
+// blob-servers and options.
+//
+func newAPIServer(config *libconfig.Config, options apiServerCmd) *apiServer {
+	return &apiServer{
+		options: options,
+		config:  config,
+		conns:   newConnLimiter(),
+	}
+}
+
+//
+// perRequest returns a handler which invokes the given method upon a copy
+// of our state, holding a snapshot of our configuration.
+//
+// A request may consult the configuration several times, to find where
+// an object goes and how many copies it needs, and the snapshot ensures
+// that a reload part-way through can't give it a mixture of the old and
+// new configurations.
+//
+func (api *apiServer) perRequest(method func(*apiServer, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		state := *api
+		state.config = api.config.Snapshot()
+		method(&state, res, req)
+	}
+}
 
 //
 // Start the upload/download servers running.
 //
-func apiServer(options apiServerCmd) {
+func runAPIServer(options apiServerCmd) {
 
 	//
-	// If we received blob-servers on the command-line use them too.
-	//
-	// NOTE: blob-servers added on the command-line are placed in the
-	// "default" group.
+	// Load our blob-servers, from the command-line or our
+	// config file(s).
 	//
-	if options.blob != "" {
-		servers := strings.Split(options.blob, ",")
-		for _, entry := range servers {
-			libconfig.AddServer("default", entry)
-		}
-	} else {
-
-		//
-		//  Initialize the servers from our config file(s).
-		//
-		libconfig.InitServers()
+	config, err := loadConfig(options.blob)
+	if err != nil {
+		fmt.Printf("Error reading configuration: %s\n", err.Error())
+		return
 	}
 
 	//
@@ -52,46 +92,91 @@ func apiServer(options apiServerCmd) {
 	//
 	if options.dump {
 		fmt.Printf("\t% 10s - %s\n", "group", "server")
-		for _, entry := range libconfig.Servers() {
+		for _, entry := range config.Servers() {
 			fmt.Printf("\t% 10s - %s\n", entry.Group, entry.Location)
 		}
 		return
 	}
 
-	OPTIONS = options
+	//
+	// Ensure we know how to place objects.
+	//
+	if options.placement != "ordered" && options.placement != "hash" {
+		fmt.Printf("Unknown placement '%s', valid choices are 'ordered' and 'hash'\n", options.placement)
+		return
+	}
+
+	api := newAPIServer(config, options)
+
+	//
+	// If we're avoiding full groups then track their capacity.
+	//
+	minFree, err := parseSize(options.minFree)
+	if err != nil {
+		fmt.Printf("Invalid -min-free: %s\n", err.Error())
+		return
+	}
+	config.SetMinFree(uint64(minFree))
+	config.SetZone(options.zone)
+
+	if options.capacityInterval > 0 {
+		go capacityLoop(config, options.capacityInterval, options.verbose)
+	}
+
+	//
+	// Check the health of our blob-servers, if we should.
+	//
+	api.health = newHealthChecker(config, options.healthRise, options.healthFall, options.healthTimeout)
+	if options.healthInterval > 0 {
+		go api.health.loop(options.healthInterval)
+	}
+
+	//
+	// If our blob-servers came from our configuration files
+	// then reload them when asked.
+	//
+	if options.blob == "" {
+		go reloadLoop(config, api.health, options.reloadInterval)
+	}
+
+	//
+	// If we're maintaining an index of object locations then
+	// load it, and keep it up to date.
+	//
+	if options.index != "" {
+		api.index, err = openLocationIndex(options.index)
+		if err != nil {
+			fmt.Printf("Failed to open index %s: %s\n", options.index, err.Error())
+			return
+		}
+		if options.indexInterval > 0 {
+			go api.index.crawlLoop(config, options.indexInterval, options.verbose)
+		}
+	}
 
 	//
 	// Otherwise show a banner, then launch the server-threads.
 	//
 	fmt.Printf("[Launching API-server]\n")
 	fmt.Printf("\nUpload service\nhttp://%s:%d/upload\n", options.host, options.uport)
+	fmt.Printf("http://%s:%d/delete/:id\n", options.host, options.uport)
+	fmt.Printf("http://%s:%d/multipart\n", options.host, options.uport)
+	fmt.Printf("http://%s:%d/buckets/:bucket\n", options.host, options.uport)
+	fmt.Printf("http://%s:%d/objects/:bucket/:path\n", options.host, options.uport)
+	fmt.Printf("http://%s:%d/backends\n", options.host, options.uport)
 	fmt.Printf("\nDownload service\nhttp://%s:%d/fetch/:id\n", options.host, options.dport)
+	fmt.Printf("http://%s:%d/fetch/:bucket/:path\n", options.host, options.dport)
 
 	//
 	// Show the blob-servers, and their weights
 	//
 	fmt.Printf("\nBlob-servers:\n")
 	fmt.Printf("\t% 10s - %s\n", "group", "server")
-	for _, entry := range libconfig.Servers() {
+	for _, entry := range config.Servers() {
 		fmt.Printf("\t% 10s - %s\n", entry.Group, entry.Location)
 	}
 	fmt.Printf("\n")
 
-	//
-	// Create a route for uploading.
-	//
-	upRouter := mux.NewRouter()
-	upRouter.HandleFunc("/upload", APIUploadHandler).Methods("POST")
-	upRouter.PathPrefix("/").HandlerFunc(APIMissingHandler)
-
-	//
-	// Create a route for downloading.
-	//
-	downRouter := mux.NewRouter()
-	downRouter.HandleFunc("/fetch/{id}", APIDownloadHandler).Methods("GET")
-	downRouter.HandleFunc("/fetch/{id}", APIDownloadHandler).Methods("HEAD")
-	downRouter.PathPrefix("/").HandlerFunc(APIMissingHandler)
-
 	//
 	// The following code is a hack to allow us to run two distinct
 	// HTTP-servers on different ports.
@@ -102,7 +187,7 @@ func apiServer(options apiServerCmd) {
 	wg.Add(1)
 	go func() {
 		err := http.ListenAndServe(fmt.Sprintf("%s:%d", options.host, options.uport),
-			upRouter)
+			api.uploadRouter())
 		if err != nil {
 			panic(err)
 		}
@@ -111,7 +196,7 @@ func apiServer(options apiServerCmd) {
 	wg.Add(1)
 	go func() {
 		err := http.ListenAndServe(fmt.Sprintf("%s:%d", options.host, options.dport),
-			downRouter)
+			api.downloadRouter())
 		if err != nil {
 			panic(err)
 		}
@@ -121,16 +206,43 @@ func apiServer(options apiServerCmd) {
 }
 
 //
-// This is a helper for allowing us to consume a HTTP-body more than once.
-///
-type myReader struct {
-	*bytes.Buffer
+// uploadRouter returns the routes served upon our upload port.
+//
+func (api *apiServer) uploadRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/upload", api.perRequest((*apiServer).APIUploadHandler)).Methods("POST")
+	router.HandleFunc("/delete/{id}", api.perRequest((*apiServer).APIDeleteHandler)).Methods("DELETE")
+	router.HandleFunc("/multipart", api.perRequest((*apiServer).APIMultipartCreateHandler)).Methods("POST")
+	router.HandleFunc("/multipart/{upload}", api.perRequest((*apiServer).APIMultipartListHandler)).Methods("GET")
+	router.HandleFunc("/multipart/{upload}", api.perRequest((*apiServer).APIMultipartAbortHandler)).Methods("DELETE")
+	router.HandleFunc("/multipart/{upload}/complete", api.perRequest((*apiServer).APIMultipartCompleteHandler)).Methods("POST")
+	router.HandleFunc("/multipart/{upload}/{part}", api.perRequest((*apiServer).APIMultipartPartHandler)).Methods("PUT")
+	router.HandleFunc("/buckets", api.perRequest((*apiServer).APIBucketListHandler)).Methods("GET")
+	router.HandleFunc("/buckets/{bucket}", api.perRequest((*apiServer).APIBucketGetHandler)).Methods("GET")
+	router.HandleFunc("/buckets/{bucket}", api.perRequest((*apiServer).APIBucketPutHandler)).Methods("PUT")
+	router.HandleFunc("/buckets/{bucket}", api.perRequest((*apiServer).APIBucketDeleteHandler)).Methods("DELETE")
+	router.HandleFunc("/objects/{bucket}", api.perRequest((*apiServer).APIObjectListHandler)).Methods("GET")
+	router.HandleFunc("/objects/{bucket}/{path:.+}", api.perRequest((*apiServer).APIObjectGetHandler)).Methods("GET", "HEAD")
+	router.HandleFunc("/objects/{bucket}/{path:.+}", api.perRequest((*apiServer).APIObjectPutHandler)).Methods("PUT")
+	router.HandleFunc("/objects/{bucket}/{path:.+}", api.perRequest((*apiServer).APIObjectDeleteHandler)).Methods("DELETE")
+	if api.health != nil {
+		router.Handle("/backends", api.health).Methods("GET")
+	}
+	router.PathPrefix("/").HandlerFunc(APIMissingHandler)
+	return router
 }
 
 //
-// So that it implements the io.ReadCloser interface
+// downloadRouter returns the routes served upon our download port.
 //
-func (m myReader) Close() error { return nil }
+func (api *apiServer) downloadRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/fetch/{id}", api.perRequest((*apiServer).APIDownloadHandler)).Methods("GET")
+	router.HandleFunc("/fetch/{id}", api.perRequest((*apiServer).APIDownloadHandler)).Methods("HEAD")
+	router.HandleFunc("/fetch/{bucket}/{path:.+}", api.perRequest((*apiServer).APIObjectFetchHandler)).Methods("GET", "HEAD")
+	router.PathPrefix("/").HandlerFunc(APIMissingHandler)
+	return router
+}
 
 // APIUploadHandler handles uploads to the API server.
 //
@@ -150,95 +262,397 @@ func (m myReader) Close() error { return nil }
 // lookups.  See `SCALING.md` for more details.
 //
 //
-func APIUploadHandler(res http.ResponseWriter, req *http.Request) {
+func (api *apiServer) APIUploadHandler(res http.ResponseWriter, req *http.Request) {
 
-	//
-	// We create a new buffer to hold the request-body.
-	//
-	buf, _ := ioutil.ReadAll(req.Body)
+	spool, id, size, err := spoolUpload(req.Body)
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(res, "{\"error\":\"%s\"}", err.Error())
+		return
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
 
 	//
-	// Create a copy of the buffer, so that we can consume
-	// it initially to hash the data.
+	// Now we're going to attempt to re-POST the uploaded
+	// content to our blob-servers, until enough of them have
+	// accepted it.
 	//
-	rdr1 := myReader{bytes.NewBuffer(buf)}
+	stored, attempts := api.storeReplicas(api.uploadServers(id), id, spool, size, uploadHeaders(req), api.replicaQuorum)
+	api.uploadResult(res, id, size, stored, attempts, nil)
+}
+
+//
+// spoolUpload reads the body of an upload, and returns its ID and size.
+//
+// We need to know the SHA1 hash of the uploaded data before we can send
+// it anywhere, and we might need to send it more than once if a
+// blob-server rejects it.  Rather than holding the body in RAM we spool
+// it to a temporary file, hashing it as it is written.
+//
+// The caller must close, and remove, the returned file.
+//
+func spoolUpload(body io.Reader) (*os.File, string, int64, error) {
+	spool, err := ioutil.TempFile("", "sos-upload")
+	if err != nil {
+		return nil, "", 0, errors.New("failed to create spool file")
+	}
 
 	//
 	// Get the SHA1 hash of the uploaded data.
 	//
 	hasher := sha1.New()
-	b, _ := ioutil.ReadAll(rdr1)
-	hasher.Write([]byte(b))
-	hash := hasher.Sum(nil)
+	size, err := io.Copy(spool, io.TeeReader(body, hasher))
+	if err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		return nil, "", 0, errors.New("failed to read body")
+	}
+	return spool, hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+//
+// uploadHeaders returns the X-headers of an upload, which are stored
+// alongside the object.
+//
+func uploadHeaders(req *http.Request) http.Header {
+	header := make(http.Header)
+	for name, value := range req.Header {
+		if strings.HasPrefix(name, "X-") {
+			header.Set(name, value[0])
+		}
+	}
+	return header
+}
+
+//
+// uploadResult reports the outcome of an upload to the caller, recording
+// where the object was stored if it succeeded.
+//
+// Any extra values are added to the reply, if the upload succeeded.
+//
+func (api *apiServer) uploadResult(res http.ResponseWriter, id string, size int64, stored []string, attempts []uploadAttempt, extra map[string]interface{}) {
+	if len(stored) > 0 {
+
+		//
+		// Remember where we put it.
+		//
+		if api.index != nil {
+			for _, location := range stored {
+				api.index.Add(id, location)
+			}
+		}
+
+		reply := map[string]interface{}{
+			"id":       id,
+			"size":     size,
+			"status":   "OK",
+			"replicas": len(stored),
+		}
+		for k, v := range extra {
+			reply[k] = v
+		}
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(reply)
+		return
+	}
 
 	//
-	// Now we're going to attempt to re-POST the uploaded
-	// content to one of our blob-servers.
+	// If we reach here we've attempted our upload on every
+	// known blob-server and not enough accepted it.
 	//
-	// We try each blob-server in turn, and if/when we receive
-	// a successful result we'll return it to the caller.
+	// Let the caller know, and tell them why.
 	//
-	for _, s := range libconfig.OrderedServers() {
+	if attempts == nil {
+		attempts = []uploadAttempt{}
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(res).Encode(map[string]interface{}{
+		"error":    "upload failed",
+		"attempts": attempts,
+	})
+	return
 
-		//
-		// Replace the request body with the (second) copy we made.
-		//
-		rdr2 := myReader{bytes.NewBuffer(buf)}
-		req.Body = rdr2
+}
 
-		//
-		// This is where we'll POST to.
-		//
-		url := fmt.Sprintf("%s%s%x", s.Location, "/blob/", hash)
+//
+// uploadServers returns the servers we'll try to upload the given ID to,
+// in order, according to our placement policy.
+//
+func (api *apiServer) uploadServers(id string) []libconfig.BlobServer {
+	if api.options.placement == "hash" {
+		return api.config.HashedUploadServers(id)
+	}
+	return api.config.UploadServers()
+}
 
-		//
-		// Build up a new request.
-		//
-		child, _ := http.NewRequest("POST", url, req.Body)
+//
+// downloadServers returns the servers we'll try to download the given ID
+// from, in order, according to our placement policy.
+//
+func (api *apiServer) downloadServers(id string) []libconfig.BlobServer {
+	if api.options.placement == "hash" {
+		return api.config.HashedServers(id)
+	}
+	return api.config.OrderedServers()
+}
 
-		//
-		// Propagate any incoming X-headers
-		//
-		for header, value := range req.Header {
-			if strings.HasPrefix(header, "X-") {
-				child.Header.Set(header, value[0])
-			}
+//
+// replicaQuorum returns the number of members of the given group which
+// must store an upload before it succeeds.
+//
+// This is taken from the group's settings, if present, otherwise from
+// our command-line.
+//
+func (api *apiServer) replicaQuorum(group string) int {
+	if replicas := api.config.GroupSettings(group).Replicas; replicas > 0 {
+		return replicas
+	}
+	return api.options.minReplicas
+}
+
+//
+// uploadAttempt records a failed attempt to upload to a blob-server.
+//
+type uploadAttempt struct {
+	Server string `json:"server"`
+	Group  string `json:"group"`
+	Error  string `json:"error"`
+}
+
+//
+// uploadBlob POSTs the given content to a single blob-server, under the
+// given ID, and returns an error if it wasn't accepted.
+//
+// Each call reads the content independently, so that we can send it
+// to several servers at once.
+//
+func (api *apiServer) uploadBlob(location string, id string, body io.ReaderAt, size int64, header http.Header) error {
+	return api.postBlob(location, id, io.NewSectionReader(body, 0, size), size, header)
+}
+
+//
+// postBlob POSTs the content of the given reader to a single blob-server,
+// under the given ID, and returns an error if it wasn't accepted.
+//
+// A blob-server has only accepted our content if it returns a 200
+// response, and the JSON it returns describes the object we sent.
+//
+func (api *apiServer) postBlob(location string, id string, body io.Reader, size int64, header http.Header) error {
+
+	//
+	// This is where we'll POST to.
+	//
+	url := fmt.Sprintf("%s%s%s", location, "/blob/", id)
+
+	if api.options.verbose {
+		fmt.Printf("Attempting upload to %s\n", url)
+	}
+
+	//
+	// Build up a new request.
+	//
+	child, _ := http.NewRequest("POST", url, body)
+	child.ContentLength = size
+	for name, value := range header {
+		child.Header[name] = value
+	}
+
+	//
+	// Send the request.
+	//
+	client := &http.Client{}
+	r, err := client.Do(child)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	//
+	// We only need to read a small reply.
+	//
+	reply, err := ioutil.ReadAll(io.LimitReader(r.Body, 4096))
+	if err != nil {
+		return err
+	}
+
+	//
+	// Failures might be described by JSON, or by plain text.
+	//
+	var result struct {
+		ID     string `json:"id"`
+		Size   int64  `json:"size"`
+		Status string `json:"status"`
+		Error  string `json:"error"`
+	}
+	decoded := json.Unmarshal(reply, &result) == nil
+
+	if r.StatusCode != http.StatusOK {
+		reason := strings.TrimSpace(string(reply))
+		if decoded && result.Error != "" {
+			reason = result.Error
+		}
+		if reason == "" {
+			return fmt.Errorf("status %d", r.StatusCode)
 		}
+		return fmt.Errorf("status %d: %s", r.StatusCode, reason)
+	}
 
-		//
-		// Send the request.
-		//
-		client := &http.Client{}
-		r, err := client.Do(child)
+	//
+	// A 200 response must still describe a successful upload.
+	//
+	if !decoded {
+		return errors.New("invalid response")
+	}
+	if result.Status != "OK" {
+		return fmt.Errorf("unexpected status %q", result.Status)
+	}
+	if result.ID != id || result.Size != size {
+		return fmt.Errorf("stored %s with size %d, expected %s with size %d", result.ID, result.Size, id, size)
+	}
+	return nil
+}
 
-		//
-		// If there was no error we're good.
-		//
-		if err == nil {
+//
+// storeReplicas uploads the given content to the members of a single
+// group, until enough of them have accepted it, and returns the locations
+// of those which did so.  The number of copies each group requires is
+// given by the quorum function.
+//
+// If no group can accept enough copies nothing is returned.  In either
+// case every failed attempt is returned too.
+//
+// The groups are tried in the order in which they appear in the given
+// list of servers, normally the output of api.uploadServers(), which means
+// that when we only need a single copy we try the first server of each
+// group, then the second server of each group, and so on.  See
+// `SCALING.md` for the rationale.
+//
+// When we need more copies we write to that many members of a group in
+// parallel, and if some fail we move on to the next group - returning
+// to the first group later to try its remaining members.
+//
+func (api *apiServer) storeReplicas(servers []libconfig.BlobServer, id string, body io.ReaderAt, size int64, header http.Header, quorum func(group string) int) ([]string, []uploadAttempt) {
+	return api.storeWith(servers, quorum, func(s libconfig.BlobServer) error {
+		return api.uploadBlob(s.Location, id, body, size, header)
+	})
+}
 
-			//
-			// We read the reply we received from the
-			// blob-server and return it to the caller.
-			//
-			response, _ := ioutil.ReadAll(r.Body)
+//
+// storeWith stores an object upon the given servers, as storeReplicas
+// does, but invokes the given function to store it upon each server.
+//
+func (api *apiServer) storeWith(servers []libconfig.BlobServer, quorum func(group string) int, store func(s libconfig.BlobServer) error) ([]string, []uploadAttempt) {
+
+	//
+	// The state of each group we might store the content within.
+	//
+	type candidate struct {
+		name    string
+		min     int
+		members []libconfig.BlobServer
+		next    int
+		stored  []string
+	}
 
-			if response != nil {
-				fmt.Fprintf(res, string(response))
-				return
+	//
+	// Find the groups, in order, along with their members.
+	//
+	var all []*candidate
+	seen := make(map[string]*candidate)
+	for _, s := range servers {
+		g, ok := seen[s.Group]
+		if !ok {
+			g = &candidate{name: s.Group, min: quorum(s.Group)}
+			if g.min < 1 {
+				g.min = 1
 			}
+			seen[s.Group] = g
+			all = append(all, g)
 		}
+		g.members = append(g.members, s)
 	}
 
 	//
-	// If we reach here we've attempted our upload on every
-	// known blob-server and none accepted it.
+	// Only groups with enough members are useful.
 	//
-	// Let the caller know.
+	var groups []*candidate
+	for _, g := range all {
+		if len(g.members) < g.min {
+			if api.options.verbose {
+				fmt.Printf("Skipping group %s - it has fewer than %d members\n", g.name, g.min)
+			}
+			continue
+		}
+		groups = append(groups, g)
+	}
+
 	//
-	res.WriteHeader(http.StatusInternalServerError)
-	fmt.Fprintf(res, "{\"error\":\"upload failed\"}")
-	return
+	// Keep going while we have untried servers.
+	//
+	var attempts []uploadAttempt
+	progress := true
+	for progress {
+		progress = false
 
+		for _, g := range groups {
+
+			if g.next >= len(g.members) {
+				continue
+			}
+			progress = true
+
+			//
+			// Upload to as many members as we still need,
+			// in parallel.
+			//
+			end := g.next + g.min - len(g.stored)
+			if end > len(g.members) {
+				end = len(g.members)
+			}
+			batch := g.members[g.next:end]
+			g.next = end
+
+			var wg sync.WaitGroup
+			var mutex sync.Mutex
+			for _, s := range batch {
+				wg.Add(1)
+				go func(s libconfig.BlobServer) {
+					defer wg.Done()
+
+					err := errBackendBusy
+					if api.conns.acquire(s) {
+						err = store(s)
+						api.conns.release(s)
+					}
+
+					mutex.Lock()
+					defer mutex.Unlock()
+
+					if err != nil {
+						if api.options.verbose {
+							fmt.Printf("\tUpload to %s failed: %s\n", s.Location, err.Error())
+						}
+						attempts = append(attempts, uploadAttempt{
+							Server: s.Location,
+							Group:  s.Group,
+							Error:  err.Error(),
+						})
+						return
+					}
+					g.stored = append(g.stored, s.Location)
+				}(s)
+			}
+			wg.Wait()
+
+			if len(g.stored) >= g.min {
+				return g.stored, attempts
+			}
+		}
+	}
+
+	return nil, attempts
 }
 
 //
@@ -260,7 +674,7 @@ func APIUploadHandler(res http.ResponseWriter, req *http.Request) {
 // lookups.  See `SCALING.md` for more details.
 //
 //
-func APIDownloadHandler(res http.ResponseWriter, req *http.Request) {
+func (api *apiServer) APIDownloadHandler(res http.ResponseWriter, req *http.Request) {
 
 	//
 	// The ID of the file we're to retrieve.
@@ -274,104 +688,102 @@ func APIDownloadHandler(res http.ResponseWriter, req *http.Request) {
 	extension := filepath.Ext(id)
 	id = id[0 : len(id)-len(extension)]
 
+	api.serveObject(res, req, id, true)
+}
+
+//
+// serveObject sends the object with the given ID to the caller.
+//
+// Objects never change, so their replies may be cached forever, but when
+// the object is found via a name, which may later refer to another object,
+// the caller is told to check it is still current before using a cached
+// copy.
+//
+func (api *apiServer) serveObject(res http.ResponseWriter, req *http.Request, id string, immutable bool) {
+
 	//
 	// We try each blob-server in turn, and if/when we receive
 	// a successfully result we'll return it to the caller.
 	//
-	for _, s := range libconfig.OrderedServers() {
+	// If the request-method was HEAD then the blob-servers are
+	// only asked to describe the object.
+	//
+	method := "GET"
+	if req.Method == "HEAD" {
+		method = "HEAD"
+	}
+
+	//
+	// Requests for part of the object, and conditional requests,
+	// are passed on.
+	//
+	header := make(http.Header)
+	for _, name := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+		if value := req.Header.Get(name); value != "" {
+			header.Set(name, value)
+		}
+	}
+
+	servers := indexedServers(api.index, id, api.downloadServers(id))
+	response, done := api.fetchObject(req.Context(), method, id, header, servers, api.options.hedgeDelay, api.options.backendTimeout)
+	if response != nil {
+		defer done()
+		defer response.Body.Close()
 
 		//
-		// Show which back-end we're going to use.
+		// Copy any X-Header which was present
+		// into the reply too.
 		//
-		if OPTIONS.verbose {
-			fmt.Printf("Attempting retrieval from %s%s%s\n", s.Location, "/blob/", id)
+		for header, value := range response.Header {
+			if strings.HasPrefix(header, "X-") {
+				res.Header().Set(header, value[0])
+			}
 		}
 
 		//
-		// Build up the request.
+		// Along with those which describe the content, or
+		// a partial reply which might hold several parts.
 		//
-		response, err := http.Get(fmt.Sprintf("%s%s%s", s.Location, "/blob/", id))
+		for _, header := range []string{"Accept-Ranges", "Content-Length", "Content-Range", "Content-Type", "Last-Modified"} {
+			if value := response.Header.Get(header); value != "" {
+				res.Header().Set(header, value)
+			}
+		}
+
 		//
-		// If there was no error we're good.
+		// Objects are named by the SHA1 of their content,
+		// so they never change, and may be cached forever.
 		//
-		if err != nil || response.StatusCode != 200 {
-
-			//
-			// If there was an error then we skip this server
-			//
-			if err != nil {
-				if OPTIONS.verbose {
-					fmt.Printf("\tError fetching: %s\n", err.Error())
-				}
+		res.Header().Set("ETag", "\""+id+"\"")
+		if response.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+			if immutable {
+				res.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
 			} else {
-
-				//
-				// If there was no error then the HTTP-connection
-				// to the back-end succeeded, but that didn't
-				// return a 200 OK.
-				//
-				// This might happen if a file was uploaded
-				// to only one host, but we've hit another.
-				//
-				// (i.e. Replication is pending.)
-				//
-				if OPTIONS.verbose {
-
-					fmt.Printf("\tStatus Code : %d\n", response.StatusCode)
-				}
+				res.Header().Set("Cache-Control", "no-cache")
 			}
+		}
 
-		} else {
+		//
+		// If the request-method was HEAD then we
+		// just need to report on the object.
+		//
+		if req.Method == "HEAD" {
+			res.Header().Set("Connection", "close")
+			res.WriteHeader(response.StatusCode)
+			return
+		}
 
-			//
-			// We read the reply we received from the
-			// blob-server and return it to the caller.
-			//
-			body, _ := ioutil.ReadAll(response.Body)
-
-			if body != nil {
-
-				//
-				// We found a non-empty result on a back-end
-				// server, so we're going to pipe the data
-				// back.
-				if OPTIONS.verbose {
-					fmt.Printf("\tFound, read %d bytes\n", len(body))
-				}
-
-				//
-				// If we found the file, and the body
-				// was non-empty then we'll return
-				// a HTTP-OK response.
-				//
-				// If the request-method was HEAD
-				// and the file isn't found then the 404-result
-				// at the foot of this function will ensure
-				// that a negative response is sent.
-				//
-				if req.Method == "HEAD" {
-					res.Header().Set("Connection", "close")
-					res.WriteHeader(http.StatusOK)
-					return
-				}
-
-				//
-				// Copy any X-Header which was present
-				// into the reply too.
-				//
-				for header, value := range response.Header {
-					if strings.HasPrefix(header, "X-") {
-						res.Header().Set(header, value[0])
-					}
-				}
+		//
+		// Now stream back the body, without holding
+		// the whole object in RAM.
+		//
+		res.WriteHeader(response.StatusCode)
+		n, _ := io.Copy(res, response.Body)
 
-				//
-				// Now send back the body.
-				//
-				io.Copy(res, bytes.NewReader(body))
-				return
-			}
+		if api.options.verbose {
+			fmt.Printf("\tFound, sent %d bytes\n", n)
 		}
+		return
 	}
 
 	//
@@ -384,6 +796,108 @@ func APIDownloadHandler(res http.ResponseWriter, req *http.Request) {
 	res.WriteHeader(http.StatusNotFound)
 }
 
+// APIDeleteHandler handles deletions via the API server.
+//
+// We don't know which blob-servers hold the object, so the deletion is
+// sent to every one of them.  Each records a tombstone, with the time
+// of the deletion, so that any server which is unavailable now will
+// have its copy removed by the next run of `sos replicate`, rather than
+// having it restored to its peers.
+//
+func (api *apiServer) APIDeleteHandler(res http.ResponseWriter, req *http.Request) {
+
+	//
+	// The ID of the file we're to delete.
+	//
+	vars := mux.Vars(req)
+	id := vars["id"]
+
+	//
+	// Strip any extension which might be present on the ID.
+	//
+	extension := filepath.Ext(id)
+	id = id[0 : len(id)-len(extension)]
+
+	//
+	// The time of the deletion is recorded by us, rather than by
+	// each blob-server, so that all the tombstones agree.
+	//
+	when := time.Now().UTC().Format(time.RFC3339Nano)
+
+	//
+	// Count how many servers held the object, and record those
+	// we failed to contact.
+	//
+	found := 0
+	failed := []string{}
+
+	servers := api.config.Servers()
+	for _, s := range servers {
+
+		if api.options.verbose {
+			fmt.Printf("Deleting %s%s%s\n", s.Location, "/blob/", id)
+		}
+
+		child, _ := http.NewRequest("DELETE", fmt.Sprintf("%s%s%s", s.Location, "/blob/", id), nil)
+		child.Header.Set("X-Deleted-At", when)
+
+		client := &http.Client{}
+		response, err := client.Do(child)
+		if err != nil {
+			if api.options.verbose {
+				fmt.Printf("\tError deleting: %s\n", err.Error())
+			}
+			failed = append(failed, s.Location)
+			continue
+		}
+
+		//
+		// Decode the result to see if the object was present.
+		//
+		var result struct {
+			Existed bool `json:"existed"`
+		}
+		err = json.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+
+		if err != nil || response.StatusCode != http.StatusOK {
+			if api.options.verbose {
+				fmt.Printf("\tStatus Code : %d\n", response.StatusCode)
+			}
+			failed = append(failed, s.Location)
+			continue
+		}
+		if result.Existed {
+			found++
+		}
+	}
+
+	//
+	// The object is gone, or will be once replication runs.
+	//
+	if api.index != nil {
+		api.index.Forget(id)
+	}
+
+	//
+	// Report the result.
+	//
+	status := http.StatusOK
+	if len(failed) == len(servers) {
+		status = http.StatusInternalServerError
+	} else if found == 0 && len(failed) == 0 {
+		status = http.StatusNotFound
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(map[string]interface{}{
+		"id":      id,
+		"deleted": found,
+		"failed":  failed,
+	})
+}
+
 // APIMissingHandler is a fall-back handler for all requests which are
 // neither upload nor download.
 func APIMissingHandler(res http.ResponseWriter, req *http.Request) {
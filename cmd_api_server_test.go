@@ -0,0 +1,216 @@
+//
+// Test the api-server's handling of uploads.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/skx/sos/libconfig"
+)
+
+//
+// Test that uploads are written to enough members of a single group.
+//
+func TestStoreReplicas(t *testing.T) {
+
+	api := newAPIServer(nil, apiServerCmd{})
+
+	a := newFakeBlobServer()
+	defer a.server.Close()
+	b := newFakeBlobServer()
+	defer b.server.Close()
+	c := newFakeBlobServer()
+	defer c.server.Close()
+	d := newFakeBlobServer()
+	defer d.server.Close()
+
+	//
+	// A server which is no longer running.
+	//
+	gone := newFakeBlobServer()
+	gone.server.Close()
+
+	body := strings.NewReader("content of obj")
+	size := int64(body.Len())
+
+	type TestCase struct {
+		servers  []libconfig.BlobServer
+		min      int
+		replicas int
+		holders  []*fakeBlobServer
+	}
+
+	tests := []TestCase{
+
+		// A single copy is stored on the first server.
+		{[]libconfig.BlobServer{
+			{Location: a.server.URL, Group: "one"},
+			{Location: b.server.URL, Group: "two"},
+		}, 1, 1, []*fakeBlobServer{a}},
+
+		// Two copies are stored within the same group.
+		{[]libconfig.BlobServer{
+			{Location: a.server.URL, Group: "one"},
+			{Location: c.server.URL, Group: "two"},
+			{Location: b.server.URL, Group: "one"},
+		}, 2, 2, []*fakeBlobServer{a, b}},
+
+		// Groups with too few members are skipped.
+		{[]libconfig.BlobServer{
+			{Location: a.server.URL, Group: "one"},
+			{Location: b.server.URL, Group: "two"},
+			{Location: c.server.URL, Group: "two"},
+		}, 2, 2, []*fakeBlobServer{b, c}},
+
+		// A failed member is replaced by another from its group.
+		{[]libconfig.BlobServer{
+			{Location: gone.server.URL, Group: "one"},
+			{Location: a.server.URL, Group: "one"},
+			{Location: b.server.URL, Group: "one"},
+		}, 2, 2, []*fakeBlobServer{a, b}},
+
+		// If a group can't satisfy us we move to the next.
+		{[]libconfig.BlobServer{
+			{Location: a.server.URL, Group: "one"},
+			{Location: gone.server.URL, Group: "one"},
+			{Location: c.server.URL, Group: "two"},
+			{Location: d.server.URL, Group: "two"},
+		}, 2, 2, []*fakeBlobServer{c, d}},
+
+		// And if nothing can we fail.
+		{[]libconfig.BlobServer{
+			{Location: a.server.URL, Group: "one"},
+			{Location: gone.server.URL, Group: "one"},
+		}, 2, 0, nil},
+	}
+
+	for i, test := range tests {
+
+		for _, f := range []*fakeBlobServer{a, b, c, d} {
+			f.Lock()
+			delete(f.objects, "obj")
+			f.Unlock()
+		}
+
+		min := test.min
+		stored, _ := api.storeReplicas(test.servers, "obj", body, size, nil, func(string) int { return min })
+		if len(stored) != test.replicas {
+			t.Errorf("test %d: expected %d replicas, got %v", i, test.replicas, stored)
+		}
+
+		for _, f := range test.holders {
+			if !f.has("obj") {
+				t.Errorf("test %d: %s is missing the upload", i, f.server.URL)
+			}
+		}
+	}
+
+	//
+	// Each group may require a different number of copies.
+	//
+	quorum := func(group string) int {
+		if group == "one" {
+			return 3
+		}
+		return 2
+	}
+	stored, _ := api.storeReplicas([]libconfig.BlobServer{
+		{Location: a.server.URL, Group: "one"},
+		{Location: b.server.URL, Group: "one"},
+		{Location: c.server.URL, Group: "two"},
+		{Location: d.server.URL, Group: "two"},
+	}, "obj", body, size, nil, quorum)
+	if len(stored) != 2 || stored[0] == a.server.URL || stored[1] == a.server.URL {
+		t.Errorf("Expected the upload to be stored in the second group, got %v", stored)
+	}
+}
+
+//
+// Test that failed uploads are detected, and reported.
+//
+func TestStoreReplicasFailures(t *testing.T) {
+
+	api := newAPIServer(nil, apiServerCmd{})
+
+	full := newFakeBlobServer()
+	full.full = true
+	defer full.server.Close()
+
+	ok := newFakeBlobServer()
+	defer ok.server.Close()
+
+	//
+	// A server which returns success, but not a valid reply.
+	//
+	bogus := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "<html>It worked</html>")
+	}))
+	defer bogus.Close()
+
+	//
+	// A server which stored something other than we sent.
+	//
+	short := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(res, "{\"id\":\"obj\",\"status\":\"OK\",\"size\":1}")
+	}))
+	defer short.Close()
+
+	servers := []libconfig.BlobServer{
+		{Location: full.server.URL, Group: "one"},
+		{Location: bogus.URL, Group: "two"},
+		{Location: short.URL, Group: "three"},
+		{Location: ok.server.URL, Group: "four"},
+	}
+
+	body := strings.NewReader("content of obj")
+	one := func(string) int { return 1 }
+	stored, attempts := api.storeReplicas(servers, "obj", body, int64(body.Len()), nil, one)
+
+	//
+	// We should have ended up on the only working server.
+	//
+	if len(stored) != 1 || stored[0] != ok.server.URL || !ok.has("obj") {
+		t.Fatalf("Upload didn't fail over to the working server")
+	}
+
+	//
+	// Having tried each of the others.
+	//
+	expected := []string{
+		"status 500: failed to write to storage",
+		"invalid response",
+		"stored obj with size 1, expected obj with size 14",
+	}
+	if len(attempts) != len(expected) {
+		t.Fatalf("Unexpected attempts %v", attempts)
+	}
+	for i, attempt := range attempts {
+		if attempt.Server != servers[i].Location || attempt.Group != servers[i].Group {
+			t.Errorf("Unexpected server in attempt %v", attempt)
+		}
+		if attempt.Error != expected[i] {
+			t.Errorf("Unexpected error '%s' - expected '%s'", attempt.Error, expected[i])
+		}
+	}
+
+	//
+	// Without the working server the upload fails, and we can
+	// report every attempt.
+	//
+	stored, attempts = api.storeReplicas(servers[:3], "obj", body, int64(body.Len()), nil, one)
+	if len(stored) != 0 || len(attempts) != 3 {
+		t.Errorf("Unexpected result %v %v", stored, attempts)
+	}
+
+	out, _ := json.Marshal(attempts[0])
+	if string(out) != `{"server":"`+full.server.URL+`","group":"one","error":"status 500: failed to write to storage"}` {
+		t.Errorf("Unexpected JSON %s", out)
+	}
+}
@@ -5,15 +5,18 @@
 package main
 
 import (
-	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -21,6 +24,63 @@ import (
 // STORAGE holds a handle to our selected storage-method.
 var STORAGE StorageHandler
 
+// BLOBOPTIONS holds options passed to this sub-command, so that our
+// handlers can test if `-verify` is in-force.
+var BLOBOPTIONS blobServerCmd
+
+//
+// errHashMismatch is returned when an upload doesn't match its ID.
+//
+var errHashMismatch = errors.New("SHA1 of body does not match ID")
+
+//
+// countingReader wraps a reader, and records the number of bytes which
+// have been read through it.
+//
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+//
+// Read implements the io.Reader interface.
+//
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count += int64(n)
+	return n, err
+}
+
+//
+// verifyingReader wraps a reader, and hashes the data which is read
+// through it.
+//
+// When the end of the data is reached the hash is compared with the
+// expected value, and an error is returned if they differ.  This
+// ensures a mismatched upload is aborted before it is committed to
+// storage.
+//
+type verifyingReader struct {
+	reader   io.Reader
+	hasher   hash.Hash
+	expected string
+	mismatch bool
+}
+
+//
+// Read implements the io.Reader interface.
+//
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.reader.Read(p)
+	v.hasher.Write(p[:n])
+
+	if err == io.EOF && hex.EncodeToString(v.hasher.Sum(nil)) != v.expected {
+		v.mismatch = true
+		return n, errHashMismatch
+	}
+	return n, err
+}
+
 // HealthHandler is a status end-point which can be polled remotely
 // to test health.
 func HealthHandler(res http.ResponseWriter, req *http.Request) {
@@ -29,7 +89,11 @@ func HealthHandler(res http.ResponseWriter, req *http.Request) {
 
 // GetHandler allows a blob to be retrieved by name.
 //
-// This is called with requests like `GET /blob/XXXXXX`.
+// This is called with requests like `GET /blob/XXXXXX`.  Requests may
+// include a `Range` header, optionally with `If-Range`, to retrieve only
+// part of the blob, and conditions such as `If-None-Match`.
+//
+// `HEAD /blob/XXXXXX` returns the same headers, without the blob.
 //
 func GetHandler(res http.ResponseWriter, req *http.Request) {
 	var (
@@ -62,25 +126,15 @@ func GetHandler(res http.ResponseWriter, req *http.Request) {
 	}
 
 	//
-	// If the request method was HEAD we don't need to
-	// lookup & return n the data, just see if it exists.
-	//
-	//  We'll terminate early and just return the status-code
-	// 200 vs. 404.
+	// If the request method was HEAD we only report on the
+	// data, but otherwise it is handled just like a GET.
 	//
 	if req.Method == "HEAD" {
 		res.Header().Set("Connection", "close")
-
-		if STORAGE.Exists(id) {
-		} else {
-			res.WriteHeader(http.StatusNotFound)
-		}
-		return
 	}
 
 	//
-	// If we reached this point then the request was a GET
-	// so we lookup the data, returning it if present.
+	// Lookup the data, returning it if present.
 	//
 	data, meta := STORAGE.Get(id)
 
@@ -90,6 +144,7 @@ func GetHandler(res http.ResponseWriter, req *http.Request) {
 	if data == nil {
 		http.NotFound(res, req)
 	} else {
+		defer data.Close()
 
 		//
 		// The meta-data will be used to populate the HTTP-response
@@ -113,7 +168,21 @@ func GetHandler(res http.ResponseWriter, req *http.Request) {
 				res.Header().Set(k, v)
 			}
 		}
-		io.Copy(res, bytes.NewReader(*data))
+
+		//
+		// The ID is the SHA1 of the content, so it makes an
+		// ideal entity-tag, which allows If-Range and
+		// If-None-Match to be used.
+		//
+		res.Header().Set("ETag", "\""+id+"\"")
+		modified, _ := STORAGE.Modified(id)
+
+		//
+		// Serve the content, honouring any Range header, and
+		// any conditions.  Only the requested parts are read
+		// from storage.
+		//
+		http.ServeContent(res, req, "", modified, data)
 	}
 }
 
@@ -127,11 +196,64 @@ func MissingHandler(res http.ResponseWriter, req *http.Request) {
 // ListHandler returns the IDs of all blobs we know about.
 //
 // This is used by the replication utility.
+//
+// The listing may be paginated, and filtered, via optional parameters:
+//
+//   GET /blobs?after=XXXX&limit=1000
+//   GET /blobs?since=2019-01-01T00:00:00Z
+//
+// `after` and `limit` return the IDs which sort after the given one,
+// so a client can walk all the IDs by passing the last ID it received
+// until it receives fewer than it asked for.
+//
+// `since` returns only the IDs which were stored after the given time,
+// which may be given either in RFC3339 format, or as seconds past the
+// epoch.
 func ListHandler(res http.ResponseWriter, req *http.Request) {
+	var (
+		status int
+		err    error
+	)
+	defer func() {
+		if nil != err {
+			http.Error(res, err.Error(), status)
+		}
+	}()
 
 	var list []string
 
-	list = STORAGE.Existing()
+	//
+	// Parse any parameters we received.
+	//
+	after := req.FormValue("after")
+
+	limit := 0
+	if req.FormValue("limit") != "" {
+		limit, err = strconv.Atoi(req.FormValue("limit"))
+		if err != nil || limit < 0 {
+			err = errors.New("invalid limit")
+			status = http.StatusBadRequest
+			return
+		}
+	}
+
+	var since time.Time
+	if req.FormValue("since") != "" {
+		since, err = parseSince(req.FormValue("since"))
+		if err != nil {
+			status = http.StatusBadRequest
+			return
+		}
+	}
+
+	//
+	// If we weren't asked for anything special return everything.
+	//
+	if after == "" && limit == 0 && since.IsZero() {
+		list = STORAGE.Existing()
+	} else {
+		list = STORAGE.List(after, limit, since)
+	}
 
 	//
 	// If the list is non-empty then build up an array
@@ -145,6 +267,23 @@ func ListHandler(res http.ResponseWriter, req *http.Request) {
 	}
 }
 
+//
+// parseSince parses the time given to our listing, which may either be
+// in RFC3339 format, or a number of seconds past the epoch.
+//
+func parseSince(since string) (time.Time, error) {
+	secs, err := strconv.ParseInt(since, 10, 64)
+	if err == nil {
+		return time.Unix(secs, 0), nil
+	}
+
+	when, err := time.Parse(time.RFC3339Nano, since)
+	if err != nil {
+		return when, errors.New("invalid since")
+	}
+	return when, nil
+}
+
 // UploadHandler is invoked to handle storing data in the blob-server.
 func UploadHandler(res http.ResponseWriter, req *http.Request) {
 	var (
@@ -180,13 +319,20 @@ func UploadHandler(res http.ResponseWriter, req *http.Request) {
 	}
 
 	//
-	// Read the body of the request.
+	// We don't read the body of the request into RAM, instead
+	// it is streamed to the storage-layer.  We count the bytes
+	// as they go past so that we can report the size.
 	//
-	content, err := ioutil.ReadAll(req.Body)
-	if err != nil {
-		err = errors.New("failed to read body")
-		status = http.StatusInternalServerError
-		return
+	content := &countingReader{reader: req.Body}
+
+	//
+	// If we're verifying uploads then we also hash the body as
+	// we go, to ensure it matches the ID it is being stored under.
+	//
+	var body io.Reader = content
+	verifier := &verifyingReader{reader: content, hasher: sha1.New(), expected: id}
+	if BLOBOPTIONS.verify {
+		body = verifier
 	}
 
 	//
@@ -205,7 +351,24 @@ func UploadHandler(res http.ResponseWriter, req *http.Request) {
 	//
 	// Store the body, via our interface.
 	//
-	result := STORAGE.Store(id, content, extras)
+	result := STORAGE.Store(id, body, extras)
+	if result == false && verifier.mismatch {
+
+		//
+		// The body didn't match the ID, so we let the caller
+		// know exactly what we received.
+		//
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(res).Encode(map[string]interface{}{
+			"id":     id,
+			"sha1":   hex.EncodeToString(verifier.hasher.Sum(nil)),
+			"size":   content.count,
+			"status": "ERROR",
+			"error":  errHashMismatch.Error(),
+		})
+		return
+	}
 	if result == false {
 		err = errors.New("failed to write to storage")
 		status = http.StatusInternalServerError
@@ -220,11 +383,140 @@ func UploadHandler(res http.ResponseWriter, req *http.Request) {
 	//   "status": "ok",
 	//  }
 	//
-	out := fmt.Sprintf("{\"id\":\"%s\",\"status\":\"OK\",\"size\":%d}", id, len(content))
+	out := fmt.Sprintf("{\"id\":\"%s\",\"status\":\"OK\",\"size\":%d}", id, content.count)
 	fmt.Fprintf(res, string(out))
 
 }
 
+// DeleteHandler is invoked to delete data from the blob-server.
+//
+// This is called with requests like `DELETE /blob/XXXXXX`.
+//
+// The time of the deletion may be specified via the `X-Deleted-At`
+// header, which the replicator uses when propagating deletions between
+// servers.  If it is absent the current time is used.
+//
+func DeleteHandler(res http.ResponseWriter, req *http.Request) {
+	var (
+		status int
+		err    error
+	)
+	defer func() {
+		if nil != err {
+			http.Error(res, err.Error(), status)
+		}
+	}()
+
+	//
+	// Get the ID which is to be deleted.
+	//
+	vars := mux.Vars(req)
+	id := vars["id"]
+
+	//
+	// Ensure the ID is entirely alphanumeric, to prevent
+	// traversal attacks.
+	//
+	r, _ := regexp.Compile("^([a-z0-9]+)$")
+	if !r.MatchString(id) {
+		err = errors.New("alphanumeric IDs only")
+		status = http.StatusInternalServerError
+		return
+	}
+
+	//
+	// When did the deletion happen?
+	//
+	when := time.Now()
+	if req.Header.Get("X-Deleted-At") != "" {
+		when, err = time.Parse(time.RFC3339Nano, req.Header.Get("X-Deleted-At"))
+		if err != nil {
+			err = errors.New("invalid X-Deleted-At header")
+			status = http.StatusBadRequest
+			return
+		}
+	}
+
+	//
+	// Did the object exist prior to the deletion?
+	//
+	existed := STORAGE.Exists(id)
+
+	//
+	// Delete it.
+	//
+	if !STORAGE.Delete(id, when) {
+
+		//
+		// If the object still exists then it was uploaded
+		// after the deletion took place, so it stays.
+		//
+		if STORAGE.Exists(id) {
+			err = errors.New("object is newer than the deletion")
+			status = http.StatusConflict
+			return
+		}
+
+		err = errors.New("failed to delete from storage")
+		status = http.StatusInternalServerError
+		return
+	}
+
+	//
+	// Output the result.
+	//
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(map[string]interface{}{
+		"id":      id,
+		"status":  "OK",
+		"existed": existed,
+	})
+}
+
+// TombstonesHandler returns the IDs of the blobs which have been deleted,
+// along with the time of their deletion.
+//
+// The listing may be paginated, exactly as for `/blobs`.
+//
+// This is used by the replication utility.
+func TombstonesHandler(res http.ResponseWriter, req *http.Request) {
+	limit := 0
+	if req.FormValue("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(req.FormValue("limit"))
+		if err != nil || limit < 0 {
+			http.Error(res, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	//
+	// The tombstones are reported as an object, mapping each ID
+	// to the time of its deletion.
+	//
+	list := make(map[string]time.Time)
+	for _, t := range STORAGE.Tombstones(req.FormValue("after"), limit) {
+		list[t.ID] = t.Deleted
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(list)
+}
+
+// StatsHandler reports the number of objects we hold, and the space we
+// have available.
+//
+// This is used by the API-server to decide where uploads should go.
+func StatsHandler(res http.ResponseWriter, req *http.Request) {
+	stats, err := STORAGE.Stats()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(stats)
+}
+
 // blobServer is our entry-point to the sub-command.
 func blobServer(options blobServerCmd) {
 
@@ -235,20 +527,34 @@ func blobServer(options blobServerCmd) {
 	// class.  In the future it is possible we'd have more, and we'd
 	// choose between them via a command-line flag.
 	//
-	STORAGE = new(FilesystemStorage)
-	STORAGE.Setup(options.store)
+	storage := new(FilesystemStorage)
+	storage.Setup(options.store)
+	STORAGE = storage
+
+	BLOBOPTIONS = options
 
 	//
-	// Create a new router and our route-mappings.
+	// Expired tombstones, along with abandoned uploads, are removed
+	// periodically.
 	//
-	router := mux.NewRouter()
-	router.HandleFunc("/alive", HealthHandler).Methods("GET")
-	router.HandleFunc("/blob/{id}", GetHandler).Methods("GET")
-	router.HandleFunc("/blob/{id}", GetHandler).Methods("HEAD")
-	router.HandleFunc("/blob/{id}", UploadHandler).Methods("POST")
-	router.HandleFunc("/blobs", ListHandler).Methods("GET")
-	router.PathPrefix("/").HandlerFunc(MissingHandler)
-	http.Handle("/", router)
+	go storage.cleanupLoop(cleanupInterval)
+
+	//
+	// If we've been asked to scrub our storage in the background
+	// then launch that now.
+	//
+	if options.scrubInterval > 0 {
+		rate, err := parseRate(options.scrubRate)
+		if err != nil {
+			panic(err)
+		}
+		go scrubLoop(STORAGE, options.scrubInterval, newRateLimiter(rate))
+	}
+
+	//
+	// Create our route-mappings.
+	//
+	http.Handle("/", blobRouter())
 
 	//
 	// Launch the server
@@ -261,3 +567,30 @@ func blobServer(options blobServerCmd) {
 	}
 
 }
+
+//
+// blobRouter returns the routes served by a blob-server.
+//
+func blobRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/alive", HealthHandler).Methods("GET")
+	router.HandleFunc("/blob/{id}", GetHandler).Methods("GET")
+	router.HandleFunc("/blob/{id}", GetHandler).Methods("HEAD")
+	router.HandleFunc("/blob/{id}", UploadHandler).Methods("POST")
+	router.HandleFunc("/blob/{id}", DeleteHandler).Methods("DELETE")
+	router.HandleFunc("/blobs", ListHandler).Methods("GET")
+	router.HandleFunc("/tombstones", TombstonesHandler).Methods("GET")
+	router.HandleFunc("/stats", StatsHandler).Methods("GET")
+	router.HandleFunc("/meta", MetaListHandler).Methods("GET")
+	router.HandleFunc("/meta/{key}", MetaGetHandler).Methods("GET")
+	router.HandleFunc("/meta/{key}", MetaPutHandler).Methods("PUT")
+	router.HandleFunc("/multipart/{upload}", MultipartCreateHandler).Methods("POST")
+	router.HandleFunc("/multipart/{upload}", MultipartListHandler).Methods("GET")
+	router.HandleFunc("/multipart/{upload}", MultipartAbortHandler).Methods("DELETE")
+	router.HandleFunc("/multipart/{upload}/complete", MultipartCompleteHandler).Methods("POST")
+	router.HandleFunc("/multipart/{upload}/commit", MultipartCommitHandler).Methods("POST")
+	router.HandleFunc("/multipart/{upload}/object", MultipartObjectHandler).Methods("GET")
+	router.HandleFunc("/multipart/{upload}/{part}", MultipartPartHandler).Methods("PUT")
+	router.PathPrefix("/").HandlerFunc(MissingHandler)
+	return router
+}
@@ -6,14 +6,16 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
-	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -140,11 +142,8 @@ func TestHeadAccess(t *testing.T) {
 	//
 	// Now create the file `foo`.
 	//
-	path := filepath.Join(p, "foo")
-	content := []byte("Content")
-	err = ioutil.WriteFile(path, content, 0644)
-	if err != nil {
-		fmt.Printf("Error writing content beneath our temporary directory %s", err.Error())
+	if !STORAGE.Store("foo", strings.NewReader("Content"), nil) {
+		t.Errorf("Error writing content beneath our temporary directory")
 	}
 
 	//
@@ -279,9 +278,7 @@ func TestBlobList(t *testing.T) {
 	// Now create a single file, so we can test that the listing
 	// returns valid contents.
 	//
-	path := filepath.Join(p, "steve")
-	content := []byte("Content")
-	ioutil.WriteFile(path, content, 0644)
+	STORAGE.Store("steve", strings.NewReader("Content"), nil)
 
 	//
 	// At this point we should get a single result.
@@ -312,6 +309,79 @@ func TestBlobList(t *testing.T) {
 	os.RemoveAll(p)
 }
 
+//
+// Test the paginated blob-list.
+//
+func TestBlobListPages(t *testing.T) {
+
+	//
+	// Create a temporary directory.
+	//
+	p, err := ioutil.TempDir("tmp", "prefix")
+	if err != nil {
+		t.Errorf("Failed to create temporary directory %s", err.Error())
+	}
+
+	//
+	// Init the filesystem storage-class - defined in `cmd_blob_server.go`
+	//
+	STORAGE = new(FilesystemStorage)
+	STORAGE.Setup(p)
+
+	for _, id := range []string{"one", "two", "three", "four"} {
+		STORAGE.Store(id, strings.NewReader(id), nil)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/blobs", ListHandler).Methods("GET")
+
+	//
+	// Test cases: the request, the expected status-code, and body.
+	//
+	type TestCase struct {
+		path   string
+		status int
+		body   string
+	}
+
+	future := fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix())
+
+	tests := []TestCase{
+		{"/blobs", http.StatusOK, `["four","one","three","two"]`},
+		{"/blobs?limit=2", http.StatusOK, `["four","one"]`},
+		{"/blobs?after=one&limit=2", http.StatusOK, `["three","two"]`},
+		{"/blobs?after=two&limit=2", http.StatusOK, `[]`},
+		{"/blobs?since=2001-01-01T00:00:00Z", http.StatusOK, `["four","one","three","two"]`},
+		{"/blobs?since=" + future, http.StatusOK, `[]`},
+		{"/blobs?limit=steve", http.StatusBadRequest, "invalid limit\n"},
+		{"/blobs?since=yesterday", http.StatusBadRequest, "invalid since\n"},
+	}
+
+	for _, test := range tests {
+
+		req, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("Unexpected status-code for %s: %v", test.path, status)
+		}
+		if rr.Body.String() != test.body {
+			t.Errorf("Unexpected body for %s: got '%v' want '%v'",
+				test.path, rr.Body.String(), test.body)
+		}
+	}
+
+	//
+	// Cleanup the storage-point
+	//
+	os.RemoveAll(p)
+}
+
 //
 // Test uploading a file.
 //
@@ -463,6 +533,104 @@ func TestBlobUploadBogusID(t *testing.T) {
 	os.RemoveAll(p)
 }
 
+//
+// Test that uploads are verified against their ID, when that is enabled.
+//
+func TestBlobUploadVerify(t *testing.T) {
+
+	//
+	// Create a temporary directory.
+	//
+	p, err := ioutil.TempDir("tmp", "prefix")
+	if err != nil {
+		t.Errorf("Failed to create temporary directory %s", err.Error())
+	}
+
+	//
+	// Init the filesystem storage-class - defined in `cmd_blob_server.go`
+	//
+	STORAGE = new(FilesystemStorage)
+	STORAGE.Setup(p)
+
+	//
+	// Enable verification.
+	//
+	BLOBOPTIONS.verify = true
+	defer func() { BLOBOPTIONS.verify = false }()
+
+	//
+	// Prepare the handler
+	//
+	router := mux.NewRouter()
+	router.HandleFunc("/blob/{id}", UploadHandler).Methods("POST")
+
+	// Get the test-server
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	//
+	// The content we're going to upload, and its SHA1 hash.
+	//
+	content := []byte("Content goes here, honest")
+	good := fmt.Sprintf("%x", sha1.Sum(content))
+
+	//
+	// Test cases: the ID, the expected status, and whether the
+	// content should be present afterwards.
+	//
+	type TestCase struct {
+		id     string
+		status int
+		exists bool
+	}
+
+	tests := []TestCase{
+		{"123456", http.StatusUnprocessableEntity, false},
+		{"8b55aac644e9e6f2701805584cc391ff81d3ecec", http.StatusUnprocessableEntity, false},
+		{good, http.StatusOK, true},
+	}
+
+	for _, test := range tests {
+
+		url := ts.URL + "/blob/" + test.id
+
+		resp, err := http.Post(url, url, bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Errorf("Unexpected status-code for %s: %v", test.id, resp.StatusCode)
+		}
+
+		//
+		// A failure should be described via JSON.
+		//
+		if test.status != http.StatusOK {
+			var result map[string]interface{}
+			err = json.Unmarshal(body, &result)
+			if err != nil {
+				t.Errorf("Failed to decode error: %s", err.Error())
+			}
+			if result["sha1"] != good {
+				t.Errorf("Unexpected body: '%s'", body)
+			}
+		}
+
+		if STORAGE.Exists(test.id) != test.exists {
+			t.Errorf("Exists('%s') returned the wrong result", test.id)
+		}
+	}
+
+	//
+	// Cleanup the storage-point
+	//
+	os.RemoveAll(p)
+}
+
 //
 // Test a round-trip of upload & download.
 //
@@ -609,6 +777,240 @@ func TestBlobRoundTrip(t *testing.T) {
 
 }
 
+//
+// Test deleting a blob.
+//
+func TestBlobDelete(t *testing.T) {
+
+	//
+	// Create a temporary directory.
+	//
+	p, err := ioutil.TempDir("tmp", "prefix")
+	if err != nil {
+		t.Errorf("Failed to create temporary directory %s", err.Error())
+	}
+
+	//
+	// Init the filesystem storage-class - defined in `cmd_blob_server.go`
+	//
+	STORAGE = new(FilesystemStorage)
+	STORAGE.Setup(p)
+	STORAGE.Store("steve", strings.NewReader("Content"), nil)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/blob/{id}", DeleteHandler).Methods("DELETE")
+	router.HandleFunc("/tombstones", TombstonesHandler).Methods("GET")
+
+	//
+	// Test cases: the path, the deletion-time, and the expected
+	// status-code.
+	//
+	type TestCase struct {
+		path   string
+		when   string
+		status int
+	}
+
+	tests := []TestCase{
+		{"/blob/a-b-c", "", http.StatusInternalServerError},
+		{"/blob/steve", "yesterday", http.StatusBadRequest},
+		{"/blob/steve", "2001-01-01T00:00:00Z", http.StatusConflict},
+		{"/blob/steve", "", http.StatusOK},
+		{"/blob/steve", "", http.StatusOK},
+	}
+
+	for _, test := range tests {
+
+		req, err := http.NewRequest("DELETE", test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.when != "" {
+			req.Header.Set("X-Deleted-At", test.when)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != test.status {
+			t.Errorf("Unexpected status-code for %s: %v", test.path, status)
+		}
+	}
+
+	if STORAGE.Exists("steve") {
+		t.Errorf("Object was not deleted")
+	}
+
+	//
+	// The deletion should be visible in the list of tombstones.
+	//
+	req, err := http.NewRequest("GET", "/tombstones", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var tombstones map[string]time.Time
+	err = json.Unmarshal(rr.Body.Bytes(), &tombstones)
+	if err != nil {
+		t.Errorf("Failed to decode tombstones: %s", err.Error())
+	}
+	if _, ok := tombstones["steve"]; !ok || len(tombstones) != 1 {
+		t.Errorf("Unexpected tombstones: %v", tombstones)
+	}
+
+	//
+	// Cleanup the storage-point
+	//
+	os.RemoveAll(p)
+}
+
+//
+// Test that our statistics are available.
+//
+func TestBlobStats(t *testing.T) {
+
+	//
+	// Create a temporary directory.
+	//
+	p, err := ioutil.TempDir("tmp", "prefix")
+	if err != nil {
+		t.Errorf("Failed to create temporary directory %s", err.Error())
+	}
+
+	//
+	// Init the filesystem storage-class - defined in `cmd_blob_server.go`
+	//
+	STORAGE = new(FilesystemStorage)
+	STORAGE.Setup(p)
+	STORAGE.Store("steve", strings.NewReader("Content"), nil)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/stats", StatsHandler).Methods("GET")
+
+	req, err := http.NewRequest("GET", "/stats", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Unexpected status-code: %v", status)
+	}
+
+	var stats StorageStats
+	err = json.Unmarshal(rr.Body.Bytes(), &stats)
+	if err != nil {
+		t.Errorf("Failed to decode stats: %s", err.Error())
+	}
+	if stats.Objects != 1 || stats.TotalBytes == 0 {
+		t.Errorf("Unexpected stats: %s", rr.Body.String())
+	}
+
+	//
+	// Cleanup the storage-point
+	//
+	os.RemoveAll(p)
+}
+
+//
+// Test retrieving part of a blob.
+//
+func TestBlobRange(t *testing.T) {
+
+	//
+	// Create a temporary directory.
+	//
+	p, err := ioutil.TempDir("tmp", "prefix")
+	if err != nil {
+		t.Errorf("Failed to create temporary directory %s", err.Error())
+	}
+	defer os.RemoveAll(p)
+
+	STORAGE = new(FilesystemStorage)
+	STORAGE.Setup(p)
+	STORAGE.Store("steve", strings.NewReader("Content goes here"), map[string]string{"X-Mime-Type": "text/plain"})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/blob/{id}", GetHandler).Methods("GET")
+
+	type TestCase struct {
+		rng     string
+		ifRange string
+		status  int
+		body    string
+	}
+
+	tests := []TestCase{
+		{"", "", http.StatusOK, "Content goes here"},
+		{"bytes=0-6", "", http.StatusPartialContent, "Content"},
+		{"bytes=-4", "", http.StatusPartialContent, "here"},
+		{"bytes=8-", "", http.StatusPartialContent, "goes here"},
+		{"bytes=0-6", "\"steve\"", http.StatusPartialContent, "Content"},
+		{"bytes=0-6", "\"other\"", http.StatusOK, "Content goes here"},
+		{"bytes=100-", "", http.StatusRequestedRangeNotSatisfiable, ""},
+	}
+
+	for i, test := range tests {
+		req, _ := http.NewRequest("GET", "/blob/steve", nil)
+		if test.rng != "" {
+			req.Header.Set("Range", test.rng)
+		}
+		if test.ifRange != "" {
+			req.Header.Set("If-Range", test.ifRange)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != test.status {
+			t.Errorf("test %d: unexpected status-code %d", i, rr.Code)
+		}
+		if test.body != "" && rr.Body.String() != test.body {
+			t.Errorf("test %d: unexpected body '%s'", i, rr.Body.String())
+		}
+	}
+
+	//
+	// Several ranges may be requested at once.
+	//
+	req, _ := http.NewRequest("GET", "/blob/steve", nil)
+	req.Header.Set("Range", "bytes=0-6,13-16")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusPartialContent || !strings.HasPrefix(rr.Header().Get("Content-Type"), "multipart/byteranges") {
+		t.Fatalf("Unexpected reply %d %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, "Content-Range: bytes 0-6/17") || !strings.Contains(body, "Content-Range: bytes 13-16/17") || !strings.Contains(body, "text/plain") {
+		t.Errorf("Unexpected body %s", body)
+	}
+	//
+	// HEAD requests describe the blob, and conditions are honoured.
+	//
+	router.HandleFunc("/blob/{id}", GetHandler).Methods("HEAD")
+
+	req, _ = http.NewRequest("HEAD", "/blob/steve", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.Len() != 0 || rr.Header().Get("Content-Length") != "17" || rr.Header().Get("Last-Modified") == "" {
+		t.Errorf("Unexpected HEAD reply %d %v", rr.Code, rr.Header())
+	}
+
+	req, _ = http.NewRequest("GET", "/blob/steve", nil)
+	req.Header.Set("If-None-Match", rr.Header().Get("ETag"))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+		t.Errorf("Unexpected conditional reply %d", rr.Code)
+	}
+}
+
 //
 // Test our 404-handler (!)
 //
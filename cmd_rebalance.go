@@ -0,0 +1,210 @@
+//
+// Move objects to the group they belong within.
+//
+// When the API-server places objects by hash each object has a single
+// group it belongs within, which is where downloads look first.  Adding
+// a group changes where some objects belong, so this command finds those
+// objects, copies them to every member of the group they now belong in,
+// and then removes them from the group which held them.
+//
+// Groups which aren't writable receive no objects, and are left alone,
+// and read-only servers receive no objects either.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/skx/sos/libconfig"
+)
+
+// rebalanceStats records the outcome of a rebalance.
+type rebalanceStats struct {
+	Misplaced int
+	Moved     int
+	Failures  int
+}
+
+//
+// rebalanceObjects moves every object held by the servers of the given
+// configuration into the group it belongs within.
+//
+// An object is only removed from its old group once every member of its
+// new group holds it.  Groups which have a member we cannot list are left
+// alone, since we can't be sure of moving objects into or out of them.
+//
+func rebalanceObjects(config *libconfig.Config, options rebalanceCmd, limiter *rateLimiter) rebalanceStats {
+	var stats rebalanceStats
+
+	//
+	// Transfers report their progress using our replication
+	// helpers.
+	//
+	ropts := replicateCmd{verbose: options.verbose}
+	ctx := context.Background()
+
+	//
+	// Find the groups, and the objects each server holds.
+	//
+	// Objects only belong within groups which are writable.
+	//
+	servers := config.Servers()
+	var groups []string
+	members := make(map[string][]libconfig.BlobServer)
+	for _, s := range servers {
+		if _, ok := members[s.Group]; !ok && config.GroupSettings(s.Group).Writable {
+			groups = append(groups, s.Group)
+		}
+		members[s.Group] = append(members[s.Group], s)
+	}
+
+	holds := make(map[string]map[string]bool)
+	broken := make(map[string]bool)
+	for _, s := range servers {
+		objects, err := Objects(ctx, s.Location)
+		if err != nil {
+			fmt.Printf("Failed to list objects on %s: %s\n", s.Location, err.Error())
+			broken[s.Group] = true
+			continue
+		}
+
+		holds[s.Location] = make(map[string]bool)
+		for _, obj := range objects {
+			holds[s.Location][obj] = true
+		}
+	}
+
+	for _, group := range groups {
+		if broken[group] {
+			fmt.Printf("Skipping group %s - not every member could be listed\n", group)
+			continue
+		}
+
+		//
+		// Find the objects held by any member of this group, and
+		// where we can fetch each of them from.
+		//
+		var objects []string
+		source := make(map[string]string)
+		for _, s := range members[group] {
+			for obj := range holds[s.Location] {
+				if _, ok := source[obj]; !ok {
+					objects = append(objects, obj)
+					source[obj] = s.Location
+				}
+			}
+		}
+		sort.Strings(objects)
+
+		for _, obj := range objects {
+
+			//
+			// Is this object where it belongs?
+			//
+			home := libconfig.RankGroups(groups, obj)[0]
+			if home == group {
+				continue
+			}
+			stats.Misplaced++
+
+			if options.dryRun {
+				fmt.Printf("Would move %s from group %s to group %s\n", obj, group, home)
+				continue
+			}
+			if broken[home] {
+				stats.Failures++
+				continue
+			}
+
+			if options.verbose {
+				fmt.Printf("Moving %s from group %s to group %s\n", obj, group, home)
+			}
+
+			//
+			// Copy the object to every member of its new
+			// group which lacks it, other than those which
+			// are read-only.
+			//
+			copied := true
+			held := 0
+			for _, dst := range members[home] {
+				if holds[dst.Location][obj] {
+					held++
+					continue
+				}
+				if dst.ReadOnly {
+					continue
+				}
+				if !MirrorObject(ctx, source[obj], dst.Location, obj, limiter, ropts) {
+					copied = false
+					continue
+				}
+				holds[dst.Location][obj] = true
+				held++
+			}
+			if !copied || held == 0 {
+				stats.Failures++
+				continue
+			}
+
+			//
+			// Now remove it from the old group.
+			//
+			// Every member is told about the deletion, so
+			// that the tombstone prevents replication from
+			// restoring the object to the group.
+			//
+			removed := true
+			when := time.Now()
+			for _, s := range members[group] {
+				if DeleteObject(ctx, s.Location, obj, when, ropts) != nil {
+					removed = false
+				}
+			}
+			if !removed {
+				stats.Failures++
+				continue
+			}
+			stats.Moved++
+		}
+	}
+
+	return stats
+}
+
+//
+// This is the entry-point to this sub-command.
+//
+func rebalance(options rebalanceCmd) error {
+
+	//
+	// Load our blob-servers, from the command-line or our
+	// config file(s).
+	//
+	config, err := loadConfig(options.blob)
+	if err != nil {
+		return err
+	}
+
+	rate, err := parseRate(options.bwlimit)
+	if err != nil {
+		return err
+	}
+
+	stats := rebalanceObjects(config, options, newRateLimiter(rate))
+
+	if options.dryRun {
+		fmt.Printf("%d objects would be moved\n", stats.Misplaced)
+		return nil
+	}
+
+	fmt.Printf("Moved %d of %d misplaced objects\n", stats.Moved, stats.Misplaced)
+	if stats.Failures > 0 {
+		return fmt.Errorf("failed to move %d objects", stats.Failures)
+	}
+	return nil
+}
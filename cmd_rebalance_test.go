@@ -0,0 +1,133 @@
+//
+// Test moving objects between groups.
+//
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/skx/sos/libconfig"
+)
+
+//
+// Test that misplaced objects are moved to the group they belong within.
+//
+func TestRebalance(t *testing.T) {
+
+	var objects []string
+	for i := 0; i < 20; i++ {
+		objects = append(objects, fmt.Sprintf("obj%d", i))
+	}
+
+	//
+	// Everything starts upon the first group, before the
+	// second was added.
+	//
+	a := newFakeBlobServer(objects...)
+	defer a.server.Close()
+	b := newFakeBlobServer(objects...)
+	defer b.server.Close()
+	c := newFakeBlobServer()
+	defer c.server.Close()
+
+	config := libconfig.New()
+	config.AddServer("one", a.server.URL)
+	config.AddServer("one", b.server.URL)
+	config.AddServer("two", c.server.URL)
+
+	//
+	// Find the objects which now belong elsewhere.
+	//
+	moving := make(map[string]bool)
+	for _, obj := range objects {
+		if libconfig.RankGroups([]string{"one", "two"}, obj)[0] == "two" {
+			moving[obj] = true
+		}
+	}
+	if len(moving) == 0 || len(moving) == len(objects) {
+		t.Fatalf("Expected some, but not all, objects to move")
+	}
+
+	//
+	// A dry-run changes nothing.
+	//
+	stats := rebalanceObjects(config, rebalanceCmd{dryRun: true}, nil)
+	if stats.Misplaced != len(moving) || stats.Moved != 0 || len(c.objects) != 0 {
+		t.Errorf("Unexpected dry-run %+v", stats)
+	}
+
+	//
+	// Now move them.
+	//
+	stats = rebalanceObjects(config, rebalanceCmd{}, nil)
+	if stats.Misplaced != len(moving) || stats.Moved != len(moving) || stats.Failures != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	for _, obj := range objects {
+		if c.has(obj) != moving[obj] {
+			t.Errorf("%s is in the wrong place on the new group", obj)
+		}
+		for _, f := range []*fakeBlobServer{a, b} {
+			if f.has(obj) == moving[obj] {
+				t.Errorf("%s is in the wrong place on %s", obj, f.server.URL)
+			}
+		}
+	}
+
+	//
+	// Everything is now where it belongs.
+	//
+	stats = rebalanceObjects(config, rebalanceCmd{}, nil)
+	if stats.Misplaced != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+//
+// Test that objects aren't moved into read-only servers, or groups.
+//
+func TestRebalanceReadOnly(t *testing.T) {
+
+	var objects []string
+	for i := 0; i < 20; i++ {
+		objects = append(objects, fmt.Sprintf("obj%d", i))
+	}
+
+	a := newFakeBlobServer(objects...)
+	defer a.server.Close()
+	c := newFakeBlobServer()
+	defer c.server.Close()
+
+	//
+	// If the group isn't writable nothing belongs there.
+	//
+	config, err := libconfig.NewFromString(fmt.Sprintf("[one]\n-: %s\n[two]\nwritable = false\n-: %s\n", a.server.URL, c.server.URL))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration %s", err.Error())
+	}
+	stats := rebalanceObjects(config, rebalanceCmd{}, nil)
+	if stats.Misplaced != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	//
+	// If its only member is read-only the objects can't be moved,
+	// so they must be left where they are.
+	//
+	config, err = libconfig.NewFromString(fmt.Sprintf("[one]\n-: %s\n[two]\n-: %s readonly\n", a.server.URL, c.server.URL))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration %s", err.Error())
+	}
+	stats = rebalanceObjects(config, rebalanceCmd{}, nil)
+	if stats.Misplaced == 0 || stats.Failures != stats.Misplaced || stats.Moved != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	for _, obj := range objects {
+		if !a.has(obj) || c.has(obj) {
+			t.Errorf("%s was moved", obj)
+		}
+	}
+}
@@ -5,27 +5,113 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/skx/sos/libconfig"
 )
 
-// Objects reads the list of objects on the given server
-func Objects(server string) []string {
+// listPageSize is the number of IDs we request from a blob-server at
+// a time, when fetching the list of objects it holds.
+var listPageSize = 1000
+
+// replicationClient is used for our requests to blob-servers.
+//
+// Objects may take a long time to transfer, so the timeout applies only
+// to a blob-server starting its reply.  Once it has, a transfer is only
+// abandoned if the context it was made with is cancelled.
+var replicationClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+		ResponseHeaderTimeout: 30 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   8,
+	},
+}
+
+// Objects reads the list of objects on the given server.
+//
+// The list is fetched a page at a time, to avoid a single huge response.
+func Objects(ctx context.Context, server string) ([]string, error) {
+	return ObjectsSince(ctx, server, time.Time{})
+}
+
+// ObjectsSince reads the list of objects on the given server which were
+// stored after the given time.
+//
+// Blob-servers which predate this support return all their objects.
+func ObjectsSince(ctx context.Context, server string, since time.Time) ([]string, error) {
+	var all []string
+
+	after := ""
+	for {
+		page, err := objectsPage(ctx, server, after, listPageSize, since)
+		if err != nil {
+			return nil, err
+		}
+
+		//
+		// Blob-servers which predate pagination return every
+		// object, regardless of what we asked for.  If we
+		// notice that we just use what we received.
+		//
+		if len(page) > listPageSize || (after != "" && len(page) > 0 && page[0] <= after) {
+			if after == "" {
+				return page, nil
+			}
+			return all, nil
+		}
+
+		all = append(all, page...)
+
+		//
+		// A short page means we've reached the end.
+		//
+		if len(page) < listPageSize {
+			return all, nil
+		}
+		after = page[len(page)-1]
+	}
+}
+
+//
+// objectsPage reads a single page of the objects on the given server.
+//
+func objectsPage(ctx context.Context, server string, after string, limit int, since time.Time) ([]string, error) {
 	type listStrings []string
 	var tmp listStrings
 
 	//
 	// Make the request to get the list of objects.
 	//
-	response, err := http.Get(server + "/blobs")
+	query := fmt.Sprintf("%s/blobs?after=%s&limit=%d",
+		server, url.QueryEscape(after), limit)
+	if !since.IsZero() {
+		query += fmt.Sprintf("&since=%d", since.Unix())
+	}
+	response, err := getWithContext(ctx, query)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", response.StatusCode)
 	}
 
 	//
@@ -33,7 +119,7 @@ func Objects(server string) []string {
 	//
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	//
@@ -41,32 +127,131 @@ func Objects(server string) []string {
 	//
 	err = json.Unmarshal(body, &tmp)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// Tombstones reads the list of deleted objects on the given server,
+// along with the time each deletion took place.
+//
+// The list is fetched a page at a time, to avoid a single huge response.
+//
+// If any page can't be read an error is returned, rather than a partial
+// list, since a deletion we don't know about would be undone.
+func Tombstones(ctx context.Context, server string) (map[string]time.Time, error) {
+	all := make(map[string]time.Time)
+
+	after := ""
+	for {
+		page, err := tombstonesPage(ctx, server, after, listPageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		//
+		// Find the last ID, noticing servers which predate
+		// pagination and return every tombstone regardless.
+		//
+		last := ""
+		complete := len(page) > listPageSize
+		for id, when := range page {
+			if id <= after {
+				complete = true
+			}
+			if id > last {
+				last = id
+			}
+			all[id] = when
+		}
+
+		if complete || len(page) < listPageSize {
+			return all, nil
+		}
+		after = last
 	}
-	return tmp
 }
 
-// HasObject tests if the specified server contains the given object.
-func HasObject(server string, object string) bool {
+//
+// tombstonesPage reads a single page of the tombstones on the given
+// server.
+//
+func tombstonesPage(ctx context.Context, server string, after string, limit int) (map[string]time.Time, error) {
+	tmp := make(map[string]time.Time)
 
-	response, err := http.Head(server + "/blob/" + object)
+	query := fmt.Sprintf("%s/tombstones?after=%s&limit=%d",
+		server, url.QueryEscape(after), limit)
+	response, err := getWithContext(ctx, query)
 	if err != nil {
-		fmt.Printf("Error Fetching: %s/blob/%s\n", server, object)
-		return false
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", response.StatusCode)
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&tmp)
+	if err != nil {
+		return nil, err
+	}
+	return tmp, nil
+}
+
+//
+// getWithContext fetches the given URL, via our client, cancelling the
+// request along with the given context.
+//
+func getWithContext(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
 	}
+	return replicationClient.Do(req)
+}
 
-	if response.StatusCode == 200 {
-		fmt.Printf("\tObject %s is present on %s\n", object, server)
-		return true
+// errNewerObject is returned by DeleteObject if the server holds a copy
+// of the object which was uploaded after it was deleted.
+var errNewerObject = errors.New("object is newer than the deletion")
+
+// DeleteObject propagates the deletion of the specified object, which
+// took place at the given time, to the given server.
+//
+// If the server holds a copy which was uploaded after the deletion then
+// it is retained and errNewerObject is returned.
+func DeleteObject(ctx context.Context, server string, obj string, when time.Time, options replicateCmd) error {
+
+	if options.verbose {
+		fmt.Printf("\t\tDeleting %s from %s\n", obj, server)
 	}
 
-	fmt.Printf("\tObject %s is missing on %s\n", object, server)
-	return false
+	child, _ := http.NewRequestWithContext(ctx, "DELETE", server+"/blob/"+obj, nil)
+	child.Header.Set("X-Deleted-At", when.UTC().Format(time.RFC3339Nano))
+
+	r, err := replicationClient.Do(child)
+	if err != nil {
+		fmt.Printf("Error deleting %s from %s - %s\n", obj, server, err.Error())
+		return err
+	}
+	r.Body.Close()
+
+	if r.StatusCode == http.StatusConflict {
+		fmt.Printf("\tObject %s was uploaded to %s after it was deleted\n", obj, server)
+		return errNewerObject
+	}
+	if r.StatusCode != http.StatusOK {
+		fmt.Printf("Error deleting %s from %s - status %d\n", obj, server, r.StatusCode)
+		return fmt.Errorf("status %d", r.StatusCode)
+	}
+	return nil
 }
 
 // MirrorObject attempts to replicate the specified object between the two
 // listed hosts.
-func MirrorObject(src string, dst string, obj string, options replicateCmd) bool {
+//
+// The transfer is throttled by the given rate-limiter, which may be nil,
+// and abandoned if the given context is cancelled.
+func MirrorObject(ctx context.Context, src string, dst string, obj string, limiter *rateLimiter, options replicateCmd) bool {
 
 	if options.verbose {
 		fmt.Printf("\t\tMirroring %s from %s to %s\n", obj, src, dst)
@@ -78,7 +263,7 @@ func MirrorObject(src string, dst string, obj string, options replicateCmd) bool
 	srcURL := fmt.Sprintf("%s%s%s", src, "/blob/", obj)
 	fmt.Printf("\tFetching :%s\n", srcURL)
 
-	response, err := http.Get(srcURL)
+	response, err := getWithContext(ctx, srcURL)
 
 	//
 	// If there was an error we're done.
@@ -88,10 +273,20 @@ func MirrorObject(src string, dst string, obj string, options replicateCmd) bool
 			obj, src, "/blob/", obj)
 		return false
 	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		fmt.Printf("Error fetching %s from %s%s%s - status %d\n",
+			obj, src, "/blob/", obj, response.StatusCode)
+		return false
+	}
 
 	//
-	// Prepare to POST the body we've downloaded to
-	// the mirror-location
+	// Prepare to POST the body we're downloading to
+	// the mirror-location.
+	//
+	// The body is streamed straight through, so we never hold
+	// the whole object in RAM.
 	//
 	dstURL := fmt.Sprintf("%s%s%s", dst, "/blob/", obj)
 	fmt.Printf("\tUploading :%s\n", dstURL)
@@ -99,7 +294,9 @@ func MirrorObject(src string, dst string, obj string, options replicateCmd) bool
 	//
 	// Build up a new request.
 	//
-	child, _ := http.NewRequest("POST", dstURL, response.Body)
+	body := &limitedReader{reader: response.Body, limiter: limiter}
+	child, _ := http.NewRequestWithContext(ctx, "POST", dstURL, body)
+	child.ContentLength = response.ContentLength
 
 	//
 	// Copy any X-Header which was present
@@ -114,27 +311,62 @@ func MirrorObject(src string, dst string, obj string, options replicateCmd) bool
 	//
 	// Send the request.
 	//
-	client := &http.Client{}
-	r, err := client.Do(child)
+	r, err := replicationClient.Do(child)
 
 	//
 	// If there was no error we're good.
 	//
 	if err != nil {
-		fmt.Printf("Error sending to %s - %s\n", dstURL, r.Body)
+		fmt.Printf("Error sending to %s - %s\n", dstURL, err.Error())
+		return false
+	}
+	r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		fmt.Printf("Error sending to %s - status %d\n", dstURL, r.StatusCode)
 		return false
 	}
 
 	return true
 }
 
+// syncStats records the outcome of syncing a single group.
+type syncStats struct {
+	// Copied is the number of objects which were mirrored.
+	Copied int `json:"copied"`
+
+	// Deleted is the number of deletions which were propagated.
+	Deleted int `json:"deleted"`
+
+	// Failures is the number of operations which failed.
+	Failures int `json:"failures"`
+}
+
 // SyncGroup syncs the contents of the specified hosts.
-func SyncGroup(servers []libconfig.BlobServer, options replicateCmd) {
+//
+// Objects are normally copied to every host, but those listed in the
+// given replica counts are only copied until they have that many copies,
+// see bucketReplicas.
+//
+// The objects which need to be copied are queued to the given pool, and
+// we wait for them to be completed before returning.
+//
+// If the context is cancelled the sync stops after the current objects.
+func SyncGroup(ctx context.Context, members []libconfig.BlobServer, replicas map[string]int, pool *transferPool, options replicateCmd) syncStats {
+	var stats syncStats
+
+	//
+	// Transfers complete in the background, so we need to protect
+	// our stats, and wait for them to finish.
+	//
+	var mutex sync.Mutex
+	var pending sync.WaitGroup
+
 	//
 	// If we're being verbose show the members
 	//
 	if options.verbose {
-		for _, s := range servers {
+		for _, s := range members {
 			fmt.Printf("\tGroup member: %s\n", s.Location)
 		}
 	}
@@ -151,16 +383,93 @@ func SyncGroup(servers []libconfig.BlobServer, options replicateCmd) {
 	//  Store the list of objects each server hosts in the
 	// hash, keyed upon the server-location/name.
 	//
+	// If we can't get the list from a server we can't know
+	// what it is missing, so it is skipped for this run.
+	//
+	var servers []libconfig.BlobServer
+	for _, s := range members {
+		list, err := Objects(ctx, s.Location)
+		if err != nil {
+			fmt.Printf("Error fetching object list from %s: %s\n", s.Location, err.Error())
+			stats.Failures++
+			continue
+		}
+		objects[s.Location] = list
+		servers = append(servers, s)
+	}
+
+	//
+	// Fetch the deletions each server has recorded, keeping the
+	// most recent deletion of each object.
+	//
+	// If we can't learn of every deletion we'd copy deleted
+	// objects back, so the group is left alone for this run.
+	//
+	tombstones := make(map[string]time.Time)
+	for _, s := range servers {
+		list, err := Tombstones(ctx, s.Location)
+		if err != nil {
+			fmt.Printf("Error fetching tombstones from %s: %s\n", s.Location, err.Error())
+			stats.Failures++
+			return stats
+		}
+		for id, when := range list {
+			if when.After(tombstones[id]) {
+				tombstones[id] = when
+			}
+		}
+	}
+
+	//
+	// If any server still holds an object which was deleted on
+	// one of its peers then it missed the deletion, so we remove
+	// it now rather than letting it be copied back.
+	//
+	// The exception is an object which was uploaded again after
+	// the deletion, which the server will refuse to remove.  Such
+	// objects are replicated as normal.
+	//
 	for _, s := range servers {
-		objects[s.Location] = Objects(s.Location)
+		var keep []string
+
+		for _, id := range objects[s.Location] {
+			when, deleted := tombstones[id]
+			if deleted && ctx.Err() == nil {
+				err := DeleteObject(ctx, s.Location, id, when, options)
+				if err == nil {
+					stats.Deleted++
+					continue
+				}
+				if err == errNewerObject {
+					delete(tombstones, id)
+				} else {
+					stats.Failures++
+				}
+			}
+			keep = append(keep, id)
+		}
+		objects[s.Location] = keep
 	}
 
 	//
 	// Right we have a list of servers.
 	//
 	// For each server we also have the list of objects
-	// that they contain.
+	// that they contain, so we can work out which objects each
+	// server is missing locally, rather than asking each server
+	// about every object.
 	//
+	present := make(map[string]map[string]bool)
+	held := make(map[string]map[string]bool)
+	for _, server := range servers {
+		present[server.Location] = make(map[string]bool)
+		held[server.Location] = make(map[string]bool)
+		for _, i := range objects[server.Location] {
+			present[server.Location][i] = true
+			held[server.Location][i] = true
+		}
+	}
+
 	for _, server := range servers {
 
 		//
@@ -173,47 +482,392 @@ func SyncGroup(servers []libconfig.BlobServer, options replicateCmd) {
 		//
 		for _, i := range obs {
 
+			//
+			// Stop if we've been asked to.
+			//
+			if ctx.Err() != nil {
+				pending.Wait()
+				return stats
+			}
+
+			//
+			// Don't replicate deleted objects.
+			//
+			if _, deleted := tombstones[i]; deleted {
+				continue
+			}
+
 			//
 			//  Mirror the object to every server that is not itself
 			//
 			for _, mirror := range servers {
 
 				//
-				// Ensure that src != dst.
+				// Ensure that src != dst, and that the
+				// object is missing.
+				//
+				if mirror.Location == server.Location || present[mirror.Location][i] {
+					continue
+				}
+
+				//
+				// Read-only servers receive no new objects.
 				//
-				if mirror.Location != server.Location {
+				if mirror.ReadOnly {
+					continue
+				}
 
-					// If the object is missing.
-					if !HasObject(mirror.Location, i) {
-						MirrorObject(server.Location, mirror.Location, i, options)
-					}
+				//
+				// Objects with a replica count only need
+				// that many copies.
+				//
+				if want := replicas[i]; want > 0 && countCopies(present, i) >= want {
+					continue
+				}
+
+				if options.verbose {
+					fmt.Printf("\tObject %s is missing on %s\n", i, mirror.Location)
 				}
 
+				//
+				// Once queued we record the object as
+				// present, so that we don't copy it again
+				// from one of the other servers.
+				//
+				present[mirror.Location][i] = true
+
+				pool.submit(transfer{
+					src: copySource(servers, held, server, mirror, i),
+					dst: mirror,
+					obj: i,
+					wg:  &pending,
+					result: func(ok bool) {
+						mutex.Lock()
+						defer mutex.Unlock()
+						if ok {
+							stats.Copied++
+						} else {
+							stats.Failures++
+						}
+					},
+				})
 			}
 		}
 	}
+
+	//
+	// Wait for our transfers to complete.
+	//
+	pending.Wait()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	return stats
 }
 
-// replicate is the entry-point to this sub-command.
-func replicate(options replicateCmd) {
+// countCopies returns the number of servers which hold the given object,
+// or which it has been queued to be copied to.
+func countCopies(present map[string]map[string]bool, obj string) int {
+	count := 0
+	for _, objects := range present {
+		if objects[obj] {
+			count++
+		}
+	}
+	return count
+}
+
+// copySource returns the server from which the given object should be
+// copied to the given destination.
+//
+// This is normally the first server we found holding it, but if another
+// server which holds it is in the same zone as the destination then we
+// use that instead, to avoid copying between zones.
+func copySource(servers []libconfig.BlobServer, held map[string]map[string]bool, first libconfig.BlobServer, dst libconfig.BlobServer, obj string) string {
+	if dst.Zone == "" || first.Zone == dst.Zone {
+		return first.Location
+	}
+
+	for _, s := range servers {
+		if s.Zone == dst.Zone && held[s.Location][obj] {
+			return s.Location
+		}
+	}
+	return first.Location
+}
+
+// SyncMeta syncs our metadata across the specified hosts.
+//
+// Every server should hold the most recent copy of every entry, so any
+// server which holds an older copy, or no copy at all, is sent it.  The
+// API-server does the same when it reads an entry, but entries which are
+// never read would otherwise remain out of date.
+//
+// The most recent copy of each entry is returned, along with our stats.
+//
+// If the context is cancelled the sync stops after the current entry.
+func SyncMeta(ctx context.Context, members []libconfig.BlobServer, options replicateCmd) (syncStats, map[string]MetaEntry) {
+	var stats syncStats
+
+	//
+	// Fetch the entries each server holds, and find the most recent
+	// copy of each.
+	//
+	// If we can't get the list from a server we can't know what it
+	// is missing, so it is skipped for this run.
+	//
+	held := make(map[string]map[string]MetaEntry)
+	latest := make(map[string]MetaEntry)
+
+	var servers []libconfig.BlobServer
+	for _, s := range members {
+		list, err := MetaEntries(replicationClient, s.Location)
+		if err != nil {
+			if options.verbose {
+				fmt.Printf("Error fetching metadata from %s: %s\n", s.Location, err.Error())
+			}
+			stats.Failures++
+			continue
+		}
+
+		held[s.Location] = make(map[string]MetaEntry)
+		for _, entry := range list {
+			held[s.Location][entry.Key] = entry
+			if existing, ok := latest[entry.Key]; !ok || entry.Newer(existing) {
+				latest[entry.Key] = entry
+			}
+		}
+		servers = append(servers, s)
+	}
+
+	keys := make([]string, 0, len(latest))
+	for key := range latest {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+
+		//
+		// Stop if we've been asked to.
+		//
+		if ctx.Err() != nil {
+			return stats, latest
+		}
+
+		entry := latest[key]
+		for _, s := range servers {
+			existing, ok := held[s.Location][key]
+			if ok && !entry.Newer(existing) {
+				continue
+			}
+
+			if options.verbose {
+				fmt.Printf("	Metadata %s is out of date on %s\n", key, s.Location)
+			}
+
+			_, err := sendMeta(replicationClient, s.Location, entry)
+			switch {
+			case err != nil:
+				if options.verbose {
+					fmt.Printf("	Error storing metadata upon %s: %s\n", s.Location, err.Error())
+				}
+				stats.Failures++
+			case entry.Deleted:
+				stats.Deleted++
+			default:
+				stats.Copied++
+			}
+		}
+	}
+	return stats, latest
+}
+
+// bucketReplicas returns the number of copies each named object should
+// have within its group, given the most recent copy of our metadata.
+//
+// This is the replica count of the bucket holding the object.  If the
+// same object is within several buckets the largest count is used, and
+// objects within any bucket without a count, along with those we know
+// nothing about, aren't listed:  they're copied to every member of their
+// group.
+func bucketReplicas(latest map[string]MetaEntry) map[string]int {
+	replicas := make(map[string]int)
+	everywhere := make(map[string]bool)
+
+	for key, entry := range latest {
+		if entry.Deleted || !strings.HasPrefix(key, "objects/") {
+			continue
+		}
+
+		var obj namedObject
+		if json.Unmarshal(entry.Value, &obj) != nil {
+			continue
+		}
+
+		//
+		// The bucket is everything up to the first `/` of the
+		// name.
+		//
+		name := strings.TrimPrefix(key, "objects/")
+		bucket := strings.SplitN(name, "/", 2)[0]
+
+		var policy bucketPolicy
+		b, ok := latest[bucketKey(bucket)]
+		if !ok || b.Deleted || json.Unmarshal(b.Value, &policy) != nil || policy.Replicas == 0 {
+			everywhere[obj.ID] = true
+			continue
+		}
+		if policy.Replicas > replicas[obj.ID] {
+			replicas[obj.ID] = policy.Replicas
+		}
+	}
+
+	for id := range everywhere {
+		delete(replicas, id)
+	}
+	return replicas
+}
+
+// groupStatus records the outcome of the most recent sync of a group.
+type groupStatus struct {
+	syncStats
+
+	// LastRun is the time at which the group was last synced.
+	LastRun time.Time `json:"last_run"`
+
+	// Duration is how long the sync took.
+	Duration string `json:"duration"`
+}
+
+// replicationStatus records the state of the replicator, so that it
+// may be reported via the status end-point when running as a daemon.
+type replicationStatus struct {
+	sync.Mutex
+
+	// Running is true if a replication run is in progress.
+	Running bool `json:"running"`
+
+	// Runs is the number of replication runs which have completed.
+	Runs int `json:"runs"`
+
+	// LastRun is the time at which the most recent run completed.
+	LastRun time.Time `json:"last_run"`
+
+	// NextRun is the time at which the next run is scheduled.
+	NextRun time.Time `json:"next_run"`
+
+	// Groups holds the outcome of syncing each group.
+	Groups map[string]groupStatus `json:"groups"`
+
+	// Metadata holds the outcome of syncing our metadata.
+	Metadata syncStats `json:"metadata"`
+}
+
+//
+// ServeHTTP reports the status, as JSON.
+//
+func (rs *replicationStatus) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	rs.Lock()
+	defer rs.Unlock()
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(rs)
+}
+
+//
+// replicateOnce carries out a single replication run, syncing each
+// group of the given configuration in parallel, and records the results
+// in the given status.
+//
+func replicateOnce(ctx context.Context, config *libconfig.Config, options replicateCmd, limiter *rateLimiter, status *replicationStatus) {
+
+	status.Lock()
+	status.Running = true
+	status.Unlock()
 
 	//
-	// If we received blob-servers on the command-line use them too.
+	// Our metadata is held by every server, whatever its group.
 	//
-	// NOTE: blob-servers added on the command-line are placed in the
-	// "default" group.
+	// It is synced first, since it tells us how many copies of
+	// each object the buckets holding them require.
+	//
+	meta, latest := SyncMeta(ctx, config.Servers(), options)
+	if options.verbose || options.daemon {
+		fmt.Printf("Synced metadata: %d copied, %d deleted, %d failures\n",
+			meta.Copied, meta.Deleted, meta.Failures)
+	}
+	replicas := bucketReplicas(latest)
+
+	//
+	// All the groups share a single pool of workers.
+	//
+	pool := newTransferPool(ctx, options, limiter)
+
+	//
+	// Get a list of groups.
 	//
-	if options.blob != "" {
-		servers := strings.Split(options.blob, ",")
-		for _, entry := range servers {
-			libconfig.AddServer("default", entry)
+	var wg sync.WaitGroup
+	for _, entry := range config.Groups() {
+
+		if options.verbose {
+			fmt.Printf("Syncing group: %s\n", entry)
 		}
-	} else {
 
 		//
-		//  Initialize the servers from our config file(s).
+		// For each group, get the members, and sync them.
 		//
-		libconfig.InitServers()
+		wg.Add(1)
+		go func(group string) {
+			defer wg.Done()
+
+			start := time.Now()
+			stats := SyncGroup(ctx, config.GroupMembers(group), replicas, pool, options)
+
+			status.Lock()
+			status.Groups[group] = groupStatus{syncStats: stats, LastRun: start, Duration: time.Since(start).String()}
+			status.Unlock()
+
+			if options.verbose || options.daemon {
+				fmt.Printf("Synced group %s: %d copied, %d deleted, %d failures\n",
+					group, stats.Copied, stats.Deleted, stats.Failures)
+			}
+		}(entry)
+	}
+	wg.Wait()
+	pool.close()
+
+	status.Lock()
+	status.Metadata = meta
+	status.Running = false
+	status.Runs++
+	status.LastRun = time.Now()
+	status.Unlock()
+}
+
+//
+// jitter returns the given interval adjusted by a random amount, of up
+// to 10% either way, so that multiple replicators don't synchronize.
+//
+func jitter(interval time.Duration) time.Duration {
+	spread := int64(interval / 10)
+	if spread <= 0 {
+		return interval
+	}
+	return interval - time.Duration(spread) + time.Duration(rand.Int63n(2*spread))
+}
+
+// replicate is the entry-point to this sub-command.
+func replicate(ctx context.Context, options replicateCmd) {
+
+	//
+	// Load our blob-servers, from the command-line or our
+	// config file(s).
+	//
+	config, err := loadConfig(options.blob)
+	if err != nil {
+		fmt.Printf("Error reading configuration: %s\n", err.Error())
+		return
 	}
 
 	//
@@ -221,23 +875,91 @@ func replicate(options replicateCmd) {
 	//
 	if options.verbose {
 		fmt.Printf("\t% 10s - %s\n", "group", "server")
-		for _, entry := range libconfig.Servers() {
+		for _, entry := range config.Servers() {
 			fmt.Printf("\t% 10s - %s\n", entry.Group, entry.Location)
 		}
 	}
 
 	//
-	// Get a list of groups.
+	// A single rate-limiter is shared by all our transfers.
 	//
-	for _, entry := range libconfig.Groups() {
+	rate, err := parseRate(options.bwlimit)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		return
+	}
+	limiter := newRateLimiter(rate)
 
-		if options.verbose {
-			fmt.Printf("Syncing group: %s\n", entry)
+	status := &replicationStatus{Groups: make(map[string]groupStatus)}
+
+	//
+	// If we're not running as a daemon we just run once.
+	//
+	if !options.daemon {
+		replicateOnce(ctx, config, options, limiter, status)
+		return
+	}
+
+	//
+	// Otherwise we run until we're asked to stop, which we
+	// handle by cancelling our context.
+	//
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fmt.Printf("Received %s, finishing the current object before exiting\n", sig)
+		cancel()
+	}()
+
+	//
+	// If our blob-servers came from our configuration files then
+	// reload them upon SIGHUP, ready for the next run.
+	//
+	if options.blob == "" {
+		go reloadLoop(config, nil, 0)
+	}
+
+	//
+	// Launch the status-server, if we should.
+	//
+	if options.statusPort != 0 {
+		srv := &http.Server{
+			Addr:    fmt.Sprintf("%s:%d", options.statusHost, options.statusPort),
+			Handler: status,
 		}
+		go func() {
+			serr := srv.ListenAndServe()
+			if serr != nil && serr != http.ErrServerClosed {
+				fmt.Printf("Error launching status-server: %s\n", serr.Error())
+			}
+		}()
+		defer srv.Close()
+
+		fmt.Printf("Replication status available at http://%s:%d/\n", options.statusHost, options.statusPort)
+	}
+
+	rand.Seed(time.Now().UnixNano())
+
+	for ctx.Err() == nil {
+
+		replicateOnce(ctx, config, options, limiter, status)
 
 		//
-		// For each group, get the members, and sync them.
+		// Wait until the next run is due, or we're stopped.
 		//
-		SyncGroup(libconfig.GroupMembers(entry), options)
+		delay := jitter(options.interval)
+
+		status.Lock()
+		status.NextRun = time.Now().Add(delay)
+		status.Unlock()
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
 	}
 }
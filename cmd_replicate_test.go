@@ -0,0 +1,730 @@
+//
+// Test our replication against some fake blob-servers.
+//
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/skx/sos/libconfig"
+)
+
+//
+// fakeBlobServer is a minimal, in-memory, implementation of the
+// blob-server API.
+//
+type fakeBlobServer struct {
+	sync.Mutex
+	objects    map[string]string
+	tombstones map[string]time.Time
+	paged      bool
+	full       bool
+	broken     bool
+	requests   map[string]int
+	server     *httptest.Server
+
+	// inflight and peak track concurrent uploads.
+	inflight int32
+	peak     int32
+}
+
+//
+// newFakeBlobServer creates, and launches, a new fake server holding
+// the given objects.
+//
+func newFakeBlobServer(objects ...string) *fakeBlobServer {
+	f := &fakeBlobServer{
+		objects:    make(map[string]string),
+		tombstones: make(map[string]time.Time),
+		requests:   make(map[string]int),
+	}
+	for _, obj := range objects {
+		f.objects[obj] = "content of " + obj
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/blobs", f.list).Methods("GET")
+	router.HandleFunc("/tombstones", f.listTombstones).Methods("GET")
+	router.HandleFunc("/blob/{id}", f.get).Methods("GET", "HEAD")
+	router.HandleFunc("/blob/{id}", f.store).Methods("POST")
+	router.HandleFunc("/blob/{id}", f.delete).Methods("DELETE")
+	f.server = httptest.NewServer(router)
+	return f
+}
+
+func (f *fakeBlobServer) count(req *http.Request) {
+	f.requests[req.Method]++
+}
+
+func (f *fakeBlobServer) list(res http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.count(req)
+
+	list := []string{}
+	for id := range f.objects {
+		list = append(list, id)
+	}
+	sort.Strings(list)
+
+	//
+	// Paginate, if we support that.
+	//
+	if f.paged {
+		after := req.FormValue("after")
+		limit, _ := strconv.Atoi(req.FormValue("limit"))
+
+		page := []string{}
+		for _, id := range list {
+			if id > after && len(page) < limit {
+				page = append(page, id)
+			}
+		}
+		list = page
+	}
+	json.NewEncoder(res).Encode(list)
+}
+
+func (f *fakeBlobServer) listTombstones(res http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.count(req)
+
+	if f.broken {
+		http.Error(res, "failed to read tombstones", http.StatusInternalServerError)
+		return
+	}
+
+	//
+	// Paginate, if we support that.
+	//
+	list := f.tombstones
+	if f.paged {
+		after := req.FormValue("after")
+		limit, _ := strconv.Atoi(req.FormValue("limit"))
+
+		var ids []string
+		for id := range f.tombstones {
+			if id > after {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+
+		list = make(map[string]time.Time)
+		for _, id := range ids {
+			if len(list) < limit {
+				list[id] = f.tombstones[id]
+			}
+		}
+	}
+	json.NewEncoder(res).Encode(list)
+}
+
+func (f *fakeBlobServer) get(res http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.count(req)
+
+	data, ok := f.objects[mux.Vars(req)["id"]]
+	if !ok {
+		http.NotFound(res, req)
+		return
+	}
+	res.Write([]byte(data))
+}
+
+func (f *fakeBlobServer) store(res http.ResponseWriter, req *http.Request) {
+	now := atomic.AddInt32(&f.inflight, 1)
+	defer atomic.AddInt32(&f.inflight, -1)
+	for {
+		peak := atomic.LoadInt32(&f.peak)
+		if now <= peak || atomic.CompareAndSwapInt32(&f.peak, peak, now) {
+			break
+		}
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+	time.Sleep(5 * time.Millisecond)
+
+	f.Lock()
+	defer f.Unlock()
+	f.count(req)
+
+	id := mux.Vars(req)["id"]
+
+	//
+	// Pretend our disk is full, if we've been told to.
+	//
+	if f.full {
+		http.Error(res, "failed to write to storage", http.StatusInternalServerError)
+		return
+	}
+
+	f.objects[id] = string(body)
+	delete(f.tombstones, id)
+	fmt.Fprintf(res, "{\"id\":\"%s\",\"status\":\"OK\",\"size\":%d}", id, len(body))
+}
+
+func (f *fakeBlobServer) delete(res http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.count(req)
+
+	id := mux.Vars(req)["id"]
+	when, _ := time.Parse(time.RFC3339Nano, req.Header.Get("X-Deleted-At"))
+	delete(f.objects, id)
+	f.tombstones[id] = when
+}
+
+//
+// has returns true if the fake server holds the given object, with
+// the expected content.
+//
+func (f *fakeBlobServer) has(id string) bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.objects[id] == "content of "+id
+}
+
+//
+// Test that a group is synced, including deletions.
+//
+func TestSyncGroup(t *testing.T) {
+
+	a := newFakeBlobServer("one", "two", "gone")
+	defer a.server.Close()
+	b := newFakeBlobServer("two", "three")
+	defer b.server.Close()
+	c := newFakeBlobServer()
+	defer c.server.Close()
+
+	//
+	// The object "gone" was deleted from c, but a missed that.
+	//
+	c.tombstones["gone"] = time.Now()
+
+	members := []libconfig.BlobServer{
+		{Location: a.server.URL, Group: "default"},
+		{Location: b.server.URL, Group: "default"},
+		{Location: c.server.URL, Group: "default"},
+	}
+
+	options := replicateCmd{workers: 4, perDestination: 2}
+	pool := newTransferPool(context.Background(), options, nil)
+	defer pool.close()
+
+	stats := SyncGroup(context.Background(), members, nil, pool, options)
+
+	//
+	// Every member should have every object, other than the
+	// deleted one.
+	//
+	for _, f := range []*fakeBlobServer{a, b, c} {
+		for _, id := range []string{"one", "two", "three"} {
+			if !f.has(id) {
+				t.Errorf("%s is missing %s after sync", f.server.URL, id)
+			}
+		}
+		if f.has("gone") {
+			t.Errorf("%s still holds a deleted object", f.server.URL)
+		}
+	}
+
+	//
+	// one -> b,c two -> c three -> a,c
+	//
+	if stats.Copied != 5 || stats.Deleted != 1 || stats.Failures != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	//
+	// A second sync has nothing to do.
+	//
+	stats = SyncGroup(context.Background(), members, nil, pool, options)
+	if stats.Copied != 0 || stats.Deleted != 0 || stats.Failures != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	//
+	// The missing objects are determined from the listings, so
+	// we never need to probe for individual objects.
+	//
+	for _, f := range []*fakeBlobServer{a, b, c} {
+		if f.requests["HEAD"] != 0 {
+			t.Errorf("%s received %d HEAD requests", f.server.URL, f.requests["HEAD"])
+		}
+	}
+}
+
+//
+// Test that objects with a replica count are only copied until they
+// have that many copies.
+//
+func TestSyncGroupReplicas(t *testing.T) {
+
+	a := newFakeBlobServer("one", "two")
+	defer a.server.Close()
+	b := newFakeBlobServer()
+	defer b.server.Close()
+	c := newFakeBlobServer()
+	defer c.server.Close()
+
+	members := []libconfig.BlobServer{
+		{Location: a.server.URL, Group: "default"},
+		{Location: b.server.URL, Group: "default"},
+		{Location: c.server.URL, Group: "default"},
+	}
+
+	pool := newTransferPool(context.Background(), replicateCmd{}, nil)
+	defer pool.close()
+
+	//
+	// "one" needs two copies, "two" is copied everywhere.
+	//
+	replicas := map[string]int{"one": 2}
+	stats := SyncGroup(context.Background(), members, replicas, pool, replicateCmd{})
+
+	held := 0
+	for _, f := range []*fakeBlobServer{a, b, c} {
+		if f.has("one") {
+			held++
+		}
+		if !f.has("two") {
+			t.Errorf("%s is missing two after sync", f.server.URL)
+		}
+	}
+	if held != 2 {
+		t.Errorf("Expected two copies of one, found %d", held)
+	}
+	if stats.Copied != 3 || stats.Failures != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	//
+	// A lost copy is replaced.
+	//
+	a.Lock()
+	delete(a.objects, "one")
+	a.Unlock()
+
+	stats = SyncGroup(context.Background(), members, replicas, pool, replicateCmd{})
+	if stats.Copied != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+//
+// Test that the replica counts are found from the bucket of each object.
+//
+func TestBucketReplicas(t *testing.T) {
+
+	entry := func(value string) MetaEntry {
+		return MetaEntry{Value: json.RawMessage(value), Modified: time.Now()}
+	}
+
+	latest := map[string]MetaEntry{
+		bucketKey("two"):            entry(`{"replicas":2}`),
+		bucketKey("three"):          entry(`{"replicas":3}`),
+		bucketKey("all"):            entry(`{"public":true}`),
+		objectKey("two", "a"):       entry(`{"id":"a","size":1}`),
+		objectKey("two", "b"):       entry(`{"id":"b","size":1}`),
+		objectKey("three", "b"):     entry(`{"id":"b","size":1}`),
+		objectKey("two", "c"):       entry(`{"id":"c","size":1}`),
+		objectKey("all", "c"):       entry(`{"id":"c","size":1}`),
+		objectKey("missing", "d"):   entry(`{"id":"d","size":1}`),
+		objectKey("two", "deleted"): {Deleted: true},
+	}
+
+	replicas := bucketReplicas(latest)
+
+	//
+	// "c" is within a bucket without a count, and "d" within a
+	// bucket we know nothing of, so both are copied everywhere.
+	//
+	expected := map[string]int{"a": 2, "b": 3}
+	if !reflect.DeepEqual(replicas, expected) {
+		t.Errorf("Expected %v, got %v", expected, replicas)
+	}
+}
+
+//
+// Test that read-only members receive nothing, and that copies are made
+// from within the same zone where possible.
+//
+func TestSyncGroupAttributes(t *testing.T) {
+
+	a := newFakeBlobServer("one")
+	defer a.server.Close()
+	b := newFakeBlobServer("one")
+	defer b.server.Close()
+	c := newFakeBlobServer()
+	defer c.server.Close()
+	d := newFakeBlobServer()
+	defer d.server.Close()
+
+	members := []libconfig.BlobServer{
+		{Location: a.server.URL, Group: "default", Zone: "r1"},
+		{Location: b.server.URL, Group: "default", Zone: "r2"},
+		{Location: c.server.URL, Group: "default", Zone: "r2"},
+		{Location: d.server.URL, Group: "default", ReadOnly: true},
+	}
+
+	pool := newTransferPool(context.Background(), replicateCmd{}, nil)
+	defer pool.close()
+
+	stats := SyncGroup(context.Background(), members, nil, pool, replicateCmd{})
+	if !c.has("one") || d.has("one") {
+		t.Errorf("Object was mirrored to the wrong servers")
+	}
+	if stats.Copied != 1 || stats.Failures != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	//
+	// Transfers to a server are limited by its max-conns.
+	//
+	if pool.limit(members[0]) != 0 || pool.limit(libconfig.BlobServer{Location: "x", MaxConns: 3}) != 3 {
+		t.Errorf("Unexpected limit upon transfers")
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	b.Lock()
+	defer b.Unlock()
+	if a.requests["GET"] >= b.requests["GET"] {
+		t.Errorf("Object wasn't copied from within the same zone")
+	}
+}
+
+//
+// Test that an unreachable member doesn't abort the sync.
+//
+func TestSyncGroupUnreachable(t *testing.T) {
+
+	a := newFakeBlobServer("one")
+	defer a.server.Close()
+	b := newFakeBlobServer()
+	defer b.server.Close()
+
+	members := []libconfig.BlobServer{
+		{Location: a.server.URL, Group: "default"},
+		{Location: "http://127.0.0.1:1", Group: "default"},
+		{Location: b.server.URL, Group: "default"},
+	}
+
+	pool := newTransferPool(context.Background(), replicateCmd{}, nil)
+	defer pool.close()
+
+	stats := SyncGroup(context.Background(), members, nil, pool, replicateCmd{})
+
+	if !b.has("one") {
+		t.Errorf("Object wasn't mirrored")
+	}
+	if stats.Copied != 1 || stats.Failures != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+//
+// Test that a group is left alone if we can't read the tombstones of one
+// of its members, since we'd otherwise restore objects it deleted.
+//
+func TestSyncGroupTombstonesFailed(t *testing.T) {
+
+	a := newFakeBlobServer("one", "gone")
+	defer a.server.Close()
+	b := newFakeBlobServer()
+	defer b.server.Close()
+
+	b.tombstones["gone"] = time.Now()
+	b.broken = true
+
+	members := []libconfig.BlobServer{
+		{Location: a.server.URL, Group: "default"},
+		{Location: b.server.URL, Group: "default"},
+	}
+
+	pool := newTransferPool(context.Background(), replicateCmd{}, nil)
+	defer pool.close()
+
+	stats := SyncGroup(context.Background(), members, nil, pool, replicateCmd{})
+
+	if b.has("one") || b.has("gone") || !a.has("gone") {
+		t.Errorf("The group was synced without its tombstones")
+	}
+	if stats.Copied != 0 || stats.Deleted != 0 || stats.Failures != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	_, err := Tombstones(context.Background(), b.server.URL)
+	if err == nil {
+		t.Errorf("Expected an error reading broken tombstones")
+	}
+}
+
+//
+// Test that object-lists are fetched a page at a time, from servers
+// which support that, and in one go from those which don't.
+//
+func TestObjects(t *testing.T) {
+
+	bak := listPageSize
+	listPageSize = 2
+	defer func() { listPageSize = bak }()
+
+	for _, size := range []int{0, 1, 2, 3, 4, 5} {
+
+		var objects []string
+		for i := 0; i < size; i++ {
+			objects = append(objects, fmt.Sprintf("obj%d", i))
+		}
+
+		for _, paged := range []bool{true, false} {
+
+			f := newFakeBlobServer(objects...)
+			f.paged = paged
+
+			list, err := Objects(context.Background(), f.server.URL)
+			f.server.Close()
+
+			if err != nil {
+				t.Errorf("Unexpected error: %s", err.Error())
+			}
+			if strings.Join(list, ",") != strings.Join(objects, ",") {
+				t.Errorf("Unexpected listing, paged:%t, %v", paged, list)
+			}
+
+			//
+			// A paged server is asked for one page more than
+			// it holds, so it can tell us we've finished.
+			//
+			if paged && f.requests["GET"] != size/2+1 {
+				t.Errorf("Unexpected number of requests for %d objects: %d", size, f.requests["GET"])
+			}
+		}
+	}
+}
+
+//
+// Test that tombstones are fetched a page at a time, from servers which
+// support that, and in one go from those which don't.
+//
+func TestTombstones(t *testing.T) {
+
+	bak := listPageSize
+	listPageSize = 2
+	defer func() { listPageSize = bak }()
+
+	for _, size := range []int{0, 1, 2, 3, 4, 5} {
+		for _, paged := range []bool{true, false} {
+
+			f := newFakeBlobServer()
+			f.paged = paged
+			for i := 0; i < size; i++ {
+				f.tombstones[fmt.Sprintf("obj%d", i)] = time.Unix(int64(i), 0)
+			}
+
+			list, err := Tombstones(context.Background(), f.server.URL)
+			f.server.Close()
+
+			if err != nil || len(list) != size {
+				t.Errorf("Unexpected tombstones, paged:%t, %v", paged, list)
+			}
+			for i := 0; i < size; i++ {
+				if !list[fmt.Sprintf("obj%d", i)].Equal(time.Unix(int64(i), 0)) {
+					t.Errorf("Missing tombstone obj%d, paged:%t", i, paged)
+				}
+			}
+			if paged && f.requests["GET"] != size/2+1 {
+				t.Errorf("Unexpected number of requests for %d tombstones: %d", size, f.requests["GET"])
+			}
+		}
+	}
+}
+
+//
+// Test that transfers run in parallel, but respect the cap upon each
+// destination.
+//
+func TestSyncGroupParallel(t *testing.T) {
+
+	var objects []string
+	for i := 0; i < 20; i++ {
+		objects = append(objects, fmt.Sprintf("obj%d", i))
+	}
+
+	a := newFakeBlobServer(objects...)
+	defer a.server.Close()
+	b := newFakeBlobServer()
+	defer b.server.Close()
+	c := newFakeBlobServer()
+	defer c.server.Close()
+
+	members := []libconfig.BlobServer{
+		{Location: a.server.URL, Group: "default"},
+		{Location: b.server.URL, Group: "default"},
+		{Location: c.server.URL, Group: "default"},
+	}
+
+	options := replicateCmd{workers: 8, perDestination: 3}
+	pool := newTransferPool(context.Background(), options, nil)
+	defer pool.close()
+
+	stats := SyncGroup(context.Background(), members, nil, pool, options)
+	if stats.Copied != 40 || stats.Failures != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	for _, f := range []*fakeBlobServer{b, c} {
+		if f.peak > 3 {
+			t.Errorf("%s received %d concurrent uploads", f.server.URL, f.peak)
+		}
+		if f.peak < 2 {
+			t.Errorf("%s received no concurrent uploads", f.server.URL)
+		}
+	}
+}
+
+//
+// Test the jitter we apply to our interval.
+//
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		j := jitter(time.Minute)
+		if j < 54*time.Second || j > 66*time.Second {
+			t.Errorf("Unexpected jitter %s", j)
+		}
+	}
+
+	if jitter(0) != 0 {
+		t.Errorf("Unexpected jitter for zero")
+	}
+}
+
+//
+// Test the status end-point.
+//
+func TestReplicationStatus(t *testing.T) {
+	status := &replicationStatus{Groups: make(map[string]groupStatus)}
+	status.Groups["1"] = groupStatus{syncStats: syncStats{Copied: 3, Failures: 1}}
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	status.ServeHTTP(rr, req)
+
+	body := rr.Body.String()
+	if !strings.Contains(body, "\"copied\":3") || !strings.Contains(body, "\"failures\":1") {
+		t.Errorf("Unexpected status: %s", body)
+	}
+}
+
+//
+// Test that transfers to a destination which is stuck don't hold up
+// those to any other.
+//
+func TestTransferPoolStuck(t *testing.T) {
+
+	src := newFakeBlobServer("obj1", "obj2", "obj3", "obj4")
+	defer src.server.Close()
+	fast := newFakeBlobServer()
+	defer fast.server.Close()
+
+	release := make(chan struct{})
+	stuck := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		<-release
+		http.Error(res, "too slow", http.StatusServiceUnavailable)
+	}))
+	defer stuck.Close()
+
+	pool := newTransferPool(context.Background(), replicateCmd{workers: 2, perDestination: 1}, nil)
+	defer pool.close()
+	defer close(release)
+
+	//
+	// Queue the stuck transfers first, so that they're taken first.
+	//
+	var slow, quick sync.WaitGroup
+	for _, obj := range []string{"obj1", "obj2", "obj3", "obj4"} {
+		pool.submit(transfer{
+			src:    src.server.URL,
+			dst:    libconfig.BlobServer{Location: stuck.URL},
+			obj:    obj,
+			wg:     &slow,
+			result: func(ok bool) {},
+		})
+	}
+	for _, obj := range []string{"obj1", "obj2", "obj3", "obj4"} {
+		pool.submit(transfer{
+			src:    src.server.URL,
+			dst:    libconfig.BlobServer{Location: fast.server.URL},
+			obj:    obj,
+			wg:     &quick,
+			result: func(ok bool) {},
+		})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		quick.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Transfers were held up by a stuck destination")
+	}
+	if !fast.has("obj4") {
+		t.Errorf("Object was not mirrored")
+	}
+}
+
+//
+// Test that cancelling the pool abandons transfers which are in progress.
+//
+func TestTransferPoolCancelled(t *testing.T) {
+
+	src, cancelled := newHungServer()
+	defer src.Close()
+	dst := newFakeBlobServer()
+	defer dst.server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := newTransferPool(ctx, replicateCmd{workers: 1}, nil)
+
+	var wg sync.WaitGroup
+	pool.submit(transfer{
+		src:    src.URL,
+		dst:    libconfig.BlobServer{Location: dst.server.URL},
+		obj:    "obj",
+		wg:     &wg,
+		result: func(ok bool) {},
+	})
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Errorf("The transfer wasn't cancelled")
+	}
+	pool.close()
+	wg.Wait()
+}
@@ -0,0 +1,179 @@
+//
+// Scrub the contents of a blob-server's storage, looking for bit-rot.
+//
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+)
+
+//
+// contentAddressed matches IDs which are SHA1 hashes of their content.
+//
+// Anything else was uploaded with verification disabled, so we cannot
+// tell whether it is corrupt.
+//
+var contentAddressed = regexp.MustCompile("^[0-9a-f]{40}$")
+
+// scrubResult records the outcome of a single scrub.
+type scrubResult struct {
+	// Checked is the number of objects which were hashed.
+	Checked int
+
+	// Skipped is the number of objects which were not
+	// content-addressed, and so could not be checked.
+	Skipped int
+
+	// Corrupt holds the IDs of the objects which failed to
+	// match, and which were quarantined.
+	Corrupt []string
+
+	// Unreadable holds the IDs of the objects which could not be
+	// read.  These are left alone, since the error might well be
+	// temporary, and are checked again by the next scrub.
+	Unreadable []string
+}
+
+// scrubStorage re-hashes each object within the given storage, and
+// quarantines any which no longer match their ID.
+//
+// Once quarantined an object no longer exists upon this server, so the
+// next run of `sos replicate` will restore a good copy from one of the
+// other members of its group.
+func scrubStorage(storage StorageHandler, limiter *rateLimiter, verbose bool) scrubResult {
+	var result scrubResult
+
+	for _, id := range storage.Existing() {
+
+		if !contentAddressed.MatchString(id) {
+			if verbose {
+				fmt.Printf("\tSkipping %s - not content-addressed\n", id)
+			}
+			result.Skipped++
+			continue
+		}
+
+		//
+		// The object might have been removed since we
+		// listed them.
+		//
+		// We note when it was stored, so that we don't
+		// quarantine a copy which replaces it while we're
+		// reading it.
+		//
+		modified, ok := storage.Modified(id)
+		if !ok {
+			continue
+		}
+		reader, _ := storage.Get(id)
+		if reader == nil {
+			continue
+		}
+
+		//
+		// Hash the content.
+		//
+		// A read-error doesn't tell us the content is wrong,
+		// so only a hash which doesn't match is treated as
+		// corruption.
+		//
+		hasher := sha1.New()
+		_, err := io.Copy(hasher, &limitedReader{reader: reader, limiter: limiter})
+		reader.Close()
+
+		if err != nil {
+			fmt.Printf("\tObject %s could not be read: %s\n", id, err.Error())
+			result.Unreadable = append(result.Unreadable, id)
+			continue
+		}
+		result.Checked++
+
+		sum := hex.EncodeToString(hasher.Sum(nil))
+		if sum == id {
+			if verbose {
+				fmt.Printf("\tObject %s is OK\n", id)
+			}
+			continue
+		}
+
+		fmt.Printf("\tObject %s is corrupt, it has SHA1 %s\n", id, sum)
+
+		if storage.Quarantine(id, modified) {
+			result.Corrupt = append(result.Corrupt, id)
+		} else if when, ok := storage.Modified(id); ok && !when.Equal(modified) {
+			fmt.Printf("\tObject %s was replaced while it was checked\n", id)
+		} else {
+			fmt.Printf("\tFailed to quarantine %s\n", id)
+		}
+	}
+
+	return result
+}
+
+//
+// reportScrub shows the result of a scrub.
+//
+func reportScrub(result scrubResult, elapsed time.Duration) {
+	fmt.Printf("Scrub complete in %s: %d checked, %d skipped, %d unreadable, %d corrupt\n",
+		elapsed.Round(time.Millisecond), result.Checked, result.Skipped, len(result.Unreadable), len(result.Corrupt))
+
+	for _, id := range result.Unreadable {
+		fmt.Printf("\tUnreadable: %s\n", id)
+	}
+
+	for _, id := range result.Corrupt {
+		fmt.Printf("\tQuarantined: %s\n", id)
+	}
+	if len(result.Corrupt) > 0 {
+		fmt.Printf("Run `sos replicate` to restore good copies from other group members.\n")
+	}
+}
+
+//
+// scrubLoop scrubs the given storage forever, pausing for the given
+// interval between runs.
+//
+// This is launched in the background by the blob-server.
+//
+func scrubLoop(storage StorageHandler, interval time.Duration, limiter *rateLimiter) {
+	for {
+		time.Sleep(interval)
+
+		start := time.Now()
+		result := scrubStorage(storage, limiter, false)
+		reportScrub(result, time.Since(start))
+	}
+}
+
+// scrub is the entry-point to this sub-command.
+func scrub(options scrubCmd) error {
+
+	//
+	// Parse the rate, if any.
+	//
+	rate, err := parseRate(options.rate)
+	if err != nil {
+		return err
+	}
+
+	//
+	// Open the storage.
+	//
+	storage := new(FilesystemStorage)
+	storage.Setup(options.store)
+
+	//
+	// Scrub it.
+	//
+	start := time.Now()
+	result := scrubStorage(storage, newRateLimiter(rate), options.verbose)
+	reportScrub(result, time.Since(start))
+
+	return nil
+}
@@ -0,0 +1,138 @@
+//
+// Test our scrubbing of storage.
+//
+
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+//
+// Test that corrupt objects are found, and quarantined.
+//
+func TestScrub(t *testing.T) {
+
+	//
+	// Create a temporary directory.
+	//
+	p, _ := ioutil.TempDir("tmp", "prefix")
+
+	//
+	// Init the filesystem storage-class
+	//
+	storage := new(FilesystemStorage)
+	storage.Setup(p)
+
+	//
+	// Store a good object, a corrupted one, and one which isn't
+	// content-addressed at all.
+	//
+	good := fmt.Sprintf("%x", sha1.Sum([]byte("good")))
+	bad := fmt.Sprintf("%x", sha1.Sum([]byte("bad")))
+
+	storage.Store(good, strings.NewReader("good"), nil)
+	storage.Store(bad, strings.NewReader("rotten"), nil)
+	storage.Store("steve", strings.NewReader("steve"), nil)
+
+	//
+	// Scrub
+	//
+	result := scrubStorage(storage, nil, false)
+
+	if result.Checked != 2 {
+		t.Errorf("Expected two objects to be checked, got %d", result.Checked)
+	}
+	if result.Skipped != 1 {
+		t.Errorf("Expected one object to be skipped, got %d", result.Skipped)
+	}
+	if len(result.Corrupt) != 1 || result.Corrupt[0] != bad {
+		t.Errorf("Unexpected corruption report: %v", result.Corrupt)
+	}
+
+	//
+	// The bad object should have gone, the rest remain.
+	//
+	if storage.Exists(bad) {
+		t.Errorf("Corrupt object was not quarantined")
+	}
+	if !storage.Exists(good) || !storage.Exists("steve") {
+		t.Errorf("Valid object was quarantined")
+	}
+
+	//
+	// A second scrub finds nothing new.
+	//
+	result = scrubStorage(storage, nil, false)
+	if len(result.Corrupt) != 0 {
+		t.Errorf("Unexpected corruption report: %v", result.Corrupt)
+	}
+
+	//
+	// Cleanup
+	//
+	os.RemoveAll(p)
+}
+
+//
+// unreadableObject returns an error when it is read, as a failing disk
+// would.
+//
+type unreadableObject struct {
+	io.ReadSeekCloser
+}
+
+func (u unreadableObject) Read(p []byte) (int, error) {
+	return 0, errors.New("input/output error")
+}
+
+//
+// failingStorage is a storage-class which fails to read one object.
+//
+type failingStorage struct {
+	*FilesystemStorage
+	broken string
+}
+
+func (f failingStorage) Get(id string) (io.ReadSeekCloser, map[string]string) {
+	reader, params := f.FilesystemStorage.Get(id)
+	if reader != nil && id == f.broken {
+		return unreadableObject{reader}, params
+	}
+	return reader, params
+}
+
+//
+// Test that objects which can't be read are reported, rather than being
+// quarantined.
+//
+func TestScrubReadError(t *testing.T) {
+
+	p, _ := ioutil.TempDir("tmp", "prefix")
+	defer os.RemoveAll(p)
+
+	fss := new(FilesystemStorage)
+	fss.Setup(p)
+
+	id := fmt.Sprintf("%x", sha1.Sum([]byte("content")))
+	fss.Store(id, strings.NewReader("content"), nil)
+
+	result := scrubStorage(failingStorage{FilesystemStorage: fss, broken: id}, nil, false)
+
+	if len(result.Unreadable) != 1 || result.Unreadable[0] != id {
+		t.Errorf("Unexpected unreadable report: %v", result.Unreadable)
+	}
+	if len(result.Corrupt) != 0 || result.Checked != 0 {
+		t.Errorf("Unreadable object was checked: %+v", result)
+	}
+	if !fss.Exists(id) {
+		t.Errorf("Unreadable object was quarantined")
+	}
+}
@@ -0,0 +1,171 @@
+//
+// The code in this file tracks the space available upon each of our
+// blob-servers, so that uploads may be placed sensibly.
+//
+// The api-server periodically polls each blob-server's `/stats`
+// end-point and records the result here.  Uploads are then directed
+// to the emptiest group, and groups which are close to being full are
+// skipped entirely.
+//
+// Downloads are unaffected: a full group still holds its content.
+//
+
+package libconfig
+
+import (
+	"sort"
+)
+
+// Capacity records the space which a blob-server reported as being
+// available, in bytes.
+type Capacity struct {
+	Free  uint64
+	Total uint64
+}
+
+//
+// SetCapacity records the capacity of the given blob-server.
+//
+func (c *Config) SetCapacity(location string, capacity Capacity) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.capacity[location] = capacity
+}
+
+//
+// ForgetCapacity discards the capacity of the given blob-server, for
+// example because it could not be contacted.
+//
+func (c *Config) ForgetCapacity(location string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.capacity, location)
+}
+
+//
+// SetMinFree sets the free-space threshold, in bytes, below which a
+// group will not be used for uploads.
+//
+func (c *Config) SetMinFree(bytes uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.minFree = bytes
+}
+
+//
+// groupCapacity returns the capacity of the given group, and whether
+// it is known.
+//
+// Since every member of a group holds the same content the group is
+// only as large as its fullest member.
+//
+// The caller must hold our lock.
+//
+func (c *Config) groupCapacity(members []BlobServer) (Capacity, bool) {
+	var result Capacity
+	known := false
+
+	for _, member := range members {
+		capacity, ok := c.capacity[member.Location]
+		if !ok {
+			continue
+		}
+		if !known || capacity.Free < result.Free {
+			result = capacity
+		}
+		known = true
+	}
+	return result, known
+}
+
+//
+// UploadServers returns a priority-ordered list of servers which will be
+// used for uploads.
+//
+// This is similar to OrderedServers, we take the first server from each
+// group, then the second server from each group, etc.  However the
+// groups are ordered such that the emptiest comes first, and any group
+// with less than the minimum free-space is omitted.
+//
+// Groups whose capacity is unknown are placed after those we know
+// about, so when no capacity has been recorded the result is identical
+// to that of OrderedServers.
+//
+// As with OrderedServers any server which is down is omitted, as are
+// read-only servers and groups which aren't writable.
+//
+func (c *Config) UploadServers() []BlobServer {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	groups, members := groupsOf(c.prefer(c.writable(c.available(c.servers))))
+
+	//
+	// Find the capacity of each group, skipping those which
+	// are too full.
+	//
+	type candidate struct {
+		name  string
+		free  float64
+		known bool
+	}
+	var candidates []candidate
+	for _, name := range groups {
+		capacity, known := c.groupCapacity(members[name])
+		if known && capacity.Free < c.minFree {
+			continue
+		}
+
+		free := 0.0
+		if capacity.Total > 0 {
+			free = float64(capacity.Free) / float64(capacity.Total)
+		}
+		candidates = append(candidates, candidate{name: name, free: free, known: known})
+	}
+
+	//
+	// The emptiest groups come first, then those we know
+	// nothing about.
+	//
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].known != candidates[j].known {
+			return candidates[i].known
+		}
+		return candidates[i].free > candidates[j].free
+	})
+
+	var order []string
+	for _, candidate := range candidates {
+		order = append(order, candidate.name)
+	}
+	return interleave(order, members)
+}
+
+//
+// HashedUploadServers returns a priority-ordered list of servers which
+// will be used to upload the given ID, when placing objects by hash.
+//
+// This is the output of HashedServers, with any group that has less than
+// the minimum free-space, or which isn't writable, omitted along with any
+// read-only servers.  If the preferred group is full the
+// object will be stored in the next group which downloads will try.
+//
+func (c *Config) HashedUploadServers(id string) []BlobServer {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	groups, members := groupsOf(c.prefer(c.writable(c.available(c.servers))))
+
+	var order []string
+	for _, name := range RankGroups(groups, id) {
+		capacity, known := c.groupCapacity(members[name])
+		if known && capacity.Free < c.minFree {
+			continue
+		}
+		order = append(order, name)
+	}
+	return preferGroup(order, members)
+}
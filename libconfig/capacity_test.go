@@ -0,0 +1,66 @@
+package libconfig
+
+import (
+	"testing"
+)
+
+//
+// Test that uploads are directed according to the capacity of each group.
+//
+func TestUploadServers(t *testing.T) {
+
+	config := New()
+	for _, s := range []BlobServer{
+		{Location: "a1", Group: "a"},
+		{Location: "a2", Group: "a"},
+		{Location: "b1", Group: "b"},
+		{Location: "b2", Group: "b"},
+		{Location: "c1", Group: "c"},
+	} {
+		config.AddServer(s.Group, s.Location)
+	}
+
+	order := func() string {
+		res := ""
+		for _, s := range config.UploadServers() {
+			res += s.Location + " "
+		}
+		return res
+	}
+
+	//
+	// With nothing known we match OrderedServers.
+	//
+	if out := order(); out != "a1 b1 c1 a2 b2 " {
+		t.Errorf("Unexpected order '%s'", out)
+	}
+
+	//
+	// The emptiest group comes first, and a group is as full
+	// as its fullest member.
+	//
+	config.SetCapacity("a1", Capacity{Free: 90, Total: 100})
+	config.SetCapacity("a2", Capacity{Free: 10, Total: 100})
+	config.SetCapacity("b1", Capacity{Free: 50, Total: 100})
+	if out := order(); out != "b1 a1 c1 b2 a2 " {
+		t.Errorf("Unexpected order '%s'", out)
+	}
+
+	//
+	// Full groups are skipped, those we know nothing about
+	// are not.
+	//
+	config.SetMinFree(20)
+	if out := order(); out != "b1 c1 b2 " {
+		t.Errorf("Unexpected order '%s'", out)
+	}
+
+	//
+	// Forgetting a server means its group is no longer skipped,
+	// since we know nothing about it.
+	//
+	config.ForgetCapacity("a2")
+	if out := order(); out != "a1 b1 c1 a2 b2 " {
+		t.Errorf("Unexpected order '%s'", out)
+	}
+}
@@ -0,0 +1,88 @@
+//
+// The code in this file tracks which of our blob-servers are down, so
+// that requests are not sent to them.
+//
+// The api-server's health-checker marks servers as being down, or up,
+// and those which are down are omitted from the lists of servers we use
+// for uploads and downloads.
+//
+// If every server is down then it is more likely that we've lost our
+// own network connection, or that the checks are failing for some other
+// reason, than that every server really is down.  In that case we carry
+// on using all of them, rather than failing every request until they're
+// marked up again.
+//
+
+package libconfig
+
+//
+// MarkDown records that the given blob-server is down.
+//
+func (c *Config) MarkDown(location string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.down[location] = true
+}
+
+//
+// MarkUp records that the given blob-server is up.
+//
+func (c *Config) MarkUp(location string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.down, location)
+}
+
+//
+// IsDown returns true if the given blob-server has been marked as down.
+//
+func (c *Config) IsDown(location string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.down[location]
+}
+
+//
+// PruneDown forgets any blob-server which has been marked as down, but
+// which is no longer part of our configuration.
+//
+// This is called after our configuration is reloaded, so that a server
+// which is removed, then later added again, isn't still treated as down.
+//
+func (c *Config) PruneDown() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	known := make(map[string]bool)
+	for _, entry := range c.servers {
+		known[entry.Location] = true
+	}
+	for location := range c.down {
+		if !known[location] {
+			delete(c.down, location)
+		}
+	}
+}
+
+//
+// available returns the given servers, omitting any which are down.
+//
+// If every server is down they're all returned.
+//
+// The caller must hold our lock.
+//
+func (c *Config) available(list []BlobServer) []BlobServer {
+	var res []BlobServer
+	for _, entry := range list {
+		if !c.down[entry.Location] {
+			res = append(res, entry)
+		}
+	}
+	if len(res) == 0 {
+		return list
+	}
+	return res
+}
@@ -0,0 +1,66 @@
+package libconfig
+
+import (
+	"testing"
+)
+
+//
+// Test that servers which are down are omitted.
+//
+func TestAvailable(t *testing.T) {
+
+	config, err := NewFromString("[a]\n-: http://a1\n-: http://a2\n[b]\n-: http://b1\n")
+	if err != nil {
+		t.Fatalf("Failed to parse configuration %s", err.Error())
+	}
+
+	config.MarkDown("http://a1")
+	config.MarkDown("http://b1")
+	config.MarkUp("http://b1")
+
+	for _, list := range [][]BlobServer{config.OrderedServers(), config.UploadServers(), config.HashedServers("obj")} {
+		if len(list) != 2 {
+			t.Errorf("Unexpected servers %v", list)
+		}
+		for _, s := range list {
+			if s.Location == "http://a1" {
+				t.Errorf("Down server was returned")
+			}
+		}
+	}
+
+	if !config.IsDown("http://a1") || config.IsDown("http://b1") {
+		t.Errorf("Unexpected health")
+	}
+
+	//
+	// If everything is down then everything is used.
+	//
+	config.MarkDown("http://a2")
+	config.MarkDown("http://b1")
+	if len(config.OrderedServers()) != 3 || len(config.UploadServers()) != 3 || len(config.HashedServers("obj")) != 3 {
+		t.Errorf("Servers weren't used when all were down")
+	}
+}
+
+//
+// Test that servers which are no longer configured are forgotten.
+//
+func TestPruneDown(t *testing.T) {
+
+	config, err := NewFromString("[a]\n-: http://a1\n")
+	if err != nil {
+		t.Fatalf("Failed to parse configuration %s", err.Error())
+	}
+
+	config.MarkDown("http://a1")
+	config.MarkDown("http://removed")
+	config.PruneDown()
+
+	if !config.IsDown("http://a1") {
+		t.Errorf("Configured server was forgotten")
+	}
+	if config.IsDown("http://removed") {
+		t.Errorf("Removed server is still down")
+	}
+}
@@ -24,13 +24,33 @@
 //
 // See `SCALING.md` for the rationale behind this setup.
 //
+// Each server may be followed by attributes, and each group may have
+// settings of its own:
+//
+//  [3]
+//  replicas = 2
+//  writable = false
+//  -: http://node3.example.com:1234/ weight=2 zone=rack1 max-conns=64
+//  -: http://mirror3-1.example.com:1234/ readonly zone=rack2
+//
+// The servers, along with what we've learned about them at runtime, are
+// held in a `Config` object.  Each is independent, and safe for use by
+// multiple goroutines.
+//
 
 package libconfig
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/go-ini/ini"
 )
@@ -41,30 +61,204 @@ import (
 //
 //  *  A location (host:port).
 //  *  A group to which it belongs.
+//  *  Optional attributes, which affect how it is used.
 //
 type BlobServer struct {
 	Location string
 	Group    string
+
+	// Weight is the preference for this server over the other
+	// members of its group, higher weights are tried first.
+	Weight int
+
+	// ReadOnly is true if the server should receive no new
+	// objects, for example because it is being drained.
+	ReadOnly bool
+
+	// Zone is the zone, or rack, in which the server lives.
+	Zone string
+
+	// MaxConns is the maximum number of concurrent requests the
+	// server should receive, or zero if there is no limit.
+	MaxConns int
+}
+
+// GroupSettings holds the settings of a group of blob-servers.
+type GroupSettings struct {
+
+	// Replicas is the number of members to which uploads must be
+	// written before they succeed, or zero to use the default.
+	Replicas int
+
+	// Writable is false if the group should receive no uploads.
+	Writable bool
+}
+
+// Config holds a list of blob-servers, along with their state.
+type Config struct {
+
+	//
+	// The list of servers we've identified.
+	//
+	// This is replaced, rather than modified in place, when it
+	// changes.  So a caller which has retrieved the list may keep
+	// using it, and will have a consistent view, even if the
+	// configuration is reloaded.
+	//
+	servers []BlobServer
+
+	//
+	// The settings of each group which has any, by name.
+	//
+	groups map[string]GroupSettings
+
+	//
+	// The zone in which we're running, if known.
+	//
+	zone string
+
+	//
+	// The files we were loaded from, if any.
+	//
+	files []string
+
+	//
+	// The capacity of each blob-server we've heard from, by
+	// location, and the free-space below which a group won't
+	// receive uploads.
+	//
+	capacity map[string]Capacity
+	minFree  uint64
+
+	//
+	// The servers which are down, by location.
+	//
+	down map[string]bool
+
+	//
+	// lock protects the state above.
+	//
+	lock sync.RWMutex
+}
+
+//
+// New creates a new, empty, configuration.
+//
+func New() *Config {
+	return &Config{
+		capacity: make(map[string]Capacity),
+		down:     make(map[string]bool),
+	}
 }
 
 //
-// The list of servers we've identified.
+// NewFromFiles creates a configuration holding the servers defined in the
+// given files.
 //
-var servers []BlobServer
+// Files which don't exist are ignored, if any file is invalid an error is
+// returned.
+//
+func NewFromFiles(files ...string) (*Config, error) {
+	c := New()
+	c.files = files
+
+	list, groups, err := loadFiles(files)
+	if err != nil {
+		return nil, err
+	}
+	c.servers = list
+	c.groups = groups
+	return c, nil
+}
+
+//
+// NewFromString creates a configuration holding the servers defined in
+// the given string, which has the same format as a configuration file.
+//
+func NewFromString(content string) (*Config, error) {
+	list, groups, err := parseServers("config", []byte(content))
+	if err != nil {
+		return nil, err
+	}
+
+	c := New()
+	c.servers = list
+	c.groups = groups
+	return c, nil
+}
+
+//
+// NewFromFlag creates a configuration holding the servers listed in the
+// given comma-separated string, as supplied upon the command-line.
+//
+// These servers are placed in the "default" group.
+//
+func NewFromFlag(value string) (*Config, error) {
+	c := New()
+
+	for _, entry := range strings.Split(value, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		server, err := parseServer("command-line", "default", entry)
+		if err != nil {
+			return nil, err
+		}
+		c.servers = append(c.servers, server)
+	}
+	return c, nil
+}
 
 //
 // Servers returns the list of servers we've discovered.
 //
-func Servers() []BlobServer {
-	return (servers)
+func (c *Config) Servers() []BlobServer {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return (c.servers)
+}
+
+//
+// Snapshot returns a copy of the configuration, as it stands now.
+//
+// Each of our methods takes the lock separately, so a caller which uses
+// several of them, such as Servers and then GroupSettings, might see the
+// configuration change between the calls if it is reloaded.  Using a
+// snapshot instead gives a consistent view.
+//
+// The snapshot can't be reloaded, and changes made to it, such as the
+// servers which are down, aren't seen by the original.
+//
+func (c *Config) Snapshot() *Config {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	//
+	// The servers and groups are replaced, rather than
+	// modified in place, so they may be shared.
+	//
+	s := New()
+	s.servers = c.servers
+	s.groups = c.groups
+	s.zone = c.zone
+	s.minFree = c.minFree
+	for location, capacity := range c.capacity {
+		s.capacity[location] = capacity
+	}
+	for location := range c.down {
+		s.down[location] = true
+	}
+	return s
 }
 
 //
 // Groups returns the name of each group we have defined.
 //
-func Groups() []string {
+func (c *Config) Groups() []string {
 	groups := []string{}
-	for _, entry := range servers {
+	for _, entry := range c.Servers() {
 		found := false
 		for _, a := range groups {
 			if entry.Group == a {
@@ -79,13 +273,40 @@ func Groups() []string {
 	return (groups)
 }
 
+//
+// GroupSettings returns the settings of the given group.
+//
+func (c *Config) GroupSettings(group string) GroupSettings {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	settings, ok := c.groups[group]
+	if !ok {
+		return GroupSettings{Writable: true}
+	}
+	return settings
+}
+
+//
+// SetZone records the zone in which we're running.
+//
+// Servers within the same zone are preferred over the other members of
+// their group.
+//
+func (c *Config) SetZone(zone string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.zone = zone
+}
+
 //
 // GroupMembers returns the members of the given group
 //
-func GroupMembers(group string) []BlobServer {
+func (c *Config) GroupMembers(group string) []BlobServer {
 	ret := []BlobServer{}
 
-	for _, entry := range servers {
+	for _, entry := range c.Servers() {
 		if entry.Group == group {
 			ret = append(ret, entry)
 		}
@@ -124,15 +345,22 @@ func GroupMembers(group string) []BlobServer {
 // than five.  Similar savings will add up when there are more groups and
 // servers.
 //
-func OrderedServers() []BlobServer {
+// Any server which has been marked as down is omitted, and within each
+// group the servers in our zone, and then those with the highest weight,
+// are placed first.
+//
+func (c *Config) OrderedServers() []BlobServer {
 	var res []BlobServer
 
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
 	//
-	// Create a copy of `servers`, the global list of all
-	// known blob-servers
+	// Create a copy of `servers`, the list of all
+	// known blob-servers, omitting any which are down and
+	// placing the preferred members of each group first.
 	//
-	tmp := make([]BlobServer, len(servers))
-	copy(tmp, servers)
+	tmp := c.prefer(c.available(c.servers))
 
 	//
 	// Get the names of each distinct group.
@@ -188,30 +416,170 @@ func OrderedServers() []BlobServer {
 }
 
 //
-// InitServers inititalizes our list of servers.
+// ConfigFiles returns the files from which our configuration is read,
+// by default.
+//
+func ConfigFiles() []string {
+	return []string{"/etc/sos.conf", os.ExpandEnv("$HOME/.sos.conf")}
+}
+
+//
+// loadFiles reads the servers from each of the given files.
 //
-func InitServers() {
-	ServersLoad("/etc/sos.conf")
-	ServersLoad(os.ExpandEnv("$HOME/.sos.conf"))
+func loadFiles(files []string) ([]BlobServer, map[string]GroupSettings, error) {
+	var all []BlobServer
+	groups := make(map[string]GroupSettings)
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, nil, err
+		}
+
+		list, settings, err := parseServers(file, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		all = append(all, list...)
+		for name, value := range settings {
+			groups[name] = value
+		}
+	}
+	return all, groups, nil
+}
+
+//
+// Reload replaces our list of servers with those read from the files we
+// were created from.
+//
+// If any file is invalid, or no servers are defined, an error is returned
+// and the existing servers are retained.
+//
+func (c *Config) Reload() error {
+	if len(c.files) == 0 {
+		return errors.New("the configuration was not loaded from a file")
+	}
+
+	list, groups, err := loadFiles(c.files)
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		return errors.New("no blob-servers are defined")
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.servers = list
+	c.groups = groups
+	return nil
 }
 
 //
 // AddServer adds an entry to our server-list.
 //
-func AddServer(group string, entry string) {
-	tmp := BlobServer{Location: entry, Group: group}
-	servers = append(servers, tmp)
+func (c *Config) AddServer(group string, entry string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	//
+	// We always create a new list, rather than appending to the
+	// one a caller might be using.
+	//
+	tmp := BlobServer{Location: entry, Group: group, Weight: 1}
+	c.servers = append(c.servers[:len(c.servers):len(c.servers)], tmp)
 }
 
 //
-// ServersLoad reads/parses the list of servers from the specified file.
+// validate ensures that the given blob-server location is a HTTP URL.
+//
+func validate(file string, group string, location string) error {
+	u, err := url.Parse(location)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s: invalid blob-server '%s' in group %s", file, location, group)
+	}
+	return nil
+}
+
 //
-func ServersLoad(file string) {
-	inFile, err := os.Open(file)
+// parseServer parses a single blob-server, which is a location followed
+// by any number of attributes:
+//
+//    http://node1.example.com:1234/ weight=2 readonly zone=rack1 max-conns=64
+//
+func parseServer(file string, group string, spec string) (BlobServer, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return BlobServer{}, fmt.Errorf("%s: empty blob-server in group %s", file, group)
+	}
+
+	server := BlobServer{Location: fields[0], Group: group, Weight: 1}
+	err := validate(file, group, server.Location)
 	if err != nil {
-		return
+		return server, err
 	}
-	defer inFile.Close()
+
+	for _, attr := range fields[1:] {
+		name, value := attr, ""
+		if i := strings.Index(attr, "="); i >= 0 {
+			name, value = attr[:i], attr[i+1:]
+		}
+
+		switch name {
+		case "readonly", "draining":
+			server.ReadOnly = true
+		case "zone":
+			server.Zone = value
+		case "weight", "max-conns":
+			n, nerr := strconv.Atoi(value)
+			if nerr != nil || n < 1 {
+				return server, fmt.Errorf("%s: invalid %s '%s' for blob-server '%s'", file, name, value, server.Location)
+			}
+			if name == "weight" {
+				server.Weight = n
+			} else {
+				server.MaxConns = n
+			}
+		default:
+			return server, fmt.Errorf("%s: unknown attribute '%s' for blob-server '%s'", file, attr, server.Location)
+		}
+	}
+	return server, nil
+}
+
+//
+// parseGroupSetting records the value of a group-setting, returning false
+// if the named key isn't one.
+//
+func parseGroupSetting(settings *GroupSettings, key *ini.Key) (bool, error) {
+	var err error
+
+	switch key.Name() {
+	case "replicas":
+		settings.Replicas, err = key.Int()
+		if err == nil && settings.Replicas < 1 {
+			err = errors.New("must be at least one")
+		}
+	case "writable":
+		settings.Writable, err = key.Bool()
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+//
+// parseServers parses the list of servers, and the settings of their
+// groups, from the given configuration, which was read from the named
+// file.
+//
+func parseServers(file string, data []byte) ([]BlobServer, map[string]GroupSettings, error) {
+	var result []BlobServer
+	groups := make(map[string]GroupSettings)
 
 	//
 	// Here we temporarily save the servers we've found.
@@ -229,7 +597,7 @@ func ServersLoad(file string) {
 	//
 	// Read the input-file line by line
 	//
-	scanner := bufio.NewScanner(inFile)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
 	scanner.Split(bufio.ScanLines)
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -259,9 +627,9 @@ func ServersLoad(file string) {
 		//
 		// Parse it as an INI-file
 		//
-		cfg, err := ini.Load(file)
+		cfg, err := ini.Load(data)
 		if err != nil {
-			panic(err)
+			return nil, nil, fmt.Errorf("%s: %s", file, err.Error())
 		}
 
 		//
@@ -276,17 +644,35 @@ func ServersLoad(file string) {
 				//  Get the keys.
 				//
 				keys := cfg.Section(name.Name()).Keys()
+				settings := GroupSettings{Writable: true}
 
 				for _, val := range keys {
 
+					//
+					// Some keys hold the settings of the
+					// group, rather than a server.
+					//
+					setting, serr := parseGroupSetting(&settings, val)
+					if serr != nil {
+						return nil, nil, fmt.Errorf("%s: invalid %s '%s' for group %s: %s", file, val.Name(), val.String(), name.Name(), serr.Error())
+					}
+					if setting {
+						continue
+					}
+
 					//
 					// For each entry add to the server-list.
 					//
-					AddServer(name.Name(), val.String())
+					server, perr := parseServer(file, name.Name(), val.String())
+					if perr != nil {
+						return nil, nil, perr
+					}
+					result = append(result, server)
 				}
+				groups[name.Name()] = settings
 			}
 		}
-		return
+		return result, groups, nil
 
 	}
 
@@ -296,8 +682,13 @@ func ServersLoad(file string) {
 	//
 	// We'll call the (anonymous) group "default".
 	for _, s := range tmp {
-		AddServer("default", s)
+		server, err := parseServer(file, "default", s)
+		if err != nil {
+			return nil, nil, err
+		}
+		result = append(result, server)
 	}
+	return result, groups, nil
 }
 
 //
@@ -305,14 +696,14 @@ func ServersLoad(file string) {
 //
 // func main() {
 //
-// 	InitServers()
+// 	config, _ := NewFromFiles(ConfigFiles()...)
 //
 // 	//
 // 	// Default, post-parse order
 // 	//
 // 	fmt.Printf("Default order:\n")
 // 	fmt.Printf("\t% 12s - %s\n", "group", "hosts" )
-// 	for _, entry := range Servers() {
+// 	for _, entry := range config.Servers() {
 // 		fmt.Printf("\t% 12s - %s\n", entry.group, entry.location)
 // 	}
 //
@@ -321,7 +712,7 @@ func ServersLoad(file string) {
 // 	//
 // 	fmt.Printf("Improved order:\n")
 // 	fmt.Printf("\t% 12s - %s\n", "group", "hosts" )
-// 	for _, entry := range OrderedServers() {
+// 	for _, entry := range config.OrderedServers() {
 // 		fmt.Printf("\t% 12s - %s\n", entry.group, entry.location)
 // 	}
 //
@@ -0,0 +1,222 @@
+package libconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//
+// Test parsing our configuration files.
+//
+func TestParseServers(t *testing.T) {
+
+	type TestCase struct {
+		content  string
+		expected string
+		valid    bool
+	}
+
+	tests := []TestCase{
+		{"http://one:3001\nhttp://two:3001\n", "default=http://one:3001,default=http://two:3001", true},
+		{"[a]\n-: http://one:3001\n[b]\n-: http://two:3001\n", "a=http://one:3001,b=http://two:3001", true},
+		{"[a]\n-: ftp://one:3001\n", "", false},
+		{"[a]\n-: one\n", "", false},
+		{"[a\n-: http://one:3001\n", "", false},
+		{"[a]\nreplicas = 2\n-: http://one:3001 weight=2 readonly\n", "a=http://one:3001", true},
+		{"http://one:3001 zone=r1 max-conns=3\n", "default=http://one:3001", true},
+		{"[a]\n-: http://one:3001 weight=0\n", "", false},
+		{"[a]\n-: http://one:3001 fast\n", "", false},
+		{"[a]\nreplicas = none\n-: http://one:3001\n", "", false},
+	}
+
+	for i, test := range tests {
+		config, err := NewFromString(test.content)
+		if (err == nil) != test.valid {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+		if err != nil {
+			continue
+		}
+
+		var out []string
+		for _, s := range config.Servers() {
+			out = append(out, s.Group+"="+s.Location)
+		}
+		if strings.Join(out, ",") != test.expected {
+			t.Errorf("test %d: unexpected servers %v", i, out)
+		}
+	}
+}
+
+//
+// Test parsing the attributes of servers and groups.
+//
+func TestAttributes(t *testing.T) {
+
+	config, err := NewFromString(`
+[a]
+replicas = 2
+writable = false
+-: http://one:3001 weight=3 readonly zone=r1 max-conns=8
+-: http://two:3001
+[b]
+-: http://three:3001 draining
+`)
+	if err != nil {
+		t.Fatalf("Failed to parse configuration %s", err.Error())
+	}
+
+	servers := config.Servers()
+	expected := []BlobServer{
+		{Location: "http://one:3001", Group: "a", Weight: 3, ReadOnly: true, Zone: "r1", MaxConns: 8},
+		{Location: "http://two:3001", Group: "a", Weight: 1},
+		{Location: "http://three:3001", Group: "b", Weight: 1, ReadOnly: true},
+	}
+	if len(servers) != len(expected) {
+		t.Fatalf("Unexpected servers %v", servers)
+	}
+	for i := range expected {
+		if servers[i] != expected[i] {
+			t.Errorf("server %d: got %+v, expected %+v", i, servers[i], expected[i])
+		}
+	}
+
+	if config.GroupSettings("a") != (GroupSettings{Replicas: 2, Writable: false}) {
+		t.Errorf("Unexpected settings %+v", config.GroupSettings("a"))
+	}
+	if config.GroupSettings("b") != (GroupSettings{Writable: true}) {
+		t.Errorf("Unexpected settings %+v", config.GroupSettings("b"))
+	}
+	if config.GroupSettings("missing") != (GroupSettings{Writable: true}) {
+		t.Errorf("Unexpected settings %+v", config.GroupSettings("missing"))
+	}
+}
+
+//
+// Test servers given upon the command-line.
+//
+func TestNewFromFlag(t *testing.T) {
+
+	config, err := NewFromFlag("http://one:3001, http://two:3001")
+	if err != nil || len(config.Servers()) != 2 || config.Groups()[0] != "default" {
+		t.Errorf("Unexpected result %v %v", config, err)
+	}
+
+	_, err = NewFromFlag("http://one:3001,two:3001")
+	if err == nil {
+		t.Errorf("Expected an error for an invalid server")
+	}
+}
+
+//
+// Test that each configuration is independent.
+//
+func TestIndependent(t *testing.T) {
+
+	a, _ := NewFromString("[a]\n-: http://one:3001\n-: http://two:3001\n")
+	b, _ := NewFromString("[b]\n-: http://two:3001\n-: http://three:3001\n")
+
+	a.MarkDown("http://two:3001")
+	if len(a.OrderedServers()) != 1 || len(b.OrderedServers()) != 2 {
+		t.Errorf("Unexpected servers %v %v", a.OrderedServers(), b.OrderedServers())
+	}
+	if len(b.GroupMembers("b")) != 2 || len(a.GroupMembers("b")) != 0 {
+		t.Errorf("Unexpected members")
+	}
+}
+
+//
+// Test reloading our configuration.
+//
+func TestReload(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "libconfig")
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "sos.conf")
+	ioutil.WriteFile(file, []byte("http://one:3001\n"), 0644)
+
+	//
+	// Missing files are ignored.
+	//
+	config, err := NewFromFiles(file, filepath.Join(dir, "missing"))
+	if err != nil || len(config.Servers()) != 1 {
+		t.Fatalf("Failed to load servers %v", err)
+	}
+	before := config.Servers()
+
+	//
+	// Reloading replaces the servers, without changing the list
+	// previously returned.
+	//
+	ioutil.WriteFile(file, []byte("[a]\n-: http://two:3001\n-: http://three:3001\n"), 0644)
+	err = config.Reload()
+	if err != nil || len(config.Servers()) != 2 || config.Servers()[0].Location != "http://two:3001" {
+		t.Errorf("Failed to reload servers %v %v", config.Servers(), err)
+	}
+	if len(before) != 1 || before[0].Location != "http://one:3001" {
+		t.Errorf("Previous list was modified %v", before)
+	}
+
+	//
+	// An invalid, or empty, configuration is rejected.
+	//
+	for _, content := range []string{"[a\n-: http://four:3001\n", ""} {
+		ioutil.WriteFile(file, []byte(content), 0644)
+		if config.Reload() == nil {
+			t.Errorf("Expected an error reloading '%s'", content)
+		}
+		if len(config.Servers()) != 2 {
+			t.Errorf("Servers changed after a failed reload %v", config.Servers())
+		}
+	}
+
+	//
+	// A configuration which didn't come from a file can't be
+	// reloaded.
+	//
+	if New().Reload() == nil {
+		t.Errorf("Expected an error reloading")
+	}
+}
+
+//
+// Test that a snapshot is unaffected by a reload, or by the servers
+// being marked as down.
+//
+func TestSnapshot(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "libconfig")
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "sos.conf")
+	ioutil.WriteFile(file, []byte("[a]\nreplicas = 2\n-: http://one:3001\n"), 0644)
+
+	config, err := NewFromFiles(file)
+	if err != nil {
+		t.Fatalf("Failed to load servers %v", err)
+	}
+	config.MarkDown("http://one:3001")
+	snapshot := config.Snapshot()
+
+	ioutil.WriteFile(file, []byte("[b]\n-: http://two:3001\n"), 0644)
+	if err = config.Reload(); err != nil {
+		t.Fatalf("Failed to reload %v", err)
+	}
+	config.MarkUp("http://one:3001")
+	snapshot.MarkDown("http://two:3001")
+
+	servers := snapshot.Servers()
+	if len(servers) != 1 || servers[0].Location != "http://one:3001" || snapshot.GroupSettings("a").Replicas != 2 {
+		t.Errorf("Snapshot changed by a reload %v", servers)
+	}
+	if !snapshot.IsDown("http://one:3001") || config.IsDown("http://two:3001") {
+		t.Errorf("Snapshot shares the servers which are down")
+	}
+	if snapshot.Reload() == nil {
+		t.Errorf("Expected an error reloading a snapshot")
+	}
+}
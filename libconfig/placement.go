@@ -0,0 +1,193 @@
+//
+// The code in this file decides which group an object belongs within,
+// when objects are placed by hash rather than by trying each group in
+// turn.
+//
+// We use rendezvous hashing: each group is given a score derived from
+// its name and the ID of the object, and the group with the highest
+// score is where the object lives.  Adding a group only moves those
+// objects which now score highest upon the new group, and removing one
+// only moves the objects it held.
+//
+
+package libconfig
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"sort"
+)
+
+//
+// groupsOf returns the names of the groups the given servers belong to,
+// in the order in which they first appear, along with the members of
+// each group.
+//
+func groupsOf(list []BlobServer) ([]string, map[string][]BlobServer) {
+	var groups []string
+	members := make(map[string][]BlobServer)
+
+	for _, entry := range list {
+		if _, ok := members[entry.Group]; !ok {
+			groups = append(groups, entry.Group)
+		}
+		members[entry.Group] = append(members[entry.Group], entry)
+	}
+	return groups, members
+}
+
+//
+// prefer returns a copy of the given servers in which, within each group,
+// the servers in our zone come first, followed by those with the highest
+// weight.  Otherwise the configured order is retained.
+//
+// The caller must hold our lock.
+//
+func (c *Config) prefer(list []BlobServer) []BlobServer {
+	local := func(s BlobServer) bool {
+		return c.zone != "" && s.Zone == c.zone
+	}
+
+	_, members := groupsOf(list)
+	for _, servers := range members {
+		sort.SliceStable(servers, func(i, j int) bool {
+			if local(servers[i]) != local(servers[j]) {
+				return local(servers[i])
+			}
+			return servers[i].Weight > servers[j].Weight
+		})
+	}
+
+	//
+	// Each position keeps its group, but now holds the next
+	// preferred member of that group.
+	//
+	res := make([]BlobServer, len(list))
+	next := make(map[string]int)
+	for i, entry := range list {
+		res[i] = members[entry.Group][next[entry.Group]]
+		next[entry.Group]++
+	}
+	return res
+}
+
+//
+// writable returns the given servers, omitting any which are read-only
+// or belong to a group which isn't writable.
+//
+// The caller must hold our lock.
+//
+func (c *Config) writable(list []BlobServer) []BlobServer {
+	var res []BlobServer
+	for _, entry := range list {
+		settings, ok := c.groups[entry.Group]
+		if entry.ReadOnly || (ok && !settings.Writable) {
+			continue
+		}
+		res = append(res, entry)
+	}
+	return res
+}
+
+//
+// interleave returns the first server from each of the given groups,
+// then the second server from each group, and so on.
+//
+func interleave(groups []string, members map[string][]BlobServer) []BlobServer {
+	var res []BlobServer
+
+	for i := 0; ; i++ {
+		added := false
+		for _, name := range groups {
+			if i < len(members[name]) {
+				res = append(res, members[name][i])
+				added = true
+			}
+		}
+		if !added {
+			break
+		}
+	}
+	return res
+}
+
+//
+// score returns the rendezvous-hash score of the given group for the
+// given ID.
+//
+func score(group string, id string) uint64 {
+	sum := sha1.Sum([]byte(group + "\x00" + id))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+//
+// RankGroups returns the given groups ordered by their preference for
+// holding the given ID.
+//
+// The first group returned is where the object belongs, the remainder
+// are where it would be placed if that group were unavailable.
+//
+func RankGroups(groups []string, id string) []string {
+	ranked := make([]string, len(groups))
+	copy(ranked, groups)
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := score(ranked[i], id), score(ranked[j], id)
+		if a != b {
+			return a > b
+		}
+		return ranked[i] < ranked[j]
+	})
+	return ranked
+}
+
+//
+// preferGroup returns every member of the first of the given groups,
+// followed by the remaining groups interleaved.
+//
+func preferGroup(groups []string, members map[string][]BlobServer) []BlobServer {
+	if len(groups) == 0 {
+		return nil
+	}
+
+	var res []BlobServer
+	res = append(res, members[groups[0]]...)
+	return append(res, interleave(groups[1:], members)...)
+}
+
+//
+// HashedServers returns a priority-ordered list of servers which will be
+// used to access the given ID, when placing objects by hash.
+//
+// The servers of the group which the ID belongs to come first, so that
+// a download will normally be satisfied by the first server we try.  The
+// remaining groups follow, in case the object was placed elsewhere.
+//
+// Objects are only placed within writable groups, so only those groups
+// are ranked, exactly as for HashedUploadServers.  Any other group is
+// tried last, since it may still hold objects placed before it stopped
+// being writable.
+//
+// Any server which is down is omitted, and the members of each group are
+// ordered as with OrderedServers.
+//
+func (c *Config) HashedServers(id string) []BlobServer {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	available := c.available(c.servers)
+	groups, members := groupsOf(c.prefer(available))
+	placed, _ := groupsOf(c.writable(available))
+
+	order := RankGroups(placed, id)
+	ranked := make(map[string]bool)
+	for _, name := range order {
+		ranked[name] = true
+	}
+	for _, name := range groups {
+		if !ranked[name] {
+			order = append(order, name)
+		}
+	}
+	return preferGroup(order, members)
+}
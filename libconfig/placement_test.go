@@ -0,0 +1,190 @@
+package libconfig
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+//
+// Test that objects are spread over groups, and that adding a group only
+// moves objects into the new group.
+//
+func TestRankGroups(t *testing.T) {
+
+	before := []string{"a", "b", "c"}
+	after := []string{"a", "b", "c", "d"}
+
+	count := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		id := fmt.Sprintf("object-%d", i)
+
+		old := RankGroups(before, id)[0]
+		now := RankGroups(after, id)[0]
+		count[old]++
+
+		if old != now && now != "d" {
+			t.Errorf("%s moved from %s to %s", id, old, now)
+		}
+
+		//
+		// The ranking doesn't depend upon the order in
+		// which the groups are given.
+		//
+		if RankGroups([]string{"c", "b", "a"}, id)[0] != old {
+			t.Errorf("%s was ranked differently", id)
+		}
+	}
+
+	for _, group := range before {
+		if count[group] < 800 || count[group] > 1200 {
+			t.Errorf("Group %s holds %d of 3000 objects", group, count[group])
+		}
+	}
+}
+
+//
+// Test that the group an object belongs within is tried first.
+//
+func TestHashedServers(t *testing.T) {
+
+	config := New()
+	for _, s := range []BlobServer{
+		{Location: "a1", Group: "a"},
+		{Location: "a2", Group: "a"},
+		{Location: "b1", Group: "b"},
+		{Location: "b2", Group: "b"},
+		{Location: "c1", Group: "c"},
+	} {
+		config.AddServer(s.Group, s.Location)
+	}
+
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("object-%d", i)
+		ranked := RankGroups([]string{"a", "b", "c"}, id)
+
+		list := config.HashedServers(id)
+		if len(list) != len(config.Servers()) {
+			t.Fatalf("Expected every server, got %v", list)
+		}
+		if list[0].Group != ranked[0] || list[len(list)-1].Location == list[0].Location {
+			t.Errorf("Unexpected order for %s: %v", id, list)
+		}
+		if ranked[0] != "c" && list[1].Group != ranked[0] {
+			t.Errorf("Expected both members of %s first: %v", ranked[0], list)
+		}
+	}
+
+	//
+	// Full groups aren't used for uploads.
+	//
+	config.SetMinFree(10)
+	config.SetCapacity("a1", Capacity{Free: 1, Total: 100})
+	for _, s := range config.HashedUploadServers("object") {
+		if s.Group == "a" {
+			t.Errorf("Full group used for upload")
+		}
+	}
+}
+
+//
+// Test that groups which aren't writable are tried last, since objects
+// are never placed within them.
+//
+func TestHashedServersReadOnly(t *testing.T) {
+
+	config, err := NewFromString(`
+[a]
+writable = false
+-: http://a1:3001
+[b]
+-: http://b1:3001
+-: http://b2:3001 readonly
+[c]
+-: http://c1:3001
+`)
+	if err != nil {
+		t.Fatalf("Failed to parse configuration %s", err.Error())
+	}
+
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("object-%d", i)
+
+		list := config.HashedServers(id)
+		uploads := config.HashedUploadServers(id)
+		if len(list) != 4 {
+			t.Fatalf("Expected every server, got %v", list)
+		}
+		if list[0].Group != uploads[0].Group {
+			t.Errorf("Downloads of %s try %s first, but uploads go to %s", id, list[0].Group, uploads[0].Group)
+		}
+		position := make(map[string]int)
+		for i, s := range list {
+			position[s.Location] = i
+		}
+		if position["http://a1:3001"] < position["http://b1:3001"] || position["http://a1:3001"] < position["http://c1:3001"] {
+			t.Errorf("Group which isn't writable wasn't tried last for %s: %v", id, list)
+		}
+	}
+}
+
+//
+// Test that the attributes of servers and groups affect their order.
+//
+func TestPreferences(t *testing.T) {
+
+	config, err := NewFromString(`
+[a]
+-: http://a1
+-: http://a2 weight=2
+-: http://a3 zone=here
+-: http://a4 readonly weight=5
+[b]
+writable = false
+-: http://b1
+[c]
+-: http://c1
+`)
+	if err != nil {
+		t.Fatalf("Failed to parse configuration %s", err.Error())
+	}
+
+	order := func(list []BlobServer) string {
+		res := ""
+		for _, s := range list {
+			res += strings.TrimPrefix(s.Location, "http://") + " "
+		}
+		return res
+	}
+
+	//
+	// Heavier servers come first, and read-only servers and
+	// groups are still used for downloads.
+	//
+	if out := order(config.OrderedServers()); out != "a4 b1 c1 a2 a1 a3 " {
+		t.Errorf("Unexpected order '%s'", out)
+	}
+	if out := order(config.UploadServers()); out != "a2 c1 a1 a3 " {
+		t.Errorf("Unexpected upload order '%s'", out)
+	}
+
+	//
+	// Servers in our own zone come first of all.
+	//
+	config.SetZone("here")
+	if out := order(config.OrderedServers()); out != "a3 b1 c1 a4 a2 a1 " {
+		t.Errorf("Unexpected order '%s'", out)
+	}
+
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("object-%d", i)
+		for _, s := range config.HashedUploadServers(id) {
+			if s.Group == "b" || s.ReadOnly {
+				t.Errorf("Unexpected upload server %v", s)
+			}
+		}
+		if config.HashedServers(id)[0].Location == "http://a1" {
+			t.Errorf("Unexpected download order for %s", id)
+		}
+	}
+}
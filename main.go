@@ -22,7 +22,9 @@ func main() {
 
 	subcommands.Register(&apiServerCmd{}, "")
 	subcommands.Register(&blobServerCmd{}, "")
+	subcommands.Register(&rebalanceCmd{}, "")
 	subcommands.Register(&replicateCmd{}, "")
+	subcommands.Register(&scrubCmd{}, "")
 	subcommands.Register(&versionCmd{}, "")
 
 	flag.Parse()
@@ -0,0 +1,166 @@
+//
+// Rate-limiting for bulk data transfers.
+//
+// The scrubber, and the replicator, read every object we hold.  To
+// avoid saturating disks and networks they may be throttled to a given
+// number of bytes per second.
+//
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a simple token-bucket, which may be shared between
+// goroutines, limiting the number of bytes which may be consumed per
+// second.
+//
+// A nil rateLimiter imposes no limit.
+type rateLimiter struct {
+	sync.Mutex
+
+	// rate is the number of bytes we allow per second.
+	rate float64
+
+	// tokens is the number of bytes available, it may be negative
+	// if we've handed out more than we have.
+	tokens float64
+
+	// last is the time at which we last refilled the bucket.
+	last time.Time
+}
+
+//
+// newRateLimiter returns a limiter allowing the given number of bytes
+// per second, or nil if there should be no limit.
+//
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+//
+// wait blocks until the given number of bytes may be consumed.
+//
+func (r *rateLimiter) wait(n int) {
+	if r == nil {
+		return
+	}
+
+	r.Lock()
+
+	//
+	// Refill the bucket, allowing at most a second's worth
+	// of bytes to accumulate.
+	//
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	r.last = now
+
+	//
+	// Take what we need, and if that leaves us in debt work out
+	// how long it'll take to repay it.
+	//
+	r.tokens -= float64(n)
+	delay := time.Duration(0)
+	if r.tokens < 0 {
+		delay = time.Duration(-r.tokens / r.rate * float64(time.Second))
+	}
+	r.Unlock()
+
+	time.Sleep(delay)
+}
+
+//
+// limitedReader wraps a reader, such that reads from it are throttled
+// by the given rateLimiter.
+//
+type limitedReader struct {
+	reader  io.Reader
+	limiter *rateLimiter
+}
+
+//
+// Read implements the io.Reader interface.
+//
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.reader.Read(p)
+	l.limiter.wait(n)
+	return n, err
+}
+
+//
+// parseRate converts a human-readable rate, such as "50MB/s", into
+// a number of bytes per second.
+//
+// An empty string, or zero, means "unlimited".
+//
+func parseRate(rate string) (int64, error) {
+
+	//
+	// The "/s" suffix is optional.
+	//
+	str := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(rate)), "/S")
+
+	val, err := parseSize(str)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate '%s'", rate)
+	}
+	return val, nil
+}
+
+//
+// parseSize converts a human-readable size, such as "10GB", into a
+// number of bytes.
+//
+// An empty string means zero.
+//
+func parseSize(size string) (int64, error) {
+
+	str := strings.ToUpper(strings.TrimSpace(size))
+	if str == "" {
+		return 0, nil
+	}
+
+	//
+	// Find the multiplier, if any.
+	//
+	units := []struct {
+		suffix string
+		scale  int64
+	}{
+		{"GB", 1024 * 1024 * 1024},
+		{"MB", 1024 * 1024},
+		{"KB", 1024},
+		{"G", 1024 * 1024 * 1024},
+		{"M", 1024 * 1024},
+		{"K", 1024},
+		{"B", 1},
+	}
+
+	scale := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(str, unit.suffix) {
+			str = strings.TrimSuffix(str, unit.suffix)
+			scale = unit.scale
+			break
+		}
+	}
+
+	val, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil || val < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", size)
+	}
+	return int64(val * float64(scale)), nil
+}
@@ -0,0 +1,106 @@
+//
+// Test our rate-limiting helpers.
+//
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+//
+// Test parsing human-readable rates.
+//
+func TestParseRate(t *testing.T) {
+
+	type TestCase struct {
+		input  string
+		output int64
+	}
+
+	tests := []TestCase{
+		{"", 0},
+		{"0", 0},
+		{"1024", 1024},
+		{"10B/s", 10},
+		{"2k", 2048},
+		{"1KB/s", 1024},
+		{"50MB/s", 50 * 1024 * 1024},
+		{"1.5M", 1024 * 1024 * 3 / 2},
+		{"1gb/s", 1024 * 1024 * 1024},
+	}
+
+	for _, test := range tests {
+		out, err := parseRate(test.input)
+		if err != nil {
+			t.Errorf("Unexpected error parsing '%s': %s", test.input, err.Error())
+		}
+		if out != test.output {
+			t.Errorf("Parsing '%s' gave %d not %d", test.input, out, test.output)
+		}
+	}
+
+	//
+	// Bogus input should fail.
+	//
+	bogus := []string{"steve", "MB/s", "-3MB"}
+	for _, input := range bogus {
+		_, err := parseRate(input)
+		if err == nil {
+			t.Errorf("Expected an error parsing '%s'", input)
+		}
+	}
+}
+
+//
+// Test parsing human-readable sizes.
+//
+func TestParseSize(t *testing.T) {
+
+	out, err := parseSize("10GB")
+	if err != nil || out != 10*1024*1024*1024 {
+		t.Errorf("Parsing '10GB' gave %d %v", out, err)
+	}
+
+	//
+	// Sizes aren't rates.
+	//
+	_, err = parseSize("10GB/s")
+	if err == nil {
+		t.Errorf("Expected an error parsing a rate as a size")
+	}
+}
+
+//
+// Test that reads are throttled.
+//
+func TestRateLimiter(t *testing.T) {
+
+	//
+	// A nil limiter doesn't limit.
+	//
+	var limiter *rateLimiter
+	limiter.wait(1024 * 1024 * 1024)
+
+	//
+	// At 4096 bytes a second, with a second's worth available
+	// up front, reading 8192 bytes should take a second.
+	//
+	limiter = newRateLimiter(4096)
+	reader := &limitedReader{reader: bytes.NewReader(make([]byte, 8192)), limiter: limiter}
+
+	start := time.Now()
+	n, _ := io.Copy(ioutil.Discard, reader)
+	elapsed := time.Since(start)
+
+	if n != 8192 {
+		t.Errorf("Read %d bytes, not 8192", n)
+	}
+	if elapsed < 900*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("Unexpected duration for throttled read: %s", elapsed)
+	}
+}
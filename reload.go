@@ -0,0 +1,110 @@
+//
+// Reload our list of blob-servers, without restarting.
+//
+// The configuration files are re-read when we receive a SIGHUP, and
+// optionally whenever they change.  If the new configuration is invalid
+// an error is logged, and we keep using the servers we already had.
+//
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/skx/sos/libconfig"
+)
+
+//
+// loadConfig returns our blob-servers.
+//
+// If we received blob-servers on the command-line we use those, placing
+// them in the "default" group, otherwise they're read from our
+// configuration files.
+//
+func loadConfig(blob string) (*libconfig.Config, error) {
+	if blob != "" {
+		return libconfig.NewFromFlag(blob)
+	}
+	return libconfig.NewFromFiles(libconfig.ConfigFiles()...)
+}
+
+//
+// reloadServers re-reads our configuration files, logging the outcome.
+//
+// The health of any server which was removed is forgotten, including by
+// the given health-checker, if we have one.
+//
+func reloadServers(config *libconfig.Config, health *healthChecker) {
+	err := config.Reload()
+	if err != nil {
+		fmt.Printf("Failed to reload configuration, keeping existing blob-servers: %s\n", err.Error())
+		return
+	}
+
+	config.PruneDown()
+	if health != nil {
+		health.prune(config.Servers())
+	}
+
+	fmt.Printf("Reloaded configuration:\n")
+	fmt.Printf("\t% 10s - %s\n", "group", "server")
+	for _, entry := range config.Servers() {
+		fmt.Printf("\t% 10s - %s\n", entry.Group, entry.Location)
+	}
+}
+
+//
+// configModified returns the most recent modification-time of any of our
+// configuration files.
+//
+func configModified() time.Time {
+	var latest time.Time
+
+	for _, file := range libconfig.ConfigFiles() {
+		info, err := os.Stat(file)
+		if err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+//
+// reloadLoop reloads the given configuration whenever we receive a SIGHUP,
+// informing the given health-checker, if any.
+//
+// If the interval is non-zero we also check our configuration files at
+// that interval, and reload them if they've changed.
+//
+func reloadLoop(config *libconfig.Config, health *healthChecker, interval time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	modified := configModified()
+	for {
+		select {
+		case <-signals:
+			fmt.Printf("Received SIGHUP, reloading configuration\n")
+			modified = configModified()
+			reloadServers(config, health)
+
+		case <-tick:
+			if latest := configModified(); !latest.Equal(modified) {
+				fmt.Printf("Configuration changed, reloading\n")
+				modified = latest
+				reloadServers(config, health)
+			}
+		}
+	}
+}
@@ -0,0 +1,238 @@
+//
+// A pool of workers which carry out replication transfers.
+//
+// Rather than mirroring objects one at a time the replicator queues
+// each transfer to a bounded pool of workers, which is shared between
+// all the groups being synced.
+//
+// To avoid overwhelming any single blob-server the number of transfers
+// to each destination is capped, both by our command-line and by any
+// `max-conns` attribute the server has, and the total bandwidth used by
+// all the workers may be limited too.
+//
+
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/skx/sos/libconfig"
+)
+
+// transfer describes a single object which is to be mirrored.
+type transfer struct {
+	// src is the server holding the object.
+	src string
+
+	// dst is the server which is missing the object.
+	dst libconfig.BlobServer
+
+	// obj is the ID of the object.
+	obj string
+
+	// result is invoked with the outcome of the transfer.
+	//
+	// It is not invoked if the transfer was cancelled.
+	result func(ok bool)
+
+	// wg is marked as done once the transfer has been handled.
+	wg *sync.WaitGroup
+}
+
+// transferPool mirrors objects via a fixed number of workers.
+type transferPool struct {
+	sync.Mutex
+
+	// ctx is used to cancel pending transfers.
+	ctx context.Context
+
+	// options holds our configuration.
+	options replicateCmd
+
+	// limiter is shared between all our workers.
+	limiter *rateLimiter
+
+	// ready is signalled when a transfer is queued, or finishes,
+	// or the pool is closed, so that idle workers look for work.
+	ready *sync.Cond
+
+	// queues holds the queued transfers to each destination.
+	queues map[string][]transfer
+
+	// order holds the destinations which have queued transfers,
+	// in the order they should next be considered.
+	order []string
+
+	// active holds the number of transfers to each destination
+	// which are in progress.
+	active map[string]int
+
+	// closed is true once no more transfers will be queued.
+	closed bool
+
+	// workers is used to wait for our workers to terminate.
+	workers sync.WaitGroup
+}
+
+//
+// newTransferPool creates a pool, and launches its workers.
+//
+func newTransferPool(ctx context.Context, options replicateCmd, limiter *rateLimiter) *transferPool {
+	workers := options.workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	pool := &transferPool{
+		ctx:     ctx,
+		options: options,
+		limiter: limiter,
+		queues:  make(map[string][]transfer),
+		active:  make(map[string]int),
+	}
+	pool.ready = sync.NewCond(pool)
+
+	for i := 0; i < workers; i++ {
+		pool.workers.Add(1)
+		go pool.worker()
+	}
+	return pool
+}
+
+//
+// submit queues a transfer.
+//
+// Each destination has its own queue, so that transfers to a slow
+// destination can't hold up those to any other.  The queues aren't
+// bounded, but a transfer is far smaller than the listing of objects
+// which led to it being queued.
+//
+func (p *transferPool) submit(t transfer) {
+	t.wg.Add(1)
+
+	p.Lock()
+	if _, ok := p.queues[t.dst.Location]; !ok {
+		p.order = append(p.order, t.dst.Location)
+	}
+	p.queues[t.dst.Location] = append(p.queues[t.dst.Location], t)
+	p.Unlock()
+
+	p.ready.Signal()
+}
+
+//
+// close waits for all queued transfers to complete, and terminates
+// the workers.
+//
+func (p *transferPool) close() {
+	p.Lock()
+	p.closed = true
+	p.Unlock()
+
+	p.ready.Broadcast()
+	p.workers.Wait()
+}
+
+//
+// limit returns the number of concurrent transfers allowed to the given
+// destination, or zero if there is no cap.
+//
+func (p *transferPool) limit(dst libconfig.BlobServer) int {
+	limit := p.options.perDestination
+	if dst.MaxConns > 0 && (limit < 1 || dst.MaxConns < limit) {
+		limit = dst.MaxConns
+	}
+	if limit < 1 {
+		return 0
+	}
+	return limit
+}
+
+//
+// next waits for a transfer whose destination has capacity, and removes
+// it from its queue.
+//
+// The second value is false once the pool is closed and every transfer
+// has been handled.
+//
+func (p *transferPool) next() (transfer, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	for {
+		for i, dst := range p.order {
+			queue := p.queues[dst]
+			t := queue[0]
+
+			//
+			// If we've been cancelled the transfer won't
+			// be made, so there's no need to wait.
+			//
+			limit := p.limit(t.dst)
+			if p.ctx.Err() == nil && limit > 0 && p.active[dst] >= limit {
+				continue
+			}
+
+			//
+			// Take the transfer, and move the destination to
+			// the back of the line, so that each destination
+			// gets its turn.
+			//
+			p.order = append(p.order[:i:i], p.order[i+1:]...)
+			if len(queue) > 1 {
+				p.queues[dst] = queue[1:]
+				p.order = append(p.order, dst)
+			} else {
+				delete(p.queues, dst)
+			}
+			p.active[dst]++
+			return t, true
+		}
+
+		if p.closed && len(p.order) == 0 {
+			return transfer{}, false
+		}
+		p.ready.Wait()
+	}
+}
+
+//
+// finish records that a transfer to the given destination is complete.
+//
+func (p *transferPool) finish(dst string) {
+	p.Lock()
+	p.active[dst]--
+	p.Unlock()
+
+	p.ready.Broadcast()
+}
+
+//
+// worker carries out queued transfers until the pool is closed.
+//
+func (p *transferPool) worker() {
+	defer p.workers.Done()
+
+	for {
+		t, ok := p.next()
+		if !ok {
+			return
+		}
+
+		//
+		// If we've been cancelled we just drain the queue.
+		//
+		if p.ctx.Err() != nil {
+			p.finish(t.dst.Location)
+			t.wg.Done()
+			continue
+		}
+
+		ok = MirrorObject(p.ctx, t.src, t.dst.Location, t.obj, p.limiter, p.options)
+		p.finish(t.dst.Location)
+
+		t.result(ok)
+		t.wg.Done()
+	}
+}
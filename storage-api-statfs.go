@@ -0,0 +1,32 @@
+// +build linux darwin freebsd
+
+package main
+
+import (
+	"syscall"
+)
+
+// diskUsage populates the given stats with the usage of the filesystem
+// holding the given directory.
+func diskUsage(directory string, stats *StorageStats) error {
+	var fs syscall.Statfs_t
+
+	err := syscall.Statfs(directory, &fs)
+	if err != nil {
+		return err
+	}
+
+	//
+	// Free space is that which is available to unprivileged
+	// users, rather than including any reserved blocks.
+	//
+	size := uint64(fs.Bsize)
+	stats.TotalBytes = uint64(fs.Blocks) * size
+	stats.FreeBytes = uint64(fs.Bavail) * size
+	stats.UsedBytes = (uint64(fs.Blocks) - uint64(fs.Bfree)) * size
+
+	stats.TotalInodes = uint64(fs.Files)
+	stats.FreeInodes = uint64(fs.Ffree)
+	stats.UsedInodes = stats.TotalInodes - stats.FreeInodes
+	return nil
+}
@@ -0,0 +1,15 @@
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import (
+	"errors"
+)
+
+// diskUsage populates the given stats with the usage of the filesystem
+// holding the given directory.
+//
+// This is not implemented upon this platform.
+func diskUsage(directory string, stats *StorageStats) error {
+	return errors.New("disk usage is not available upon this platform")
+}
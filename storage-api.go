@@ -15,17 +15,46 @@
 // We also allow (optional) meta-data to be written/retrieved alongside
 // the data.  The latter is saved as a JSON file, alongside the data.
 //
+// Rather than writing every blob into a single directory, which many
+// filesystems struggle with once there are millions of entries, the
+// filesystem-storage shards the blobs beneath two levels of directories
+// named after the prefix of the ID:
+//
+//     ab/cd/abcdef0123..
+//     ab/cd/abcdef0123...json
+//
+// Stores created before this layout was introduced are migrated the
+// first time they're opened.
+//
+// Writes are crash-safe: data and meta-data are written to temporary
+// files beneath `.tmp/`, flushed to disk, and then renamed into place.
+// The rename of the blob itself is the point at which an upload becomes
+// visible, so a crash can never leave a truncated blob behind.
+//
+// Blobs which are found to be corrupt are moved beneath `.quarantine/`
+// where they may be inspected.
+//
+// When a blob is deleted an empty tombstone is written beneath
+// `.tombstones/`, sharded in the same way, with its modification-time
+// set to the time of the deletion.  Tombstones are removed once they're
+// 30 days old.
+//
 
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 // StorageHandler is the interface for a storage class.
@@ -42,29 +71,118 @@ type StorageHandler interface {
 	//
 	// Retrieve the contents of a blob by ID.
 	//
+	// The content is returned as a reader, rather than being
+	// loaded into RAM, the caller is responsible for closing it.
+	//
 	// The fetch will also return any (optional)
 	// key=value parameters which were stored when
 	// the content was uploaded.
 	//
-	Get(id string) (*[]byte, map[string]string)
+	Get(id string) (io.ReadSeekCloser, map[string]string)
 
 	//
 	// Store some data against the given ID.
 	//
+	// The data is consumed from the given reader until EOF,
+	// so arbitrarily large objects may be stored without
+	// buffering them.
+	//
 	// If any optional `key=value` parameters have been
 	// sent then store them too, alongside the data.
 	//
-	Store(id string, data []byte, params map[string]string) bool
+	Store(id string, data io.Reader, params map[string]string) bool
 
 	//
 	// Get all known IDs.
 	//
 	Existing() []string
 
+	//
+	// Get a page of the known IDs, in order.
+	//
+	// At most `limit` IDs are returned, or all of them if
+	// that is zero.  Only IDs which sort after `after`, and
+	// which were stored after `since` are included.
+	//
+	List(after string, limit int, since time.Time) []string
+
 	//
 	// Does the given ID exist?
 	//
 	Exists(id string) bool
+
+	//
+	// When was the given ID stored?
+	//
+	// The second value is false if the ID doesn't exist.
+	//
+	Modified(id string) (time.Time, bool)
+
+	//
+	// Move the given ID aside, because its content has been
+	// found to be corrupt.
+	//
+	// Once quarantined the ID no longer exists, so replication
+	// will restore a good copy from another server.
+	//
+	// The ID is only moved if it was stored at the given time,
+	// so that a good copy which has replaced the corrupt one
+	// since it was found is left alone.
+	//
+	Quarantine(id string, modified time.Time) bool
+
+	//
+	// Delete the given ID.
+	//
+	// A tombstone is recorded, with the time of the deletion,
+	// so that replication doesn't restore the object from a
+	// server which missed the deletion.
+	//
+	// If the object was stored after the given time then it
+	// has been re-uploaded since it was deleted, so it is kept
+	// and false is returned.
+	//
+	Delete(id string, when time.Time) bool
+
+	//
+	// Get a page of the known tombstones, in order of their IDs.
+	//
+	// At most `limit` tombstones are returned, or all of them
+	// if that is zero.  Only IDs which sort after `after` are
+	// included.
+	//
+	Tombstones(after string, limit int) []Tombstone
+
+	//
+	// Report on the number of objects we hold, and the space
+	// which is available to store more.
+	//
+	Stats() (StorageStats, error)
+}
+
+// StorageStats describes the capacity of a storage-backend.
+type StorageStats struct {
+	// Objects is the number of objects stored.
+	Objects int64 `json:"objects"`
+
+	// The space used, free, and in total, in bytes.
+	UsedBytes  uint64 `json:"used_bytes"`
+	FreeBytes  uint64 `json:"free_bytes"`
+	TotalBytes uint64 `json:"total_bytes"`
+
+	// The inodes used, free, and in total.
+	UsedInodes  uint64 `json:"used_inodes"`
+	FreeInodes  uint64 `json:"free_inodes"`
+	TotalInodes uint64 `json:"total_inodes"`
+}
+
+// Tombstone records the deletion of an object.
+type Tombstone struct {
+	// ID is the ID of the object which was deleted.
+	ID string
+
+	// Deleted is the time of the deletion.
+	Deleted time.Time
 }
 
 // FilesystemStorage is a concrete type which implements
@@ -75,6 +193,360 @@ type FilesystemStorage struct {
 
 	// prefix holds our prefix directory if we didn't chroot
 	prefix string
+
+	// countLock protects our cached count of objects.
+	countLock sync.Mutex
+
+	// count holds the number of objects we found when we last
+	// counted them, at the time recorded in counted.
+	count   int64
+	counted time.Time
+
+	// counting is true while we're counting our objects.
+	counting bool
+
+	// meta holds our cluster metadata.
+	meta metaStore
+}
+
+//
+// shardPad is used to pad IDs which are too short to be sharded.
+//
+// It sorts before all of the characters which are valid in an ID,
+// which means that walking the shards in order returns the IDs in
+// order too.
+//
+const shardPad = "----"
+
+//
+// shard returns the two directory-names beneath which the given
+// ID is stored.
+//
+func shard(id string) (string, string) {
+	if len(id) < 4 {
+		id = id + shardPad[len(id):]
+	}
+	return id[0:2], id[2:4]
+}
+
+//
+// path returns the location of the given file, beneath our
+// data-directory.
+//
+// If we're not using the cwd we need to build up the complete
+// path to the file.
+//
+func (fss *FilesystemStorage) path(name ...string) string {
+	target := filepath.Join(name...)
+	if fss.cwd == false {
+		target = filepath.Join(fss.prefix, target)
+	}
+	return target
+}
+
+//
+// blobPath returns the sharded location of the given ID.
+//
+func (fss *FilesystemStorage) blobPath(id string) string {
+	a, b := shard(id)
+	return fss.path(a, b, id)
+}
+
+//
+// tombstonePath returns the sharded location of the tombstone of the
+// given ID, which is laid out beneath our tombstone-directory just as
+// blobs are beneath our data-directory.
+//
+func (fss *FilesystemStorage) tombstonePath(id string) string {
+	a, b := shard(id)
+	return fss.path(tombstoneDir, a, b, id)
+}
+
+//
+// isShard returns true if the given directory-entry is one of the
+// directories we create to hold shards.
+//
+func isShard(info os.FileInfo) bool {
+	return info.IsDir() && len(info.Name()) == 2
+}
+
+//
+// walk invokes the given function for each blob we hold, in order,
+// starting with the first ID which sorts after the given one.
+//
+// If the callback returns false the walk is terminated.
+//
+func (fss *FilesystemStorage) walk(after string, fn func(id string, info os.FileInfo) bool) {
+	fss.walkShards(".", after, fn)
+}
+
+//
+// walkShards invokes the given function for each file within the shards
+// beneath the given directory, in order, starting with the first which
+// sorts after the given ID.
+//
+func (fss *FilesystemStorage) walkShards(dir string, after string, fn func(id string, info os.FileInfo) bool) {
+
+	//
+	// The shards which hold the starting point, any shard which
+	// sorts before these cannot contain anything of interest.
+	//
+	first, second := "", ""
+	if after != "" {
+		first, second = shard(after)
+	}
+
+	top, _ := ioutil.ReadDir(fss.path(dir))
+	for _, a := range top {
+		if !isShard(a) || a.Name() < first {
+			continue
+		}
+
+		middle, _ := ioutil.ReadDir(fss.path(dir, a.Name()))
+		for _, b := range middle {
+			if !isShard(b) || (a.Name() == first && b.Name() < second) {
+				continue
+			}
+
+			files, _ := ioutil.ReadDir(fss.path(dir, a.Name(), b.Name()))
+			for _, f := range files {
+				name := f.Name()
+
+				if f.IsDir() || strings.HasSuffix(name, ".json") || name <= after {
+					continue
+				}
+				if !fn(name, f) {
+					return
+				}
+			}
+		}
+	}
+}
+
+//
+// migrate moves any blobs, and tombstones, which were written by older
+// releases, which kept everything in a single directory, into the sharded
+// layout.
+//
+func (fss *FilesystemStorage) migrate() {
+	fss.migrateDir(".", "blob")
+	fss.migrateDir(tombstoneDir, "tombstone")
+}
+
+//
+// migrateDir moves the files within the given directory into the shards
+// beneath it.  The given description of the files is used to report
+// what was moved.
+//
+func (fss *FilesystemStorage) migrateDir(dir string, what string) {
+
+	//
+	// Files written by older releases live in the top-level
+	// directory, alongside the shards.
+	//
+	files, _ := ioutil.ReadDir(fss.path(dir))
+
+	count := 0
+	for _, f := range files {
+		name := f.Name()
+
+		//
+		// Skip the shards themselves, and the meta-data which
+		// we'll move alongside the data it belongs to.
+		//
+		if f.IsDir() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		//
+		// A blob with a very short name might collide with the
+		// shard-directory it needs to be moved into, so we move
+		// those out of the way first.
+		//
+		// If we were interrupted during a previous migration we
+		// might find such a file waiting.
+		//
+		src := fss.path(dir, name)
+		id := strings.TrimSuffix(name, ".migrating")
+		if id == name && len(id) <= 2 {
+			src = fss.path(dir, id+".migrating")
+			if os.Rename(fss.path(dir, id), src) != nil {
+				continue
+			}
+		}
+
+		a, b := shard(id)
+		dst := fss.path(dir, a, b, id)
+		if os.MkdirAll(filepath.Dir(dst), 0755) != nil {
+			continue
+		}
+
+		//
+		// Move the meta-data first, so that the blob never
+		// appears without it.
+		//
+		if _, err := os.Stat(fss.path(dir, id+".json")); err == nil {
+			os.Rename(fss.path(dir, id+".json"), dst+".json")
+		}
+		if os.Rename(src, dst) == nil {
+			count++
+		}
+	}
+
+	if count > 0 {
+		fmt.Printf("Migrated %d %s(s) to the sharded storage layout\n", count, what)
+	}
+}
+
+//
+// tmpDir is the directory, beneath our data-directory, in which
+// uploads are written before being moved into place.
+//
+// This must live on the same filesystem as the blobs, so that the
+// final rename is atomic.
+//
+const tmpDir = ".tmp"
+
+//
+// tmpMaxAge is the age after which a temporary file is considered to
+// be orphaned.
+//
+// An upload which is in-progress will be constantly updating its
+// temporary file, but we don't want to remove it if another process,
+// such as `sos scrub`, opens the same data-directory.
+//
+const tmpMaxAge = time.Hour
+
+//
+// quarantineDir is the directory, beneath our data-directory, to which
+// corrupted blobs are moved.
+//
+const quarantineDir = ".quarantine"
+
+//
+// tombstoneDir is the directory, beneath our data-directory, in which
+// we record deletions.  It is sharded in the same way as our blobs.
+//
+const tombstoneDir = ".tombstones"
+
+//
+// tombstoneMaxAge is the age after which a tombstone is removed.
+//
+// A server which misses a deletion learns of it from the tombstones of
+// its peers, so replication must run, and every server must rejoin the
+// cluster, more often than this.  Otherwise a deleted object might be
+// restored from a server which still holds it.
+//
+const tombstoneMaxAge = 30 * 24 * time.Hour
+
+//
+// cleanupInterval is how often a blob-server repeats its cleanup.
+//
+const cleanupInterval = time.Hour
+
+//
+// countMaxAge is how long we cache the number of objects we hold for,
+// since counting them requires walking every shard.
+//
+const countMaxAge = 5 * time.Minute
+
+//
+// cleanup removes any temporary files which were left behind if we
+// crashed mid-upload, any multipart uploads which were abandoned, and
+// any tombstones which have expired.
+//
+func (fss *FilesystemStorage) cleanup() {
+	os.MkdirAll(fss.path(tmpDir), 0755)
+
+	files, _ := ioutil.ReadDir(fss.path(tmpDir))
+	for _, f := range files {
+		if time.Since(f.ModTime()) > tmpMaxAge {
+			os.RemoveAll(fss.path(tmpDir, f.Name()))
+		}
+	}
+
+	fss.cleanupUploads()
+
+	fss.walkShards(tombstoneDir, "", func(id string, info os.FileInfo) bool {
+		if time.Since(info.ModTime()) > tombstoneMaxAge {
+			os.Remove(fss.tombstonePath(id))
+		}
+		return true
+	})
+}
+
+//
+// cleanupLoop repeats our cleanup forever, since a blob-server might run
+// for far longer than the ages at which things are removed.
+//
+// This is launched in the background by the blob-server.
+//
+func (fss *FilesystemStorage) cleanupLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		fss.cleanup()
+	}
+}
+
+//
+// prepare gets the data-directory ready for use, once we know where
+// it lives.
+//
+func (fss *FilesystemStorage) prepare() {
+
+	//
+	// Remove any orphaned temporary files.
+	//
+	fss.cleanup()
+
+	//
+	// Move any blobs from an older, flat, layout into place.
+	//
+	fss.migrate()
+}
+
+//
+// writeTemp streams the given reader to a new temporary file, and
+// flushes it to disk.
+//
+// The name of the temporary file is returned, and it is the callers
+// responsibility to rename or remove it.
+//
+func (fss *FilesystemStorage) writeTemp(data io.Reader) (string, error) {
+	tmp, err := ioutil.TempFile(fss.path(tmpDir), "store-")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(tmp, data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	cerr := tmp.Close()
+	if err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+//
+// syncDir flushes the given directory to disk, so that any renames
+// carried out within it are durable.
+//
+// This isn't supported upon all platforms, so errors are ignored.
+//
+func syncDir(path string) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	dir.Sync()
+	dir.Close()
 }
 
 //
@@ -95,6 +567,7 @@ func (fss *FilesystemStorage) Setup(connection string) {
 	if flag.Lookup("test.v") != nil {
 		fss.cwd = false
 		fss.prefix = connection
+		fss.prepare()
 		return
 	}
 
@@ -114,21 +587,21 @@ func (fss *FilesystemStorage) Setup(connection string) {
 	//
 	fss.cwd = true
 
+	//
+	// Cleanup, and migrate, the data-directory.
+	//
+	fss.prepare()
 }
 
 //
 // Get the contents of a given ID.
 //
-func (fss *FilesystemStorage) Get(id string) (*[]byte, map[string]string) {
+func (fss *FilesystemStorage) Get(id string) (io.ReadSeekCloser, map[string]string) {
 
 	//
-	// If we're not using the cwd we need to build up the complete
-	// path to the file.
+	// Find the sharded location of the file.
 	//
-	target := id
-	if fss.cwd == false {
-		target = filepath.Join(fss.prefix, id)
-	}
+	target := fss.blobPath(id)
 
 	//
 	// If the file is missing we return nil.
@@ -138,9 +611,9 @@ func (fss *FilesystemStorage) Get(id string) (*[]byte, map[string]string) {
 	}
 
 	//
-	// Read the file contents
+	// Open the file, the caller will read from it.
 	//
-	x, err := ioutil.ReadFile(target)
+	x, err := os.Open(target)
 
 	// If there was an error return nil too.
 	if err != nil {
@@ -162,46 +635,56 @@ func (fss *FilesystemStorage) Get(id string) (*[]byte, map[string]string) {
 	//
 	if err == nil {
 		json.Unmarshal([]byte(metaData), &meta)
-		return &x, meta
+		return x, meta
 	}
 
 	//
 	// There was a failure to unmarshal the meta-data
 	// just return the actual data.
 	//
-	return &x, nil
+	return x, nil
 }
 
 //
 // Store the specified data against the given file.
 //
-func (fss *FilesystemStorage) Store(id string, data []byte, params map[string]string) bool {
+// The data, and any meta-data, are first written to temporary files
+// which are then renamed into place.  The blob is moved last, so it
+// only becomes visible once everything has been written successfully.
+//
+func (fss *FilesystemStorage) Store(id string, data io.Reader, params map[string]string) bool {
 
 	//
-	// If we're not using the cwd we need to build up the complete
-	// path to the file.
+	// Write out the data, streaming it from the reader.
 	//
-	target := id
-	if fss.cwd == false {
-		target = filepath.Join(fss.prefix, id)
+	blob, err := fss.writeTemp(data)
+	if err != nil {
+		return false
 	}
+	defer os.Remove(blob)
 
-	//
-	// Write out the data.
-	//
-	err := ioutil.WriteFile(target, data, 0644)
+	return fss.place(id, blob, params)
+}
+
+//
+// place moves the given temporary file into place as the given ID, along
+// with any meta-data.
+//
+// The temporary file must live beneath our data-directory, so that it
+// can be renamed into place.
+//
+func (fss *FilesystemStorage) place(id string, blob string, params map[string]string) bool {
 
 	//
-	// If there was an error we abort.
+	// Find the sharded location of the file.
 	//
-	if err != nil {
-		return false
-	}
+	target := fss.blobPath(id)
 
 	//
 	// If we received some optional parameters then write them
 	// out too.
 	//
+	meta := ""
 	if len(params) != 0 {
 
 		// Marshal to JSON.
@@ -209,23 +692,61 @@ func (fss *FilesystemStorage) Store(id string, data []byte, params map[string]st
 
 		//
 		// If there was an error marshalling the meta-data
-		// then our upload failed, even though the data
-		// was stored already..
+		// then our upload failed.
 		//
 		if err != nil {
 			return false
 		}
 
-		// Write out to a .json-suffixed file.
-		err = ioutil.WriteFile(target+".json", encoded, 0644)
+		// Write out to a temporary file.
+		meta, err = fss.writeTemp(bytes.NewReader(encoded))
 
-		// If the data was saved but the meta-data wasn't
-		// this is still a failure.
+		// If the meta-data couldn't be saved this is a failure.
 		if err != nil {
 			return false
 		}
+		defer os.Remove(meta)
 	}
 
+	//
+	// Ensure the shard-directory exists.
+	//
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return false
+	}
+
+	//
+	// Move the meta-data into place, or remove any stale meta-data
+	// if we weren't given any this time.
+	//
+	if meta != "" {
+		err = os.Rename(meta, target+".json")
+	} else {
+		err = os.Remove(target + ".json")
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return false
+	}
+
+	//
+	// Finally move the data into place, which commits the upload.
+	//
+	err = os.Rename(blob, target)
+	if err != nil {
+		return false
+	}
+	syncDir(filepath.Dir(target))
+
+	//
+	// If the object had previously been deleted then it has now
+	// been uploaded again, so the tombstone is no longer valid.
+	//
+	os.Remove(fss.tombstonePath(id))
+
 	//
 	// Data written.
 	//
@@ -237,44 +758,201 @@ func (fss *FilesystemStorage) Store(id string, data []byte, params map[string]st
 // Existing returns all known IDs.
 //
 // We assume we've been chdir() + chroot() into the data-directory
-// so we just need to read the filenames we can find.
+// so we just need to walk the shards and read the filenames we find.
 //
 func (fss *FilesystemStorage) Existing() []string {
 	var list []string
 
+	fss.walk("", func(id string, info os.FileInfo) bool {
+		list = append(list, id)
+		return true
+	})
+	return list
+}
+
+// List returns a page of the IDs we hold, in order.
+//
+// Only IDs which sort after `after`, and which were stored after `since`,
+// are returned, and at most `limit` of them, unless that is zero.
+func (fss *FilesystemStorage) List(after string, limit int, since time.Time) []string {
+	list := []string{}
+
+	fss.walk(after, func(id string, info os.FileInfo) bool {
+		if info.ModTime().After(since) {
+			list = append(list, id)
+		}
+		return limit <= 0 || len(list) < limit
+	})
+	return list
+}
+
+// Exists tests whether the given ID exists (as a file).
+func (fss *FilesystemStorage) Exists(id string) bool {
+
 	//
-	// If we're not using the cwd we need to use our prefix, explicitly
+	// Find the sharded location of the file.
 	//
-	target := "."
-	if fss.cwd == false {
-		target = fss.prefix
+	target := fss.blobPath(id)
+
+	if _, err := os.Stat(target); os.IsNotExist(err) {
+		return false
 	}
+	return true
+}
 
-	files, _ := ioutil.ReadDir(target)
-	for _, f := range files {
-		name := f.Name()
+// Modified returns the time at which the given ID was stored.
+func (fss *FilesystemStorage) Modified(id string) (time.Time, bool) {
 
-		if !strings.HasSuffix(name, ".json") {
-			list = append(list, name)
-		}
+	info, err := os.Stat(fss.blobPath(id))
+	if err != nil {
+		return time.Time{}, false
 	}
-	return list
+	return info.ModTime(), true
 }
 
-// Exists tests whether the given ID exists (as a file).
-func (fss *FilesystemStorage) Exists(id string) bool {
+// Quarantine moves the given ID, and its meta-data, beneath our
+// quarantine-directory, unless it has been replaced since the given time.
+func (fss *FilesystemStorage) Quarantine(id string, modified time.Time) bool {
 
 	//
-	// If we're not using the cwd we need to build up the complete
-	// path to the file.
+	// Find the sharded location of the file.
 	//
-	target := id
-	if fss.cwd == false {
-		target = filepath.Join(fss.prefix, id)
+	target := fss.blobPath(id)
+
+	//
+	// If the object has been stored again, by replication or an
+	// upload, then it isn't the copy which was found to be
+	// corrupt.
+	//
+	info, err := os.Stat(target)
+	if err != nil || !info.ModTime().Equal(modified) {
+		return false
 	}
 
-	if _, err := os.Stat(target); os.IsNotExist(err) {
+	//
+	// Ensure we have somewhere to move it to.
+	//
+	err = os.MkdirAll(fss.path(quarantineDir), 0755)
+	if err != nil {
+		return false
+	}
+
+	//
+	// Move the data first, so that the ID no longer exists,
+	// then the meta-data if present.
+	//
+	err = os.Rename(target, fss.path(quarantineDir, id))
+	if err != nil {
 		return false
 	}
+	os.Rename(target+".json", fss.path(quarantineDir, id+".json"))
 	return true
 }
+
+// Delete removes the given ID, and records a tombstone.
+func (fss *FilesystemStorage) Delete(id string, when time.Time) bool {
+
+	//
+	// Find the sharded location of the file.
+	//
+	target := fss.blobPath(id)
+
+	//
+	// If the object was stored after the deletion then it was
+	// uploaded again, and must be retained.
+	//
+	info, err := os.Stat(target)
+	if err == nil && info.ModTime().After(when) {
+		return false
+	}
+
+	//
+	// Record the tombstone before we remove anything, so that
+	// a crash can't leave the deletion unrecorded.
+	//
+	// If there is already a more recent tombstone we keep it.
+	//
+	tombstone := fss.tombstonePath(id)
+	info, err = os.Stat(tombstone)
+	if err != nil || info.ModTime().Before(when) {
+
+		err = os.MkdirAll(filepath.Dir(tombstone), 0755)
+		if err != nil {
+			return false
+		}
+
+		err = ioutil.WriteFile(tombstone, nil, 0644)
+		if err != nil {
+			return false
+		}
+
+		err = os.Chtimes(tombstone, when, when)
+		if err != nil {
+			return false
+		}
+	}
+
+	//
+	// Now remove the data, then the meta-data.
+	//
+	err = os.Remove(target)
+	if err != nil && !os.IsNotExist(err) {
+		return false
+	}
+	os.Remove(target + ".json")
+
+	return true
+}
+
+// Tombstones returns a page of the deletions we've recorded, in order.
+func (fss *FilesystemStorage) Tombstones(after string, limit int) []Tombstone {
+	list := []Tombstone{}
+
+	fss.walkShards(tombstoneDir, after, func(id string, info os.FileInfo) bool {
+		list = append(list, Tombstone{ID: id, Deleted: info.ModTime()})
+		return limit <= 0 || len(list) < limit
+	})
+	return list
+}
+
+// Stats returns the number of objects we hold, along with the usage of
+// the filesystem they're stored upon.
+func (fss *FilesystemStorage) Stats() (StorageStats, error) {
+
+	//
+	// Count our objects, unless we did so recently.
+	//
+	// The lock isn't held while we walk the shards, which takes
+	// a while, so that other callers aren't held up.  Instead
+	// they're given the previous count.
+	//
+	fss.countLock.Lock()
+	stale := time.Since(fss.counted) > countMaxAge && !fss.counting
+	if stale {
+		fss.counting = true
+	}
+	stats := StorageStats{Objects: fss.count}
+	fss.countLock.Unlock()
+
+	if stale {
+		var count int64
+		fss.walk("", func(id string, info os.FileInfo) bool {
+			count++
+			return true
+		})
+
+		fss.countLock.Lock()
+		fss.count = count
+		fss.counted = time.Now()
+		fss.counting = false
+		fss.countLock.Unlock()
+
+		stats.Objects = count
+	}
+
+	//
+	// Now find the state of the filesystem.
+	//
+	err := diskUsage(fss.path("."), &stats)
+	return stats, err
+}
@@ -5,11 +5,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 //
@@ -63,9 +66,7 @@ func TestList(t *testing.T) {
 		//
 		// Create the file.
 		//
-		path := filepath.Join(p, id)
-		content := []byte("File Content Here")
-		ioutil.WriteFile(path, content, 0644)
+		STORAGE.Store(id, strings.NewReader("File Content Here"), nil)
 
 		//
 		// WHich should mean they exist.
@@ -126,9 +127,7 @@ func TestGet(t *testing.T) {
 		//
 		// Create the file.
 		//
-		path := filepath.Join(p, id)
-		content := []byte(id)
-		ioutil.WriteFile(path, content, 0644)
+		STORAGE.Store(id, strings.NewReader(id), nil)
 
 	}
 
@@ -137,8 +136,10 @@ func TestGet(t *testing.T) {
 	//
 	for _, id := range files {
 
-		content, _ := STORAGE.Get(id)
-		stringContent := fmt.Sprintf("%s", *content)
+		reader, _ := STORAGE.Get(id)
+		content, _ := ioutil.ReadAll(reader)
+		reader.Close()
+		stringContent := fmt.Sprintf("%s", content)
 
 		if stringContent != id {
 			t.Errorf("Content of '%s' was not '%s'",
@@ -198,7 +199,7 @@ func TestStore(t *testing.T) {
 		//
 		// Store it
 		//
-		STORAGE.Store(id, []byte(id), meta)
+		STORAGE.Store(id, strings.NewReader(id), meta)
 
 		//
 		// Now it should be present
@@ -221,3 +222,540 @@ func TestStore(t *testing.T) {
 	//
 	os.RemoveAll(p)
 }
+
+//
+// Test that a store using the old, flat, layout is migrated.
+//
+func TestMigrate(t *testing.T) {
+
+	//
+	// Create a temporary directory.
+	//
+	p, _ := ioutil.TempDir("tmp", "prefix")
+
+	//
+	// Create some files, and meta-data, the way older releases
+	// would have done.  Note that "ab" collides with the name of
+	// its own shard-directory.
+	//
+	files := []string{"steve", "ab", "abcdef", "x"}
+	for _, id := range files {
+		ioutil.WriteFile(filepath.Join(p, id), []byte(id), 0644)
+		ioutil.WriteFile(filepath.Join(p, id+".json"), []byte("{\"name\":\""+id+"\"}"), 0644)
+	}
+
+	//
+	// Along with some tombstones, which keep the time of their
+	// deletion.
+	//
+	deleted := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.MkdirAll(filepath.Join(p, tombstoneDir), 0755)
+	for _, id := range []string{"gone", "go"} {
+		ioutil.WriteFile(filepath.Join(p, tombstoneDir, id), nil, 0644)
+		os.Chtimes(filepath.Join(p, tombstoneDir, id), deleted, deleted)
+	}
+
+	//
+	// Init the filesystem storage-class, which will migrate.
+	//
+	fss := new(FilesystemStorage)
+	fss.Setup(p)
+
+	//
+	// The listing should be complete, and sorted.
+	//
+	list := fss.Existing()
+	expected := []string{"ab", "abcdef", "steve", "x"}
+	if strings.Join(list, ",") != strings.Join(expected, ",") {
+		t.Errorf("Unexpected listing %v", list)
+	}
+
+	for _, id := range files {
+
+		//
+		// The flat file should have gone.
+		//
+		if _, err := os.Stat(filepath.Join(p, id+".json")); !os.IsNotExist(err) {
+			t.Errorf("Meta-data for %s was not migrated", id)
+		}
+
+		//
+		// And the content should be available.
+		//
+		reader, meta := fss.Get(id)
+		if reader == nil {
+			t.Fatalf("Failed to get %s post-migration", id)
+		}
+		content, _ := ioutil.ReadAll(reader)
+		reader.Close()
+
+		if string(content) != id {
+			t.Errorf("Content of '%s' was not '%s'", content, id)
+		}
+		if meta["name"] != id {
+			t.Errorf("meta-data mismatch after migration!")
+		}
+	}
+
+	tombstones := fss.Tombstones("", 0)
+	if len(tombstones) != 2 || tombstones[0].ID != "go" || tombstones[1].ID != "gone" {
+		t.Fatalf("Unexpected tombstones after migration %v", tombstones)
+	}
+	for _, tombstone := range tombstones {
+		if !tombstone.Deleted.Equal(deleted) {
+			t.Errorf("Tombstone %s has the wrong time %s", tombstone.ID, tombstone.Deleted)
+		}
+
+		//
+		// "go" is now the name of its own shard-directory.
+		//
+		info, err := os.Stat(filepath.Join(p, tombstoneDir, tombstone.ID))
+		if err == nil && !info.IsDir() {
+			t.Errorf("Tombstone %s was not migrated", tombstone.ID)
+		}
+	}
+
+	//
+	// Cleanup
+	//
+	os.RemoveAll(p)
+}
+
+//
+// failingReader returns some data, then an error, to simulate an
+// upload which is interrupted part-way through.
+//
+type failingReader struct {
+	sent bool
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.sent {
+		return 0, errors.New("connection reset")
+	}
+	f.sent = true
+	return copy(p, "partial content"), nil
+}
+
+//
+// Test that a failed store leaves nothing behind.
+//
+func TestStoreFailure(t *testing.T) {
+
+	//
+	// Create a temporary directory.
+	//
+	p, _ := ioutil.TempDir("tmp", "prefix")
+
+	//
+	// Init the filesystem storage-class
+	//
+	var STORAGE StorageHandler
+	STORAGE = new(FilesystemStorage)
+	STORAGE.Setup(p)
+
+	meta := make(map[string]string)
+	meta["filename"] = "steve"
+
+	//
+	// The store should fail.
+	//
+	if STORAGE.Store("steve", &failingReader{}, meta) {
+		t.Errorf("Store succeeded with a failing reader!")
+	}
+
+	//
+	// The blob shouldn't be visible.
+	//
+	if STORAGE.Exists("steve") {
+		t.Errorf("Exists() succeeded after a failed store!")
+	}
+
+	//
+	// And there should be no temporary files left behind.
+	//
+	tmp, _ := ioutil.ReadDir(filepath.Join(p, tmpDir))
+	if len(tmp) != 0 {
+		t.Errorf("Temporary files were left behind: %d", len(tmp))
+	}
+
+	//
+	// Cleanup
+	//
+	os.RemoveAll(p)
+}
+
+//
+// Test that orphaned temporary files are removed on startup.
+//
+func TestStoreCleanup(t *testing.T) {
+
+	//
+	// Create a temporary directory, containing the remains
+	// of an interrupted upload.
+	//
+	p, _ := ioutil.TempDir("tmp", "prefix")
+	os.MkdirAll(filepath.Join(p, tmpDir), 0755)
+
+	orphan := filepath.Join(p, tmpDir, "store-123")
+	ioutil.WriteFile(orphan, []byte("partial"), 0644)
+	old := time.Now().Add(-2 * tmpMaxAge)
+	os.Chtimes(orphan, old, old)
+
+	//
+	// An upload which is in-progress, from another process.
+	//
+	active := filepath.Join(p, tmpDir, "store-456")
+	ioutil.WriteFile(active, []byte("partial"), 0644)
+
+	//
+	// Init the filesystem storage-class
+	//
+	var STORAGE StorageHandler
+	STORAGE = new(FilesystemStorage)
+	STORAGE.Setup(p)
+
+	//
+	// The orphan should have gone, the active upload should remain.
+	//
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("Orphaned temporary file was not removed")
+	}
+	if _, err := os.Stat(active); err != nil {
+		t.Errorf("Active temporary file was removed")
+	}
+
+	//
+	// And it shouldn't appear as an object.
+	//
+	if len(STORAGE.Existing()) != 0 {
+		t.Errorf("Temporary files were listed as objects")
+	}
+
+	//
+	// Cleanup
+	//
+	os.RemoveAll(p)
+}
+
+//
+// Test that quarantined objects are moved aside.
+//
+func TestQuarantine(t *testing.T) {
+
+	//
+	// Create a temporary directory.
+	//
+	p, _ := ioutil.TempDir("tmp", "prefix")
+
+	//
+	// Init the filesystem storage-class
+	//
+	var STORAGE StorageHandler
+	STORAGE = new(FilesystemStorage)
+	STORAGE.Setup(p)
+
+	meta := make(map[string]string)
+	meta["filename"] = "steve"
+	STORAGE.Store("steve", strings.NewReader("steve"), meta)
+
+	//
+	// Quarantining a missing object fails.
+	//
+	if STORAGE.Quarantine("missing", time.Now()) {
+		t.Errorf("Quarantined a missing object")
+	}
+
+	//
+	// As does quarantining an object which was replaced.
+	//
+	modified, _ := STORAGE.Modified("steve")
+	if STORAGE.Quarantine("steve", modified.Add(-time.Second)) || !STORAGE.Exists("steve") {
+		t.Errorf("Quarantined an object which was replaced")
+	}
+
+	if !STORAGE.Quarantine("steve", modified) {
+		t.Errorf("Failed to quarantine an object")
+	}
+
+	//
+	// The object has gone.
+	//
+	if STORAGE.Exists("steve") || len(STORAGE.Existing()) != 0 {
+		t.Errorf("Quarantined object still exists")
+	}
+
+	//
+	// But is available for inspection.
+	//
+	for _, name := range []string{"steve", "steve.json"} {
+		if _, err := os.Stat(filepath.Join(p, quarantineDir, name)); err != nil {
+			t.Errorf("Quarantined file %s is missing", name)
+		}
+	}
+
+	//
+	// Cleanup
+	//
+	os.RemoveAll(p)
+}
+
+//
+// Test deleting objects records tombstones.
+//
+func TestDelete(t *testing.T) {
+
+	//
+	// Create a temporary directory.
+	//
+	p, _ := ioutil.TempDir("tmp", "prefix")
+
+	//
+	// Init the filesystem storage-class
+	//
+	var STORAGE StorageHandler
+	STORAGE = new(FilesystemStorage)
+	STORAGE.Setup(p)
+
+	STORAGE.Store("steve", strings.NewReader("steve"), nil)
+
+	//
+	// A deletion which took place before the object was
+	// uploaded doesn't remove it.
+	//
+	if STORAGE.Delete("steve", time.Now().Add(-time.Hour)) {
+		t.Errorf("Deleted an object which was stored after the deletion")
+	}
+	if !STORAGE.Exists("steve") {
+		t.Errorf("Object was removed by a stale deletion")
+	}
+
+	//
+	// But a current one does.
+	//
+	when := time.Now().Add(time.Second)
+	if !STORAGE.Delete("steve", when) {
+		t.Errorf("Failed to delete object")
+	}
+	if STORAGE.Exists("steve") || len(STORAGE.Existing()) != 0 {
+		t.Errorf("Deleted object still exists")
+	}
+
+	//
+	// Deleting a missing object is fine, and records a tombstone.
+	//
+	if !STORAGE.Delete("missing", when) {
+		t.Errorf("Failed to delete missing object")
+	}
+
+	tombstones := STORAGE.Tombstones("", 0)
+	if len(tombstones) != 2 || tombstones[0].ID != "missing" || tombstones[1].ID != "steve" {
+		t.Fatalf("Unexpected tombstones %v", tombstones)
+	}
+	if when.Sub(tombstones[1].Deleted) > time.Second || tombstones[1].Deleted.After(when) {
+		t.Errorf("Unexpected tombstone time %s", tombstones[1].Deleted)
+	}
+
+	//
+	// Uploading again removes the tombstone.
+	//
+	STORAGE.Store("steve", strings.NewReader("steve"), nil)
+	tombstones = STORAGE.Tombstones("", 0)
+	if len(tombstones) != 1 || tombstones[0].ID != "missing" {
+		t.Errorf("Tombstone survived a fresh upload")
+	}
+
+	//
+	// Cleanup
+	//
+	os.RemoveAll(p)
+}
+
+//
+// Test the paginated listing of tombstones, and their expiry.
+//
+func TestTombstonePages(t *testing.T) {
+
+	p, _ := ioutil.TempDir("tmp", "prefix")
+	defer os.RemoveAll(p)
+
+	fss := new(FilesystemStorage)
+	fss.Setup(p)
+
+	for _, id := range []string{"c", "a", "b", "d"} {
+		fss.Delete(id, time.Now())
+	}
+	fss.Delete("old", time.Now().Add(-tombstoneMaxAge-time.Hour))
+
+	tests := []struct {
+		after string
+		limit int
+		ids   string
+	}{
+		{"", 0, "a,b,c,d,old"},
+		{"", 2, "a,b"},
+		{"b", 2, "c,d"},
+		{"d", 2, "old"},
+		{"old", 2, ""},
+	}
+	for _, test := range tests {
+		var ids []string
+		for _, tombstone := range fss.Tombstones(test.after, test.limit) {
+			ids = append(ids, tombstone.ID)
+		}
+		if strings.Join(ids, ",") != test.ids {
+			t.Errorf("Unexpected tombstones after %q: %v", test.after, ids)
+		}
+	}
+
+	//
+	// Expired tombstones are removed by our cleanup.
+	//
+	fss.cleanup()
+	tombstones := fss.Tombstones("", 0)
+	if len(tombstones) != 4 || tombstones[3].ID != "d" {
+		t.Errorf("Unexpected tombstones after expiry %v", tombstones)
+	}
+}
+
+//
+// Test the paginated listing.
+//
+func TestListPages(t *testing.T) {
+
+	//
+	// Create a temporary directory.
+	//
+	p, _ := ioutil.TempDir("tmp", "prefix")
+
+	//
+	// Init the filesystem storage-class
+	//
+	var STORAGE StorageHandler
+	STORAGE = new(FilesystemStorage)
+	STORAGE.Setup(p)
+
+	//
+	// Create some objects, spread across shards.
+	//
+	files := []string{"a", "ab", "abc", "abcd", "abcde", "abd", "b", "ba12", "ba13", "zz"}
+	for _, id := range files {
+		STORAGE.Store(id, strings.NewReader(id), nil)
+	}
+
+	//
+	// Walk the listing, a page at a time.
+	//
+	var all []string
+	after := ""
+	for {
+		page := STORAGE.List(after, 3, time.Time{})
+		if len(page) > 3 {
+			t.Fatalf("Page was too large: %v", page)
+		}
+		all = append(all, page...)
+		if len(page) < 3 {
+			break
+		}
+		after = page[len(page)-1]
+	}
+
+	if strings.Join(all, ",") != strings.Join(files, ",") {
+		t.Errorf("Unexpected listing: %v", all)
+	}
+
+	//
+	// Starting after an ID which doesn't exist works.
+	//
+	page := STORAGE.List("abcc", 2, time.Time{})
+	if strings.Join(page, ",") != "abcd,abcde" {
+		t.Errorf("Unexpected page: %v", page)
+	}
+
+	//
+	// Now age all but one of the objects, and test the
+	// incremental listing.
+	//
+	old := time.Now().Add(-time.Hour)
+	for _, id := range files {
+		if id != "ba12" {
+			a, b := shard(id)
+			os.Chtimes(filepath.Join(p, a, b, id), old, old)
+		}
+	}
+	page = STORAGE.List("", 0, time.Now().Add(-time.Minute))
+	if strings.Join(page, ",") != "ba12" {
+		t.Errorf("Unexpected incremental listing: %v", page)
+	}
+
+	//
+	// Cleanup
+	//
+	os.RemoveAll(p)
+}
+
+//
+// Test that we report our statistics.
+//
+func TestStats(t *testing.T) {
+
+	//
+	// Create a temporary directory.
+	//
+	p, _ := ioutil.TempDir("tmp", "prefix")
+
+	//
+	// Init the filesystem storage-class
+	//
+	var STORAGE StorageHandler
+	STORAGE = new(FilesystemStorage)
+	STORAGE.Setup(p)
+
+	for _, id := range []string{"one", "two", "three"} {
+		STORAGE.Store(id, strings.NewReader(id), nil)
+	}
+
+	stats, err := STORAGE.Stats()
+	if err != nil {
+		t.Fatalf("Failed to get stats: %s", err.Error())
+	}
+	if stats.Objects != 3 {
+		t.Errorf("Expected 3 objects, got %d", stats.Objects)
+	}
+	if stats.TotalBytes == 0 || stats.FreeBytes > stats.TotalBytes || stats.UsedBytes > stats.TotalBytes {
+		t.Errorf("Unexpected disk usage %+v", stats)
+	}
+
+	//
+	// The count is cached, so new objects aren't seen
+	// immediately.
+	//
+	STORAGE.Store("four", strings.NewReader("four"), nil)
+	stats, _ = STORAGE.Stats()
+	if stats.Objects != 3 {
+		t.Errorf("Expected the cached count, got %d", stats.Objects)
+	}
+
+	//
+	// Once the count is stale it is taken again, unless another
+	// caller is already doing so, in which case we don't wait.
+	//
+	fss := STORAGE.(*FilesystemStorage)
+	fss.counted = time.Time{}
+	fss.counting = true
+	stats, _ = STORAGE.Stats()
+	if stats.Objects != 3 {
+		t.Errorf("Expected the previous count while counting, got %d", stats.Objects)
+	}
+
+	fss.counting = false
+	stats, _ = STORAGE.Stats()
+	if stats.Objects != 4 || fss.counting {
+		t.Errorf("Expected a fresh count, got %d", stats.Objects)
+	}
+
+	//
+	// Cleanup
+	//
+	os.RemoveAll(p)
+}
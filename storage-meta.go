@@ -0,0 +1,275 @@
+//
+// Cluster metadata.
+//
+// Alongside the blobs we hold a small key-value store, which allows the
+// API-server to record things such as the names given to objects.  Each
+// blob-server holds a copy of every entry, and each entry records the
+// time at which it was written:  when two copies differ the most recent
+// one wins.
+//
+// Deleting an entry replaces it with a tombstone, which is also
+// timestamped, so that the deletion isn't undone by a server holding an
+// older copy of the entry.
+//
+// The entries are stored beneath `.meta/`, in files named after the SHA1
+// hash of their key, since keys may contain any character:
+//
+//     .meta/ab/abcdef0123...
+//
+// The entries are small, so they're also held in RAM, which allows them
+// to be listed in order without reading every file.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// MetadataHandler is the interface for a storage class which can hold
+// cluster metadata.
+//
+// It is optional, the blob-server reports that metadata is unsupported
+// if its storage class doesn't implement it.
+type MetadataHandler interface {
+
+	//
+	// Retrieve the entry with the given key, which might be a
+	// tombstone.
+	//
+	// The second value is false if the key doesn't exist.
+	//
+	GetMeta(key string) (MetaEntry, bool)
+
+	//
+	// Store the given entry, unless we already hold a more
+	// recent copy of it.
+	//
+	// The entry we hold afterwards is returned.
+	//
+	PutMeta(entry MetaEntry) (MetaEntry, error)
+
+	//
+	// Get a page of the entries whose keys begin with the given
+	// prefix, in order, including any tombstones.
+	//
+	// At most `limit` entries are returned, or all of them if
+	// that is zero.  Only keys which sort after `after` are
+	// included.
+	//
+	ListMeta(prefix string, after string, limit int) []MetaEntry
+}
+
+// MetaEntry is a single entry of our cluster metadata.
+type MetaEntry struct {
+	// Key is the name of the entry.
+	Key string `json:"key"`
+
+	// Value is the JSON value of the entry, which is empty for a
+	// tombstone.
+	Value json.RawMessage `json:"value,omitempty"`
+
+	// Modified is the time at which the entry was written.
+	Modified time.Time `json:"modified"`
+
+	// Deleted is true if the entry is a tombstone.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// Newer returns true if the entry should replace the given one.
+//
+// The most recent entry wins.  If two entries were written at the same
+// time a tombstone wins, otherwise the larger value does, so that every
+// server reaches the same decision.
+func (e MetaEntry) Newer(other MetaEntry) bool {
+	if !e.Modified.Equal(other.Modified) {
+		return e.Modified.After(other.Modified)
+	}
+	if e.Deleted != other.Deleted {
+		return e.Deleted
+	}
+	return bytes.Compare(e.Value, other.Value) > 0
+}
+
+//
+// maxMetaKey is the length of the longest key we allow.
+//
+const maxMetaKey = 1024
+
+//
+// errInvalidMetaKey is returned for keys which are empty, too long, or
+// not valid UTF-8.
+//
+var errInvalidMetaKey = errors.New("invalid key")
+
+//
+// validMetaKey returns true if the given string may be used as a key.
+//
+func validMetaKey(key string) bool {
+	return key != "" &&
+		len(key) <= maxMetaKey &&
+		utf8.ValidString(key) &&
+		!strings.ContainsRune(key, 0)
+}
+
+//
+// metaDir is the directory, beneath our data-directory, which holds our
+// metadata.
+//
+const metaDir = ".meta"
+
+//
+// metaStore holds our metadata in RAM.
+//
+type metaStore struct {
+	sync.Mutex
+
+	// loaded is true once we've read our entries.
+	loaded bool
+
+	// entries holds each entry, by key, and keys holds the keys
+	// in order.
+	entries map[string]MetaEntry
+	keys    []string
+}
+
+//
+// metaPath returns the location of the file holding the given key.
+//
+func (fss *FilesystemStorage) metaPath(key string) string {
+	hash := sha1.Sum([]byte(key))
+	name := hex.EncodeToString(hash[:])
+	return fss.path(metaDir, name[0:2], name)
+}
+
+//
+// loadMeta reads our entries into RAM, if we've not already done so.
+//
+// The caller must hold the lock of our metaStore.
+//
+func (fss *FilesystemStorage) loadMeta() {
+	if fss.meta.loaded {
+		return
+	}
+
+	fss.meta.entries = make(map[string]MetaEntry)
+	fss.meta.keys = nil
+
+	shards, _ := ioutil.ReadDir(fss.path(metaDir))
+	for _, shard := range shards {
+		files, _ := ioutil.ReadDir(fss.path(metaDir, shard.Name()))
+		for _, f := range files {
+			data, err := ioutil.ReadFile(fss.path(metaDir, shard.Name(), f.Name()))
+			if err != nil {
+				continue
+			}
+
+			var entry MetaEntry
+			if json.Unmarshal(data, &entry) != nil || !validMetaKey(entry.Key) {
+				continue
+			}
+			fss.meta.entries[entry.Key] = entry
+			fss.meta.keys = append(fss.meta.keys, entry.Key)
+		}
+	}
+	sort.Strings(fss.meta.keys)
+	fss.meta.loaded = true
+}
+
+// GetMeta returns the entry with the given key.
+func (fss *FilesystemStorage) GetMeta(key string) (MetaEntry, bool) {
+	fss.meta.Lock()
+	defer fss.meta.Unlock()
+
+	fss.loadMeta()
+	entry, ok := fss.meta.entries[key]
+	return entry, ok
+}
+
+// PutMeta stores the given entry, unless we hold a more recent copy.
+func (fss *FilesystemStorage) PutMeta(entry MetaEntry) (MetaEntry, error) {
+	if !validMetaKey(entry.Key) {
+		return MetaEntry{}, errInvalidMetaKey
+	}
+
+	fss.meta.Lock()
+	defer fss.meta.Unlock()
+
+	fss.loadMeta()
+	existing, ok := fss.meta.entries[entry.Key]
+	if ok && !entry.Newer(existing) {
+		return existing, nil
+	}
+
+	//
+	// Tombstones have no value.
+	//
+	if entry.Deleted {
+		entry.Value = nil
+	}
+
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return MetaEntry{}, err
+	}
+
+	target := fss.metaPath(entry.Key)
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return MetaEntry{}, err
+	}
+	err = fss.moveTemp(bytes.NewReader(encoded), target)
+	if err != nil {
+		return MetaEntry{}, err
+	}
+
+	//
+	// Now update our copy in RAM.
+	//
+	if !ok {
+		i := sort.SearchStrings(fss.meta.keys, entry.Key)
+		fss.meta.keys = append(fss.meta.keys, "")
+		copy(fss.meta.keys[i+1:], fss.meta.keys[i:])
+		fss.meta.keys[i] = entry.Key
+	}
+	fss.meta.entries[entry.Key] = entry
+	return entry, nil
+}
+
+// ListMeta returns a page of the entries whose keys begin with the given
+// prefix, in order.
+func (fss *FilesystemStorage) ListMeta(prefix string, after string, limit int) []MetaEntry {
+	fss.meta.Lock()
+	defer fss.meta.Unlock()
+
+	fss.loadMeta()
+
+	list := []MetaEntry{}
+	start := prefix
+	if after > start {
+		start = after
+	}
+	for i := sort.SearchStrings(fss.meta.keys, start); i < len(fss.meta.keys); i++ {
+		key := fss.meta.keys[i]
+		if key == after {
+			continue
+		}
+		if !strings.HasPrefix(key, prefix) || (limit > 0 && len(list) >= limit) {
+			break
+		}
+		list = append(list, fss.meta.entries[key])
+	}
+	return list
+}
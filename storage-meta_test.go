@@ -0,0 +1,137 @@
+//
+// Test cluster metadata, in our storage layer.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+//
+// Test that the most recent copy of an entry wins.
+//
+func TestMetaNewest(t *testing.T) {
+
+	//
+	// Create a temporary directory.
+	//
+	p, _ := ioutil.TempDir("tmp", "prefix")
+	defer os.RemoveAll(p)
+
+	//
+	// Init the filesystem storage-class
+	//
+	fss := new(FilesystemStorage)
+	fss.Setup(p)
+
+	if _, ok := fss.GetMeta("missing"); ok {
+		t.Errorf("Found a missing entry")
+	}
+	if _, err := fss.PutMeta(MetaEntry{Modified: time.Now()}); err != errInvalidMetaKey {
+		t.Errorf("Stored an entry with no key: %v", err)
+	}
+
+	now := time.Now().UTC()
+	tests := []struct {
+		entry  MetaEntry
+		result string
+	}{
+		{MetaEntry{Key: "k", Value: json.RawMessage(`"one"`), Modified: now}, `"one"`},
+		{MetaEntry{Key: "k", Value: json.RawMessage(`"old"`), Modified: now.Add(-time.Second)}, `"one"`},
+		{MetaEntry{Key: "k", Value: json.RawMessage(`"two"`), Modified: now.Add(time.Second)}, `"two"`},
+		{MetaEntry{Key: "k", Value: json.RawMessage(`"three"`), Modified: now.Add(time.Second)}, `"two"`},
+		{MetaEntry{Key: "k", Value: json.RawMessage(`"zzz"`), Modified: now.Add(time.Second)}, `"zzz"`},
+	}
+
+	for _, test := range tests {
+		result, err := fss.PutMeta(test.entry)
+		if err != nil {
+			t.Fatalf("Failed to store entry: %s", err.Error())
+		}
+		if string(result.Value) != test.result {
+			t.Errorf("Storing %s gave %s, expected %s", test.entry.Value, result.Value, test.result)
+		}
+	}
+
+	//
+	// A tombstone written at the same time wins, and has no value.
+	//
+	result, _ := fss.PutMeta(MetaEntry{Key: "k", Value: json.RawMessage(`"x"`), Modified: now.Add(time.Second), Deleted: true})
+	if !result.Deleted || result.Value != nil {
+		t.Errorf("Tombstone was not stored: %v", result)
+	}
+	result, _ = fss.PutMeta(MetaEntry{Key: "k", Value: json.RawMessage(`"one"`), Modified: now})
+	if !result.Deleted {
+		t.Errorf("Tombstone was replaced by an older entry")
+	}
+
+	//
+	// Everything is still there once we've been restarted.
+	//
+	fss = new(FilesystemStorage)
+	fss.Setup(p)
+
+	entry, ok := fss.GetMeta("k")
+	if !ok || !entry.Deleted || !entry.Modified.Equal(now.Add(time.Second)) {
+		t.Errorf("Tombstone was not reloaded: %v", entry)
+	}
+}
+
+//
+// Test listing entries.
+//
+func TestMetaList(t *testing.T) {
+
+	p, _ := ioutil.TempDir("tmp", "prefix")
+	defer os.RemoveAll(p)
+
+	fss := new(FilesystemStorage)
+	fss.Setup(p)
+
+	for _, key := range []string{"b/2", "a/1", "b/1", "c", "b/3"} {
+		_, err := fss.PutMeta(MetaEntry{Key: key, Value: json.RawMessage(`1`), Modified: time.Now()})
+		if err != nil {
+			t.Fatalf("Failed to store entry: %s", err.Error())
+		}
+	}
+	fss.PutMeta(MetaEntry{Key: "b/2", Modified: time.Now().Add(time.Second), Deleted: true})
+
+	tests := []struct {
+		prefix string
+		after  string
+		limit  int
+		keys   []string
+	}{
+		{"", "", 0, []string{"a/1", "b/1", "b/2", "b/3", "c"}},
+		{"b/", "", 0, []string{"b/1", "b/2", "b/3"}},
+		{"b/", "", 2, []string{"b/1", "b/2"}},
+		{"b/", "b/2", 2, []string{"b/3"}},
+		{"b/", "a", 0, []string{"b/1", "b/2", "b/3"}},
+		{"", "b/3", 0, []string{"c"}},
+		{"d", "", 0, []string{}},
+	}
+
+	for _, test := range tests {
+		list := fss.ListMeta(test.prefix, test.after, test.limit)
+
+		var keys []string
+		for _, entry := range list {
+			keys = append(keys, entry.Key)
+		}
+		if len(keys) != len(test.keys) {
+			t.Errorf("Listing %q after %q gave %v, expected %v", test.prefix, test.after, keys, test.keys)
+			continue
+		}
+		for i := range keys {
+			if keys[i] != test.keys[i] {
+				t.Errorf("Listing %q after %q gave %v, expected %v", test.prefix, test.after, keys, test.keys)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,563 @@
+//
+// Multipart uploads.
+//
+// Large objects may be uploaded in parts, so that a failure part-way
+// through an upload only requires the missing parts to be sent again.
+//
+// The parts of each upload are stored beneath `.uploads/`, in a directory
+// named after the upload:
+//
+//     .uploads/${upload}/meta.json
+//     .uploads/${upload}/part-000001
+//     .uploads/${upload}/part-000002
+//
+// Once every part has been received the upload is completed, which joins
+// the parts together, in order, into a single object and hashes it to find
+// its ID.  The assembled object then replaces the parts:
+//
+//     .uploads/${upload}/object
+//     .uploads/${upload}/object.json
+//
+// The assembled object may be read, so that it can be copied to other
+// servers, or committed to our own storage, until the upload is removed.
+//
+// Uploads which are abandoned are removed once they've not been touched
+// for a week.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MultipartHandler is the interface for a storage class which supports
+// uploads in parts.
+//
+// It is optional, the blob-server reports that multipart uploads are
+// unsupported if its storage class doesn't implement it.
+type MultipartHandler interface {
+
+	//
+	// Begin a new upload, with the given ID, recording
+	// any `key=value` parameters to store alongside the
+	// object it produces.
+	//
+	CreateUpload(upload string, params map[string]string) error
+
+	//
+	// Store the given part of an upload, replacing any
+	// previous copy of it, and return its size.
+	//
+	StorePart(upload string, part int, data io.Reader) (int64, error)
+
+	//
+	// Get the parts of an upload which we hold, in order.
+	//
+	// If the upload has been completed the resulting object
+	// is returned too.
+	//
+	Parts(upload string) ([]UploadPart, *UploadedObject, error)
+
+	//
+	// Join the parts of an upload into a single object, and
+	// return its ID and size.
+	//
+	// Completing an upload which has already been completed
+	// returns the same object again.
+	//
+	CompleteUpload(upload string) (UploadedObject, error)
+
+	//
+	// Retrieve the object produced by completing an upload,
+	// along with the parameters it was created with.
+	//
+	OpenUpload(upload string) (io.ReadSeekCloser, map[string]string, error)
+
+	//
+	// Store the object produced by completing an upload, as
+	// though it had been uploaded in a single piece.
+	//
+	// The upload remains until it is removed.
+	//
+	CommitUpload(upload string) (UploadedObject, error)
+
+	//
+	// Remove an upload, along with its parts.
+	//
+	AbortUpload(upload string) error
+}
+
+// UploadPart describes a single part of a multipart upload.
+type UploadPart struct {
+	Part int   `json:"part"`
+	Size int64 `json:"size"`
+}
+
+// UploadedObject describes the object produced by a multipart upload.
+type UploadedObject struct {
+	ID   string `json:"id"`
+	Size int64  `json:"size"`
+}
+
+var (
+	// errUnknownUpload is returned for uploads which don't exist.
+	errUnknownUpload = errors.New("unknown upload")
+
+	// errUploadExists is returned when creating an upload twice.
+	errUploadExists = errors.New("upload already exists")
+
+	// errUploadComplete is returned when a part is sent after the
+	// upload has been completed.
+	errUploadComplete = errors.New("upload has already been completed")
+
+	// errUploadIncomplete is returned when reading, or committing,
+	// an upload which hasn't been completed.
+	errUploadIncomplete = errors.New("upload has not been completed")
+
+	// errUploadBusy is returned when completing an upload which is
+	// already being completed.
+	errUploadBusy = errors.New("upload is being completed")
+
+	// errNoParts is returned when completing an upload which has no
+	// parts.
+	errNoParts = errors.New("upload has no parts")
+)
+
+//
+// missingPart is returned when completing an upload which lacks the
+// given part.
+//
+type missingPart int
+
+//
+// Error implements the error interface.
+//
+func (m missingPart) Error() string {
+	return fmt.Sprintf("part %d is missing", int(m))
+}
+
+//
+// uploadDir is the directory, beneath our data-directory, which holds
+// uploads which are in progress.
+//
+// This must live on the same filesystem as the blobs, so that parts
+// may be renamed into place.
+//
+const uploadDir = ".uploads"
+
+//
+// uploadMaxAge is the age after which an upload which hasn't been
+// touched is considered to be abandoned.
+//
+const uploadMaxAge = 7 * 24 * time.Hour
+
+//
+// maxParts is the highest part-number an upload may use.
+//
+const maxParts = 10000
+
+//
+// partName returns the name of the file holding the given part, which
+// is padded so that the parts sort in order.
+//
+func partName(part int) string {
+	return fmt.Sprintf("part-%06d", part)
+}
+
+//
+// assembling records the uploads which are being completed, since
+// joining the parts of a large upload takes some time.
+//
+var assembling = struct {
+	sync.Mutex
+	uploads map[string]bool
+}{uploads: make(map[string]bool)}
+
+//
+// cleanupUploads removes any uploads which have been abandoned.
+//
+func (fss *FilesystemStorage) cleanupUploads() {
+	uploads, _ := ioutil.ReadDir(fss.path(uploadDir))
+	for _, u := range uploads {
+		if time.Since(u.ModTime()) > uploadMaxAge {
+			os.RemoveAll(fss.path(uploadDir, u.Name()))
+		}
+	}
+}
+
+//
+// uploadExists returns true if the given upload exists.
+//
+func (fss *FilesystemStorage) uploadExists(upload string) bool {
+	_, err := os.Stat(fss.path(uploadDir, upload, "meta.json"))
+	return err == nil
+}
+
+//
+// uploaded returns the object an upload produced, if it has been
+// completed.
+//
+func (fss *FilesystemStorage) uploaded(upload string) (*UploadedObject, error) {
+	data, err := ioutil.ReadFile(fss.path(uploadDir, upload, "object.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var obj UploadedObject
+	err = json.Unmarshal(data, &obj)
+	if err != nil {
+		return nil, err
+	}
+	return &obj, nil
+}
+
+//
+// moveTemp writes the given data to a temporary file, and then renames
+// it to the given location.
+//
+func (fss *FilesystemStorage) moveTemp(data io.Reader, target string) error {
+	tmp, err := fss.writeTemp(data)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, target)
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// CreateUpload begins a new upload.
+func (fss *FilesystemStorage) CreateUpload(upload string, params map[string]string) error {
+
+	//
+	// This is a good time to remove any abandoned uploads.
+	//
+	fss.cleanupUploads()
+
+	if params == nil {
+		params = make(map[string]string)
+	}
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(fss.path(uploadDir), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(fss.path(uploadDir, upload), 0755)
+	if os.IsExist(err) {
+		return errUploadExists
+	}
+	if err != nil {
+		return err
+	}
+
+	//
+	// The upload exists once its meta-data does.
+	//
+	err = fss.moveTemp(bytes.NewReader(encoded), fss.path(uploadDir, upload, "meta.json"))
+	if err != nil {
+		os.RemoveAll(fss.path(uploadDir, upload))
+	}
+	return err
+}
+
+// StorePart stores a single part of an upload.
+func (fss *FilesystemStorage) StorePart(upload string, part int, data io.Reader) (int64, error) {
+
+	if !fss.uploadExists(upload) {
+		return 0, errUnknownUpload
+	}
+	if part < 1 || part > maxParts {
+		return 0, fmt.Errorf("part must be between 1 and %d", maxParts)
+	}
+
+	content := &countingReader{reader: data}
+	tmp, err := fss.writeTemp(content)
+	if err != nil {
+		return 0, err
+	}
+
+	//
+	// The part is only moved into place while the upload isn't
+	// being completed, holding the same lock as CompleteUpload,
+	// so that the parts can't change beneath it.
+	//
+	assembling.Lock()
+	defer assembling.Unlock()
+
+	if assembling.uploads[upload] {
+		os.Remove(tmp)
+		return 0, errUploadBusy
+	}
+
+	//
+	// The parts are removed once the upload is completed.
+	//
+	obj, err := fss.uploaded(upload)
+	if err == nil && obj != nil {
+		err = errUploadComplete
+	}
+	if err == nil {
+		err = os.Rename(tmp, fss.path(uploadDir, upload, partName(part)))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return content.count, nil
+}
+
+// Parts returns the parts of an upload which we hold, in order, and the
+// object it produced if it has been completed.
+func (fss *FilesystemStorage) Parts(upload string) ([]UploadPart, *UploadedObject, error) {
+
+	if !fss.uploadExists(upload) {
+		return nil, nil, errUnknownUpload
+	}
+
+	files, err := ioutil.ReadDir(fss.path(uploadDir, upload))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parts := []UploadPart{}
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name(), "part-") {
+			continue
+		}
+		part, perr := strconv.Atoi(strings.TrimPrefix(f.Name(), "part-"))
+		if perr == nil {
+			parts = append(parts, UploadPart{Part: part, Size: f.Size()})
+		}
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].Part < parts[j].Part
+	})
+
+	obj, err := fss.uploaded(upload)
+	return parts, obj, err
+}
+
+// CompleteUpload joins the parts of an upload into a single object.
+//
+// The parts must be numbered consecutively, from one, so that a part
+// which is missing is noticed rather than silently skipped.
+func (fss *FilesystemStorage) CompleteUpload(upload string) (UploadedObject, error) {
+
+	//
+	// Only one caller may assemble an upload at a time.
+	//
+	assembling.Lock()
+	if assembling.uploads[upload] {
+		assembling.Unlock()
+		return UploadedObject{}, errUploadBusy
+	}
+	assembling.uploads[upload] = true
+	assembling.Unlock()
+
+	defer func() {
+		assembling.Lock()
+		delete(assembling.uploads, upload)
+		assembling.Unlock()
+	}()
+
+	parts, obj, err := fss.Parts(upload)
+	if err != nil {
+		return UploadedObject{}, err
+	}
+	if obj != nil {
+		return *obj, nil
+	}
+	if len(parts) == 0 {
+		return UploadedObject{}, errNoParts
+	}
+	for i, p := range parts {
+		if p.Part != i+1 {
+			return UploadedObject{}, missingPart(i + 1)
+		}
+	}
+
+	//
+	// Join the parts, hashing them as we go.
+	//
+	hasher := sha1.New()
+	readers := make([]io.Reader, len(parts))
+	for i, p := range parts {
+		r := &partReader{path: fss.path(uploadDir, upload, partName(p.Part))}
+		defer r.Close()
+		readers[i] = r
+	}
+	content := &countingReader{reader: io.MultiReader(readers...)}
+
+	err = fss.moveTemp(io.TeeReader(content, hasher), fss.path(uploadDir, upload, "object"))
+	if err != nil {
+		return UploadedObject{}, err
+	}
+
+	//
+	// Recording the ID completes the upload, after which the
+	// parts are no longer required.
+	//
+	result := UploadedObject{ID: hex.EncodeToString(hasher.Sum(nil)), Size: content.count}
+	encoded, _ := json.Marshal(result)
+
+	err = fss.moveTemp(bytes.NewReader(encoded), fss.path(uploadDir, upload, "object.json"))
+	if err != nil {
+		return UploadedObject{}, err
+	}
+	for _, p := range parts {
+		os.Remove(fss.path(uploadDir, upload, partName(p.Part)))
+	}
+	return result, nil
+}
+
+//
+// partReader reads a single part of an upload, opening it upon the
+// first read, and closing it once it has been read completely.
+//
+// This means we only have one part open at a time, however many parts
+// an upload has.
+//
+type partReader struct {
+	path string
+	file *os.File
+	done bool
+}
+
+//
+// Read implements the io.Reader interface.
+//
+func (p *partReader) Read(buf []byte) (int, error) {
+	if p.done {
+		return 0, io.EOF
+	}
+	if p.file == nil {
+		file, err := os.Open(p.path)
+		if err != nil {
+			return 0, err
+		}
+		p.file = file
+	}
+
+	n, err := p.file.Read(buf)
+	if err != nil {
+		p.Close()
+		p.done = true
+	}
+	return n, err
+}
+
+//
+// Close closes the part, if it is open.
+//
+func (p *partReader) Close() error {
+	if p.file == nil {
+		return nil
+	}
+	err := p.file.Close()
+	p.file = nil
+	return err
+}
+
+// OpenUpload returns the object produced by completing an upload, along
+// with the parameters the upload was created with.
+func (fss *FilesystemStorage) OpenUpload(upload string) (io.ReadSeekCloser, map[string]string, error) {
+
+	if !fss.uploadExists(upload) {
+		return nil, nil, errUnknownUpload
+	}
+	obj, err := fss.uploaded(upload)
+	if err != nil {
+		return nil, nil, err
+	}
+	if obj == nil {
+		return nil, nil, errUploadIncomplete
+	}
+
+	params := make(map[string]string)
+	data, err := ioutil.ReadFile(fss.path(uploadDir, upload, "meta.json"))
+	if err == nil {
+		err = json.Unmarshal(data, &params)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(fss.path(uploadDir, upload, "object"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, params, nil
+}
+
+// CommitUpload stores the object produced by completing an upload.
+func (fss *FilesystemStorage) CommitUpload(upload string) (UploadedObject, error) {
+
+	data, params, err := fss.OpenUpload(upload)
+	if err != nil {
+		return UploadedObject{}, err
+	}
+	defer data.Close()
+
+	obj, err := fss.uploaded(upload)
+	if err != nil {
+		return UploadedObject{}, err
+	}
+
+	//
+	// Link the object into our temporary directory, which avoids
+	// copying it, but copy it if the filesystem doesn't allow that.
+	//
+	// The link keeps the time at which the upload was completed,
+	// whereas a deletion is judged against the time the object
+	// was stored, so it is updated to the present.
+	//
+	tmp := fss.path(tmpDir, "commit-"+upload)
+	os.Remove(tmp)
+	if os.Link(fss.path(uploadDir, upload, "object"), tmp) == nil {
+		now := time.Now()
+		err = os.Chtimes(tmp, now, now)
+	} else {
+		tmp, err = fss.writeTemp(data)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return UploadedObject{}, err
+	}
+	defer os.Remove(tmp)
+
+	if !fss.place(obj.ID, tmp, params) {
+		return UploadedObject{}, errors.New("failed to write to storage")
+	}
+	return *obj, nil
+}
+
+// AbortUpload removes an upload, along with its parts.
+func (fss *FilesystemStorage) AbortUpload(upload string) error {
+	if !fss.uploadExists(upload) {
+		return errUnknownUpload
+	}
+	return os.RemoveAll(fss.path(uploadDir, upload))
+}
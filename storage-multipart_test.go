@@ -0,0 +1,247 @@
+//
+// Test multipart uploads, in our storage layer.
+//
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+// Test an upload from beginning to end.
+//
+func TestMultipart(t *testing.T) {
+
+	//
+	// Create a temporary directory.
+	//
+	p, _ := ioutil.TempDir("tmp", "prefix")
+	defer os.RemoveAll(p)
+
+	//
+	// Init the filesystem storage-class
+	//
+	fss := new(FilesystemStorage)
+	fss.Setup(p)
+
+	//
+	// Parts of unknown uploads are rejected.
+	//
+	if _, err := fss.StorePart("missing", 1, strings.NewReader("x")); err != errUnknownUpload {
+		t.Errorf("Unexpected error storing a part of a missing upload: %v", err)
+	}
+
+	err := fss.CreateUpload("up", map[string]string{"X-Mime-Type": "text/plain"})
+	if err != nil {
+		t.Fatalf("Failed to create upload: %s", err.Error())
+	}
+	if fss.CreateUpload("up", nil) != errUploadExists {
+		t.Errorf("Created the same upload twice")
+	}
+
+	//
+	// Store some parts, out of order, with one resent.
+	//
+	parts := []struct {
+		part    int
+		content string
+	}{
+		{3, "three"},
+		{1, "junk"},
+		{1, "one "},
+	}
+	for _, part := range parts {
+		size, serr := fss.StorePart("up", part.part, strings.NewReader(part.content))
+		if serr != nil || size != int64(len(part.content)) {
+			t.Errorf("Failed to store part %d: %d %v", part.part, size, serr)
+		}
+	}
+	if _, err = fss.StorePart("up", 0, strings.NewReader("zero")); err == nil {
+		t.Errorf("Stored part zero")
+	}
+
+	//
+	// We can't complete with a part missing.
+	//
+	if _, err = fss.CompleteUpload("up"); err != missingPart(2) {
+		t.Errorf("Unexpected error completing with a missing part: %v", err)
+	}
+	if _, err = fss.StorePart("up", 2, strings.NewReader("two ")); err != nil {
+		t.Errorf("Failed to store part 2: %s", err.Error())
+	}
+
+	list, obj, err := fss.Parts("up")
+	if err != nil || obj != nil || len(list) != 3 {
+		t.Fatalf("Unexpected parts %v %v %v", list, obj, err)
+	}
+	for i, part := range list {
+		if part.Part != i+1 || part.Size != int64(len([]string{"one ", "two ", "three"}[i])) {
+			t.Errorf("Unexpected part %v", part)
+		}
+	}
+
+	//
+	// Parts can't be stored while the upload is being completed.
+	//
+	assembling.Lock()
+	assembling.uploads["up"] = true
+	assembling.Unlock()
+	_, err = fss.StorePart("up", 4, strings.NewReader("four"))
+	assembling.Lock()
+	delete(assembling.uploads, "up")
+	assembling.Unlock()
+	if err != errUploadBusy {
+		t.Errorf("Unexpected error storing a part during completion: %v", err)
+	}
+
+	//
+	// Reading before completion fails.
+	//
+	if _, _, err = fss.OpenUpload("up"); err != errUploadIncomplete {
+		t.Errorf("Unexpected error reading an incomplete upload: %v", err)
+	}
+
+	//
+	// Complete the upload.
+	//
+	content := "one two three"
+	hash := sha1.Sum([]byte(content))
+	id := hex.EncodeToString(hash[:])
+
+	result, err := fss.CompleteUpload("up")
+	if err != nil {
+		t.Fatalf("Failed to complete: %s", err.Error())
+	}
+	if result.ID != id || result.Size != int64(len(content)) {
+		t.Errorf("Unexpected result %v", result)
+	}
+
+	//
+	// Completing again is harmless, but adding parts isn't.
+	//
+	again, err := fss.CompleteUpload("up")
+	if err != nil || again != result {
+		t.Errorf("Unexpected result completing again %v %v", again, err)
+	}
+	if _, err = fss.StorePart("up", 4, strings.NewReader("four")); err != errUploadComplete {
+		t.Errorf("Unexpected error storing a part after completion: %v", err)
+	}
+	list, obj, _ = fss.Parts("up")
+	if len(list) != 0 || obj == nil || *obj != result {
+		t.Errorf("Unexpected parts after completion %v %v", list, obj)
+	}
+
+	//
+	// Read the object.
+	//
+	data, meta, err := fss.OpenUpload("up")
+	if err != nil {
+		t.Fatalf("Failed to read the upload: %s", err.Error())
+	}
+	read, _ := ioutil.ReadAll(data)
+	data.Close()
+	if string(read) != content || meta["X-Mime-Type"] != "text/plain" {
+		t.Errorf("Unexpected object '%s' %v", read, meta)
+	}
+
+	//
+	// Commit it, which stores it as a normal object.
+	//
+	// The object is stored now, however long ago the upload was
+	// completed.
+	//
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(p, uploadDir, "up", "object"), old, old)
+
+	if _, err = fss.CommitUpload("up"); err != nil {
+		t.Fatalf("Failed to commit: %s", err.Error())
+	}
+	info, err := os.Stat(fss.blobPath(id))
+	if err != nil || info.ModTime().Before(time.Now().Add(-time.Minute)) {
+		t.Errorf("The committed object has an old time %v %v", info, err)
+	}
+	data, meta = fss.Get(id)
+	if data == nil {
+		t.Fatalf("The committed object doesn't exist")
+	}
+	read, _ = ioutil.ReadAll(data)
+	data.Close()
+	if string(read) != content || meta["X-Mime-Type"] != "text/plain" {
+		t.Errorf("Unexpected object '%s' %v", read, meta)
+	}
+
+	//
+	// Now remove the upload, which leaves the object alone.
+	//
+	if err = fss.AbortUpload("up"); err != nil {
+		t.Errorf("Failed to abort: %s", err.Error())
+	}
+	if err = fss.AbortUpload("up"); err != errUnknownUpload {
+		t.Errorf("Unexpected error aborting twice: %v", err)
+	}
+	if !fss.Exists(id) {
+		t.Errorf("The object was removed with the upload")
+	}
+	if len(fss.Existing()) != 1 {
+		t.Errorf("Uploads were listed as objects")
+	}
+}
+
+//
+// Test that an upload with no parts cannot be completed.
+//
+func TestMultipartEmpty(t *testing.T) {
+
+	p, _ := ioutil.TempDir("tmp", "prefix")
+	defer os.RemoveAll(p)
+
+	fss := new(FilesystemStorage)
+	fss.Setup(p)
+
+	fss.CreateUpload("empty", nil)
+	if _, err := fss.CompleteUpload("empty"); err != errNoParts {
+		t.Errorf("Unexpected error completing an empty upload: %v", err)
+	}
+	if _, err := fss.CommitUpload("empty"); err != errUploadIncomplete {
+		t.Errorf("Unexpected error committing an empty upload: %v", err)
+	}
+}
+
+//
+// Test that abandoned uploads are removed.
+//
+func TestMultipartCleanup(t *testing.T) {
+
+	p, _ := ioutil.TempDir("tmp", "prefix")
+	defer os.RemoveAll(p)
+
+	fss := new(FilesystemStorage)
+	fss.Setup(p)
+
+	fss.CreateUpload("old", nil)
+	fss.CreateUpload("new", nil)
+
+	old := time.Now().Add(-2 * uploadMaxAge)
+	os.Chtimes(filepath.Join(p, uploadDir, "old"), old, old)
+
+	//
+	// Abandoned uploads are removed when we start, and whenever
+	// a new upload is begun.
+	//
+	fss.CreateUpload("another", nil)
+
+	if fss.uploadExists("old") {
+		t.Errorf("The abandoned upload wasn't removed")
+	}
+	if !fss.uploadExists("new") || !fss.uploadExists("another") {
+		t.Errorf("An active upload was removed")
+	}
+}
@@ -5,6 +5,8 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
+	"time"
 
 	"github.com/google/subcommands"
 )
@@ -22,12 +24,27 @@ import (
 // Options which may be set via flags for the "api-server" subcommand.
 //
 type apiServerCmd struct {
-	host    string
-	blob    string
-	dport   int
-	uport   int
-	dump    bool
-	verbose bool
+	host             string
+	blob             string
+	dport            int
+	uport            int
+	dump             bool
+	verbose          bool
+	minReplicas      int
+	minFree          string
+	capacityInterval time.Duration
+	placement        string
+	index            string
+	indexInterval    time.Duration
+	hedgeDelay       time.Duration
+	backendTimeout   time.Duration
+	healthInterval   time.Duration
+	healthTimeout    time.Duration
+	healthRise       int
+	healthFall       int
+	reloadInterval   time.Duration
+	zone             string
+	metaQuorum       int
 }
 
 //
@@ -51,6 +68,21 @@ func (p *apiServerCmd) SetFlags(f *flag.FlagSet) {
 	f.IntVar(&p.uport, "upload-port", 9991, "The port to bind upon for uploading objects.")
 	f.BoolVar(&p.dump, "dump", false, "Dump configuration and exit?")
 	f.BoolVar(&p.verbose, "verbose", false, "Show more output from the API-server.")
+	f.IntVar(&p.minReplicas, "min-replicas", 1, "The number of blob-servers, within a single group, which must store an upload before it succeeds.")
+	f.StringVar(&p.minFree, "min-free", "", "Don't upload to groups with less free space than this, e.g. \"10GB\".")
+	f.DurationVar(&p.capacityInterval, "capacity-interval", time.Minute, "How often to fetch the free space of each blob-server, zero to disable.")
+	f.StringVar(&p.index, "index", "", "The file to hold an index of object locations in (default no index).")
+	f.DurationVar(&p.indexInterval, "index-interval", 10*time.Minute, "How often to crawl the blob-servers to update the index, zero to disable.")
+	f.DurationVar(&p.hedgeDelay, "hedge-delay", 250*time.Millisecond, "How long to wait for a blob-server before also asking the next one for a download, zero to disable.")
+	f.DurationVar(&p.backendTimeout, "backend-timeout", 10*time.Second, "How long to wait for a blob-server to start replying to a download, or a multipart request, zero for no limit.")
+	f.DurationVar(&p.healthInterval, "health-interval", 5*time.Second, "How often to check that each blob-server is alive, zero to disable.")
+	f.DurationVar(&p.healthTimeout, "health-timeout", 2*time.Second, "How long to wait for a blob-server to reply to a health check.")
+	f.IntVar(&p.healthRise, "health-rise", 2, "The number of consecutive checks a blob-server must pass to be marked up.")
+	f.IntVar(&p.healthFall, "health-fall", 3, "The number of consecutive checks a blob-server must fail to be marked down.")
+	f.DurationVar(&p.reloadInterval, "reload-interval", 0, "How often to check our configuration files for changes, zero to only reload upon SIGHUP.")
+	f.StringVar(&p.placement, "placement", "ordered", "How objects are placed in groups: 'ordered' tries each group in turn, 'hash' derives the group from the object's ID.")
+	f.StringVar(&p.zone, "zone", "", "The zone we're running within, blob-servers in the same zone are preferred.")
+	f.IntVar(&p.metaQuorum, "meta-quorum", 0, "The number of blob-servers which must store a change to our metadata, such as the name of an object, before it succeeds (default a majority).")
 }
 
 //
@@ -58,7 +90,7 @@ func (p *apiServerCmd) SetFlags(f *flag.FlagSet) {
 //
 func (p *apiServerCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
 
-	apiServer(*p)
+	runAPIServer(*p)
 	return subcommands.ExitSuccess
 }
 
@@ -66,9 +98,12 @@ func (p *apiServerCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interfac
 // Options which may be set via flags for the "blob-server" subcommand.
 //
 type blobServerCmd struct {
-	store string
-	port  int
-	host  string
+	store         string
+	port          int
+	host          string
+	verify        bool
+	scrubInterval time.Duration
+	scrubRate     string
 }
 
 //
@@ -89,6 +124,9 @@ func (p *blobServerCmd) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&p.host, "host", "127.0.0.1", "The IP to listen upon")
 	f.IntVar(&p.port, "port", 3001, "The port to bind upon")
 	f.StringVar(&p.store, "store", "data", "The location to write the data  to")
+	f.BoolVar(&p.verify, "verify", true, "Reject uploads whose body doesn't match their SHA1 ID?")
+	f.DurationVar(&p.scrubInterval, "scrub-interval", 0, "Scrub our storage in the background, pausing this long between runs (0 to disable).")
+	f.StringVar(&p.scrubRate, "scrub-rate", "10MB/s", "The maximum rate at which background scrubbing reads data.")
 }
 
 //
@@ -104,8 +142,15 @@ func (p *blobServerCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interfa
 // Options which may be set via flags for the "replicate" subcommand.
 //
 type replicateCmd struct {
-	blob    string
-	verbose bool
+	blob           string
+	verbose        bool
+	daemon         bool
+	interval       time.Duration
+	statusHost     string
+	statusPort     int
+	workers        int
+	perDestination int
+	bwlimit        string
 }
 
 //
@@ -115,7 +160,8 @@ func (*replicateCmd) Name() string     { return "replicate" }
 func (*replicateCmd) Synopsis() string { return "Trigger replication." }
 func (*replicateCmd) Usage() string {
 	return `replication :
-  Trigger a single run of the replication/balancing operation.
+  Trigger a single run of the replication/balancing operation, or
+  with -daemon run it repeatedly.
 `
 }
 
@@ -125,14 +171,109 @@ func (*replicateCmd) Usage() string {
 func (p *replicateCmd) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&p.blob, "blob-server", "", "Comma-separated list of blob-servers to contact.")
 	f.BoolVar(&p.verbose, "verbose", false, "Be more verbose?")
+	f.BoolVar(&p.daemon, "daemon", false, "Run continuously, rather than once?")
+	f.DurationVar(&p.interval, "interval", 5*time.Minute, "The delay between replication runs, when running as a daemon.")
+	f.StringVar(&p.statusHost, "status-host", "127.0.0.1", "The IP to listen upon for status requests, when running as a daemon.")
+	f.IntVar(&p.statusPort, "status-port", 0, "The port to listen upon for status requests, when running as a daemon (0 to disable).")
+	f.IntVar(&p.workers, "workers", 4, "The number of objects to transfer in parallel.")
+	f.IntVar(&p.perDestination, "per-destination", 2, "The maximum number of parallel transfers to any one blob-server (0 for no limit).")
+	f.StringVar(&p.bwlimit, "bwlimit", "", "The maximum bandwidth to use for all transfers, e.g. 50MB/s (default unlimited).")
 }
 
 //
 // Entry-point - invoke the main replication-routine.
 //
-func (p *replicateCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+func (p *replicateCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	replicate(ctx, *p)
+	return subcommands.ExitSuccess
+}
+
+//
+// Options which may be set via flags for the "rebalance" subcommand.
+//
+type rebalanceCmd struct {
+	blob    string
+	dryRun  bool
+	verbose bool
+	bwlimit string
+}
+
+//
+// Glue
+//
+func (*rebalanceCmd) Name() string     { return "rebalance" }
+func (*rebalanceCmd) Synopsis() string { return "Move objects to the group their ID hashes to." }
+func (*rebalanceCmd) Usage() string {
+	return `rebalance :
+  Move every object into the group it belongs within, when the API-server
+  is placing objects by hash.  Run this after adding a group.
+`
+}
+
+//
+// Flag setup
+//
+func (p *rebalanceCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.blob, "blob-server", "", "Comma-separated list of blob-servers to contact.")
+	f.BoolVar(&p.dryRun, "dry-run", false, "Report the objects which would be moved, without moving them.")
+	f.BoolVar(&p.verbose, "verbose", false, "Be more verbose?")
+	f.StringVar(&p.bwlimit, "bwlimit", "", "The maximum bandwidth to use for all transfers, e.g. 50MB/s (default unlimited).")
+}
+
+//
+// Entry-point - invoke the rebalancer.
+//
+func (p *rebalanceCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	err := rebalance(*p)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+//
+// Options which may be set via flags for the "scrub" subcommand.
+//
+type scrubCmd struct {
+	store   string
+	rate    string
+	verbose bool
+}
+
+//
+// Glue
+//
+func (*scrubCmd) Name() string     { return "scrub" }
+func (*scrubCmd) Synopsis() string { return "Check stored objects for corruption." }
+func (*scrubCmd) Usage() string {
+	return `scrub :
+  Re-hash every object held by a blob-server, and quarantine any which
+  no longer match their ID.
+`
+}
+
+//
+// Flag setup
+//
+func (p *scrubCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.store, "store", "data", "The location of the blob-server's data")
+	f.StringVar(&p.rate, "rate", "", "The maximum rate at which to read data, e.g. 50MB/s (default unlimited).")
+	f.BoolVar(&p.verbose, "verbose", false, "Be more verbose?")
+}
+
+//
+// Entry-point - invoke the scrubber.
+//
+func (p *scrubCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
 
-	replicate(*p)
+	err := scrub(*p)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err.Error())
+		return subcommands.ExitFailure
+	}
 	return subcommands.ExitSuccess
 }
 